@@ -15,25 +15,741 @@
 package httprequest
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// DefaultMaxBytes is the default limit on the size of a response; we expect responses to be much smaller.
+	DefaultMaxBytes = 1024 * 1024 * 10
+	// DefaultUserAgent is the default User-Agent header sent with every request.
+	DefaultUserAgent = "istio-operator"
+)
+
+var (
+	// ErrResponseTooLarge is returned when a response is larger than the size limit of the request.
+	ErrResponseTooLarge = errors.New("response exceeds the size limit")
+	// ErrTooManyRedirects is returned when a request is redirected more times than allowed by its options.
+	ErrTooManyRedirects = errors.New("too many redirects")
+	// ErrNotModified is returned by a conditional request when the resource still has the given ETag.
+	ErrNotModified = errors.New("not modified")
+)
+
+// Options configures requests. Zero valued fields fall back to Defaults, except that the transport options
+// (TLSConfig, SocketPath, ConnectTimeout and ResponseHeaderTimeout) and Client replace each other: a call
+// setting any transport option does not inherit Defaults.Client, and a call setting Client does not inherit
+// the transport options of Defaults.
+type Options struct {
+	// Timeout limits the time taken by a request, including reading the response. Zero falls back to
+	// Defaults, which sets no timeout unless configured; a negative value means no timeout.
+	Timeout time.Duration
+	// MaxBytes limits the size of a response. Larger responses fail with ErrResponseTooLarge. Zero falls back
+	// to Defaults; a negative value means no limit, e.g. to download large files.
+	MaxBytes int64
+	// UserAgent is sent in the User-Agent header. DefaultUserAgent is sent when neither the options nor
+	// Defaults set one, rather than the Go default that some servers reject.
+	UserAgent string
+	// Client sends the requests, e.g. to configure TLS, proxies or connection pooling. Nil falls back to
+	// Defaults unless a transport option is set; http.DefaultClient is used when neither sets one.
+	Client *http.Client
+	// TLSConfig configures the TLS connections of the default transport, e.g. to trust a private CA.
+	// It cannot be combined with Client, whose transport must be configured instead. Nil falls back to
+	// Defaults unless Client is set.
+	TLSConfig *tls.Config
+	// Context, if set, cancels the request and any retry. The Timeout applies to each attempt.
+	Context context.Context
+	// Attempts is the number of attempts made at a request failing with a connection error or
+	// a retriable status. A single attempt is made when it is 1 or less.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled after each attempt.
+	Backoff time.Duration
+	// Decompress, if true, requests gzip or deflate encoded responses and decodes them, so that the size
+	// limit applies to the decoded response whatever the client. The default transport already requests and
+	// decodes gzip responses by itself, so the option mostly adds deflate support, and decoding for clients
+	// whose transport disables compression. Nil falls back to Defaults; false turns it off even if Defaults
+	// turns it on.
+	Decompress *bool
+	// Auth holds the credentials sent with the requests, if any.
+	Auth *Auth
+	// SocketPath, if set, sends the requests over the Unix domain socket at the path, e.g. to reach
+	// a local agent. The host of the URL is then only used for the Host header. It cannot be combined
+	// with Client, whose transport must be configured instead. Empty falls back to Defaults unless Client
+	// is set.
+	SocketPath string
+	// Hook, if set, observes every attempt at a request, e.g. to record metrics or traces.
+	Hook Hook
+	// MaxRedirects limits the redirects followed by a request, which then fails with ErrTooManyRedirects.
+	// The redirect policy of the client applies when zero, which for the default client is 10 redirects.
+	MaxRedirects int
+	// ConnectTimeout limits the time taken to connect to the server, so that an unreachable server fails fast
+	// while the Timeout still leaves time to a slow one. It cannot be combined with Client, whose transport
+	// must be configured instead. Zero falls back to Defaults unless Client is set; a negative value means
+	// no connect timeout.
+	ConnectTimeout time.Duration
+	// ResponseHeaderTimeout limits the wait for the response headers once the request is sent. The time taken
+	// to read the body is only limited by the Timeout. It cannot be combined with Client either. Zero falls
+	// back to Defaults unless Client is set; a negative value means no response header timeout.
+	ResponseHeaderTimeout time.Duration
+	// NoRedirects, if true, forbids redirects, e.g. so that a redirect cannot send a request to an unexpected
+	// host. A redirect response then fails with a StatusError. It takes precedence over MaxRedirects.
+	// Nil falls back to Defaults; false allows redirects even if Defaults forbids them.
+	NoRedirects *bool
+
+	// ifNoneMatch is the ETag sent in the If-None-Match header of conditional requests.
+	ifNoneMatch string
+}
+
+// Bool returns a pointer to v, to set the boolean options that fall back to Defaults when nil.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// isSet returns whether an optional boolean option is set to true.
+func isSet(v *bool) bool {
+	return v != nil && *v
+}
+
+// Hook observes the requests, e.g. to record metrics or traces. It must be safe for concurrent use.
+type Hook interface {
+	// Observe is called once an attempt at a request completes, whether it succeeded or not.
+	Observe(info RequestInfo)
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(info RequestInfo)
+
+// Observe calls f.
+func (f HookFunc) Observe(info RequestInfo) {
+	f(info)
+}
+
+// RequestInfo describes an attempt at a request.
+type RequestInfo struct {
+	Method string
+	URL    string
+	// StatusCode is the status of the response, or 0 if none was received.
+	StatusCode int
+	Duration   time.Duration
+	// Bytes is the number of bytes read from the body of the response.
+	Bytes int64
+	// Err is the error the attempt failed with, if any.
+	Err error
+}
+
+// Auth holds the credentials of a request, either HTTP Basic credentials or a bearer token.
+type Auth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// String does not print the secrets, so that credentials are not logged by accident.
+func (a *Auth) String() string {
+	switch {
+	case a == nil:
+		return "none"
+	case a.BearerToken != "":
+		return "bearer token"
+	default:
+		return fmt.Sprintf("basic auth for user %q", a.Username)
+	}
+}
+
+// GoString does not print the secrets either.
+func (a *Auth) GoString() string {
+	return a.String()
+}
+
+// apply sets the Authorization header of the request.
+func (a *Auth) apply(req *http.Request) error {
+	switch {
+	case a == nil:
+		return nil
+	case a.BearerToken != "" && (a.Username != "" || a.Password != ""):
+		return errors.New("basic auth credentials cannot be set along with a bearer token")
+	case a.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	default:
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	return nil
+}
+
+// Defaults holds the options used by every request unless overridden per call. It is meant to be set
+// once at startup, before any request is made.
+var Defaults = Options{
+	MaxBytes:  DefaultMaxBytes,
+	UserAgent: DefaultUserAgent,
+}
+
+// withDefaults returns the options with zero valued fields taken from Defaults.
+func (o Options) withDefaults() Options {
+	// Client and the transport options replace each other, so that a call can configure the transport
+	// whatever the defaults, and the other way around.
+	if o.Client == nil && !o.shapesTransport() {
+		o.Client = Defaults.Client
+	}
+	if o.Client == nil {
+		if o.TLSConfig == nil {
+			o.TLSConfig = Defaults.TLSConfig
+		}
+		if o.SocketPath == "" {
+			o.SocketPath = Defaults.SocketPath
+		}
+		if o.ConnectTimeout == 0 {
+			o.ConnectTimeout = Defaults.ConnectTimeout
+		}
+		if o.ResponseHeaderTimeout == 0 {
+			o.ResponseHeaderTimeout = Defaults.ResponseHeaderTimeout
+		}
+	}
+	if o.Timeout == 0 {
+		o.Timeout = Defaults.Timeout
+	}
+	if o.MaxBytes == 0 {
+		o.MaxBytes = Defaults.MaxBytes
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = Defaults.UserAgent
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = DefaultUserAgent
+	}
+	if o.Attempts == 0 {
+		o.Attempts = Defaults.Attempts
+	}
+	if o.Backoff == 0 {
+		o.Backoff = Defaults.Backoff
+	}
+	if o.Decompress == nil {
+		o.Decompress = Defaults.Decompress
+	}
+	if o.Auth == nil {
+		o.Auth = Defaults.Auth
+	}
+	if o.Hook == nil {
+		o.Hook = Defaults.Hook
+	}
+	if o.MaxRedirects == 0 {
+		o.MaxRedirects = Defaults.MaxRedirects
+	}
+	if o.NoRedirects == nil {
+		o.NoRedirects = Defaults.NoRedirects
+	}
+	return o
+}
+
+// shapesTransport returns whether the options set any option configuring the transport, which cannot be
+// combined with Client.
+func (o Options) shapesTransport() bool {
+	return o.TLSConfig != nil || o.SocketPath != "" || o.ConnectTimeout != 0 || o.ResponseHeaderTimeout != 0
+}
+
+// client returns the client sending the requests.
+func (o Options) client() (*http.Client, error) {
+	c, err := o.baseClient()
+	if err != nil || (o.MaxRedirects == 0 && !isSet(o.NoRedirects)) {
+		return c, err
+	}
+	// The client may be shared, so the redirect policy is set on a copy.
+	withPolicy := *c
+	withPolicy.CheckRedirect = o.checkRedirect
+	return &withPolicy, nil
+}
+
+// checkRedirect applies the redirect policy of the options, via holding the requests made so far.
+func (o Options) checkRedirect(_ *http.Request, via []*http.Request) error {
+	if isSet(o.NoRedirects) {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > o.MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d", ErrTooManyRedirects, o.MaxRedirects)
+	}
+	return nil
+}
+
+// baseClient returns the client sending the requests, before any redirect policy is applied.
+func (o Options) baseClient() (*http.Client, error) {
+	switch {
+	case o.Client != nil && o.TLSConfig != nil:
+		return nil, errors.New("a TLS config cannot be set along with a client")
+	case o.Client != nil && o.SocketPath != "":
+		return nil, errors.New("a socket path cannot be set along with a client")
+	case o.Client != nil && (o.ConnectTimeout > 0 || o.ResponseHeaderTimeout > 0):
+		return nil, errors.New("connect and response header timeouts cannot be set along with a client")
+	case o.Client != nil:
+		return o.Client, nil
+	case o.TLSConfig == nil && o.SocketPath == "" && o.ConnectTimeout <= 0 && o.ResponseHeaderTimeout <= 0:
+		return http.DefaultClient, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = o.TLSConfig
+	if o.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.SocketPath != "" {
+		dialer := &net.Dialer{}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", o.SocketPath)
+		}
+	}
+	if o.ConnectTimeout > 0 {
+		transport.DialContext = withConnectTimeout(transport.DialContext, o.ConnectTimeout)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// dialFunc dials the connections of a transport.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// withConnectTimeout bounds the time taken by dial. The connections are not affected once established.
+func withConnectTimeout(dial dialFunc, timeout time.Duration) dialFunc {
+	return func(parent context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		// The request may have been canceled or timed out first, in which case the connect timeout is not at fault.
+		if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return nil, fmt.Errorf("failed to connect to %s within %v: %w", addr, timeout, err)
+		}
+		return conn, err
+	}
+}
+
+// NewTLSConfig returns a TLS config trusting the certificates of the PEM encoded CA bundle, in addition to
+// the system roots. The certificates of servers are not verified if insecureSkipVerify is set.
+func NewTLSConfig(caBundle []byte, insecureSkipVerify bool) (*tls.Config, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if len(caBundle) > 0 && !pool.AppendCertsFromPEM(caBundle) {
+		return nil, errors.New("failed to parse the CA bundle")
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		InsecureSkipVerify: insecureSkipVerify, // nolint: gosec
+	}, nil
+}
+
 // Get sends an HTTP GET request and returns the result.
 func Get(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	return GetWithOptions(url, Options{})
+}
+
+// GetWithLimit sends an HTTP GET request and returns the result, failing with ErrResponseTooLarge if it
+// is larger than maxBytes.
+func GetWithLimit(url string, maxBytes int64) ([]byte, error) {
+	return GetWithOptions(url, Options{MaxBytes: maxBytes})
+}
+
+// GetWithClient sends an HTTP GET request with the given client and returns the result.
+func GetWithClient(c *http.Client, url string) ([]byte, error) {
+	return GetWithOptions(url, Options{Client: c})
+}
+
+// GetWithAuth sends an HTTP GET request with the given credentials and returns the result.
+func GetWithAuth(url string, auth *Auth) ([]byte, error) {
+	return GetWithOptions(url, Options{Auth: auth})
+}
+
+// GetWithRetry sends an HTTP GET request and returns the result, making up to the given number of attempts
+// when the request fails with a connection error or a retriable status. The wait between attempts starts
+// at backoff and doubles after each attempt. The last error is returned when all attempts fail.
+func GetWithRetry(url string, attempts int, backoff time.Duration) ([]byte, error) {
+	return GetWithOptions(url, Options{Attempts: attempts, Backoff: backoff})
+}
+
+// GetWithOptions sends an HTTP GET request with the given options and returns the result.
+func GetWithOptions(url string, opts Options) ([]byte, error) {
+	ret, _, err := get(url, opts)
+	return ret, err
+}
+
+// GetConditional sends an HTTP GET request with the ETag of the last result in the If-None-Match header, and
+// returns the result along with its ETag. It fails with ErrNotModified when the resource did not change, so
+// that callers polling a resource can skip processing it again. The request is unconditional if etag is empty.
+func GetConditional(url, etag string) ([]byte, string, error) {
+	return GetConditionalWithOptions(url, etag, Options{})
+}
+
+// GetConditionalWithOptions is like GetConditional, sending the request with the given options.
+func GetConditionalWithOptions(url, etag string, opts Options) ([]byte, string, error) {
+	opts.ifNoneMatch = etag
+	ret, header, err := get(url, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	return ret, header.Get("ETag"), nil
+}
+
+// get sends an HTTP GET request with the given options and returns the result and the response headers.
+func get(url string, opts Options) ([]byte, http.Header, error) {
+	if err := validateURL(url); err != nil {
+		return nil, nil, err
+	}
+	opts = opts.withDefaults()
+	var ret []byte
+	var header http.Header
+	err := opts.retry(func(ctx context.Context) (err error) {
+		start := time.Now()
+		resp, cancel, err := send(ctx, url, opts)
+		defer func() {
+			opts.observe(url, start, resp, int64(len(ret)), err)
+		}()
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		defer resp.Body.Close()
+		header = resp.Header
+		// Read one byte past the limit to tell a response at the limit from a larger one.
+		body := io.Reader(resp.Body)
+		if opts.MaxBytes >= 0 {
+			body = io.LimitReader(resp.Body, opts.MaxBytes+1)
+		}
+		ret, err = io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if opts.MaxBytes >= 0 && int64(len(ret)) > opts.MaxBytes {
+			return fmt.Errorf("failed to fetch URL %s : %w of %d bytes", url, ErrResponseTooLarge, opts.MaxBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return ret, header, nil
+}
+
+// GetAll sends HTTP GET requests for the URLs, at most concurrency at a time, and returns the results of the
+// requests that succeeded and the errors of the ones that failed, keyed by URL. A URL listed several times
+// is only fetched once. Requests are sent one at a time when concurrency is less than 1.
+func GetAll(urls []string, concurrency int) (map[string][]byte, map[string]error) {
+	return GetAllWithOptions(urls, concurrency, Options{})
+}
+
+// GetAllWithOptions is like GetAll, sending every request with the given options.
+func GetAllWithOptions(urls []string, concurrency int, opts Options) (map[string][]byte, map[string]error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(map[string][]byte, len(urls))
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(chan string)
+	for i := 0; i < concurrency && i < len(urls); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range pending {
+				data, err := GetWithOptions(url, opts)
+				mu.Lock()
+				if err != nil {
+					errs[url] = err
+				} else {
+					results[url] = data
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	seen := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		if !seen[url] {
+			seen[url] = true
+			pending <- url
+		}
+	}
+	close(pending)
+	wg.Wait()
+	return results, errs
+}
+
+// maxSnippetBytes limits the part of a malformed response quoted in errors.
+const maxSnippetBytes = 100
+
+// GetJSON sends an HTTP GET request and unmarshals the JSON result into v.
+func GetJSON(url string, v any) error {
+	return GetJSONWithOptions(url, v, Options{})
+}
+
+// GetJSONWithOptions sends an HTTP GET request with the given options and unmarshals the JSON result into v.
+func GetJSONWithOptions(url string, v any, opts Options) error {
+	data, err := GetWithOptions(url, opts)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		snippet := data
+		if len(snippet) > maxSnippetBytes {
+			snippet = snippet[:maxSnippetBytes]
+		}
+		return fmt.Errorf("failed to parse the JSON response of URL %s : %v, response starts with %q", url, err, snippet)
+	}
+	return nil
+}
+
+// Download sends an HTTP GET request and streams the result to w, returning the number of bytes copied.
+// Unlike Get, the size of the response is not limited.
+func Download(url string, w io.Writer) (int64, error) {
+	return DownloadWithOptions(url, w, Options{MaxBytes: -1})
+}
+
+// DownloadWithOptions sends an HTTP GET request with the given options and streams the result to w,
+// returning the number of bytes copied. The size of the response is limited like for Get, by opts.MaxBytes
+// or else Defaults.MaxBytes: no more than MaxBytes are written before failing with ErrResponseTooLarge.
+// A negative MaxBytes lifts the limit.
+// Failed attempts are only retried until the response starts streaming.
+func DownloadWithOptions(url string, w io.Writer, opts Options) (int64, error) {
+	if err := validateURL(url); err != nil {
+		return 0, err
+	}
+	opts = opts.withDefaults()
+	var resp *http.Response
+	var cancel context.CancelFunc
+	var start time.Time
+	err := opts.retry(func(ctx context.Context) (err error) {
+		start = time.Now()
+		resp, cancel, err = send(ctx, url, opts)
+		if err != nil {
+			opts.observe(url, start, nil, 0, err)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch URL %s : %s", url, resp.Status)
+	n, err := copyBody(w, resp.Body, url, opts.MaxBytes)
+	opts.observe(url, start, resp, n, err)
+	return n, err
+}
+
+// validateURL checks that the URL is an absolute http or https URL, so that a mistyped or unexpected URL,
+// e.g. a file path, fails with a clear error before any request is sent. Requests over a Unix domain socket
+// also use an http URL, whose host is only sent in the Host header.
+func validateURL(rawURL string) error {
+	if rawURL == "" {
+		return errors.New("failed to fetch URL: the URL is empty")
 	}
-	// Limit requests to 10mb; we expect response to be much smaller
-	ret, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024*10))
+	u, err := url.Parse(rawURL)
 	if err != nil {
+		return fmt.Errorf("failed to fetch URL %s : %v", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("failed to fetch URL %s : unsupported scheme %q, only http and https are supported", rawURL, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("failed to fetch URL %s : the URL has no host", rawURL)
+	}
+	return nil
+}
+
+// copyBody copies the body to w, failing with ErrResponseTooLarge once maxBytes are copied if it is set.
+func copyBody(w io.Writer, body io.Reader, url string, maxBytes int64) (int64, error) {
+	if maxBytes <= 0 {
+		return io.Copy(w, body)
+	}
+	n, err := io.Copy(w, io.LimitReader(body, maxBytes))
+	if err != nil {
+		return n, err
+	}
+	if m, _ := io.ReadFull(body, make([]byte, 1)); m > 0 {
+		return n, fmt.Errorf("failed to fetch URL %s : %w of %d bytes", url, ErrResponseTooLarge, maxBytes)
+	}
+	return n, nil
+}
+
+// observe reports an attempt at a request to the hook, if any.
+func (o Options) observe(url string, start time.Time, resp *http.Response, bytes int64, err error) {
+	if o.Hook == nil {
+		return
+	}
+	info := RequestInfo{
+		Method:   http.MethodGet,
+		URL:      url,
+		Duration: time.Since(start),
+		Bytes:    bytes,
+		Err:      err,
+	}
+	var statusErr *StatusError
+	if resp != nil {
+		info.StatusCode = resp.StatusCode
+	} else if errors.As(err, &statusErr) {
+		info.StatusCode = statusErr.StatusCode
+	}
+	o.Hook.Observe(info)
+}
+
+// retry calls f until it succeeds, fails with an error that is not retriable, or the attempts are exhausted.
+func (o Options) retry(f func(ctx context.Context) error) error {
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	backoff := o.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || attempt >= o.Attempts || !retriable(ctx, err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send sends the request and checks the status of the response. The caller must close the body of
+// the response, then call the returned function to release the resources of the request.
+func send(ctx context.Context, url string, opts Options) (*http.Response, context.CancelFunc, error) {
+	// The timeout is applied to the request rather than the client, which may be shared.
+	cancel := context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+	resp, err := doSend(ctx, url, opts)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+func doSend(ctx context.Context, url string, opts Options) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", opts.UserAgent)
+	if opts.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", opts.ifNoneMatch)
+	}
+	if isSet(opts.Decompress) {
+		// Setting the header explicitly stops the transport from decoding gzip responses itself.
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	if err := opts.Auth.apply(req); err != nil {
+		return nil, err
+	}
+	client, err := opts.client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, ErrTooManyRedirects) {
 		return nil, err
 	}
-	return ret, nil
+	if err != nil {
+		return nil, &connectionError{err: err}
+	}
+	if resp.StatusCode == http.StatusNotModified && opts.ifNoneMatch != "" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch URL %s : %w", url, ErrNotModified)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if isSet(opts.Decompress) {
+		if err := decodeBody(resp); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch URL %s : %v", url, err)
+		}
+	}
+	return resp, nil
+}
+
+// decodeBody replaces the body of the response with its decoded content, according to its encoding.
+func decodeBody(resp *http.Response) error {
+	var decoder io.ReadCloser
+	var err error
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		decoder, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		decoder, err = zlib.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = &decodedBody{ReadCloser: decoder, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// decodedBody reads the decoded content of a body, closing both on Close.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
+
+// StatusError is returned when a request is answered with a status other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to fetch URL %s : %s", e.URL, e.Status)
+}
+
+// connectionError wraps the errors sending a request or receiving the response headers.
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+// retriable returns whether a request failing with the error may succeed when retried.
+func retriable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var connErr *connectionError
+	return errors.As(err, &connErr)
 }
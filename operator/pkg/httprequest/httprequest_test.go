@@ -15,9 +15,23 @@
 package httprequest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGet(t *testing.T) {
@@ -51,3 +65,1135 @@ func TestGet(t *testing.T) {
 		})
 	}
 }
+
+func TestGetWithOptions(t *testing.T) {
+	tests := []struct {
+		desc              string
+		defaults          Options
+		opts              Options
+		expectedData      string
+		expectedUserAgent string
+		slow              bool
+		expectErr         bool
+	}{
+		{
+			desc:              "defaults",
+			defaults:          Defaults,
+			expectedData:      "fooey-baroque",
+			expectedUserAgent: DefaultUserAgent,
+		},
+		{
+			desc:              "package defaults",
+			defaults:          Options{MaxBytes: 20, UserAgent: "operator-test"},
+			expectedData:      "fooey-baroque",
+			expectedUserAgent: "operator-test",
+		},
+		{
+			desc:              "per call override",
+			defaults:          Options{MaxBytes: 5, UserAgent: "operator-test"},
+			opts:              Options{MaxBytes: 20, UserAgent: "per-call"},
+			expectedData:      "fooey-baroque",
+			expectedUserAgent: "per-call",
+		},
+		{
+			desc:      "package size limit",
+			defaults:  Options{MaxBytes: 5},
+			expectErr: true,
+		},
+		{
+			desc:      "package timeout",
+			defaults:  Options{Timeout: time.Millisecond},
+			expectErr: true,
+		},
+		{
+			desc:     "per call timeout",
+			defaults: Defaults,
+			opts:     Options{Timeout: time.Millisecond},
+			// The timeout is hit while the server sleeps.
+			expectErr: true,
+		},
+		{
+			desc:         "per call no timeout",
+			defaults:     Options{MaxBytes: 20, Timeout: time.Millisecond},
+			opts:         Options{Timeout: -1},
+			slow:         true,
+			expectedData: "fooey-baroque",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if tt.expectErr || tt.slow {
+					time.Sleep(100 * time.Millisecond)
+				}
+				if got := req.Header.Get("User-Agent"); tt.expectedUserAgent != "" && got != tt.expectedUserAgent {
+					t.Errorf("%s: got User-Agent %q, want %q", tt.desc, got, tt.expectedUserAgent)
+				}
+				rw.Write([]byte("fooey-baroque"))
+			}))
+			defer testServer.Close()
+			defaults := Defaults
+			Defaults = tt.defaults
+			defer func() { Defaults = defaults }()
+
+			response, err := GetWithOptions(testServer.URL, tt.opts)
+			if gotErr := err != nil; gotErr != tt.expectErr {
+				t.Fatalf("%s: got error %v, want error %v", tt.desc, err, tt.expectErr)
+			}
+			if tt.expectedData != string(response) {
+				t.Errorf("Returned unexpected response, want: %s, got: %s", tt.expectedData, string(response))
+			}
+		})
+	}
+}
+
+func TestGetWithLimit(t *testing.T) {
+	const data = "fooey-baroque"
+	tests := []struct {
+		desc         string
+		maxBytes     int64
+		expectedData string
+		expectErr    bool
+	}{
+		{
+			desc:         "under limit",
+			maxBytes:     int64(len(data)) + 1,
+			expectedData: data,
+		},
+		{
+			desc:         "at limit",
+			maxBytes:     int64(len(data)),
+			expectedData: data,
+		},
+		{
+			desc:      "over limit",
+			maxBytes:  int64(len(data)) - 1,
+			expectErr: true,
+		},
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(data))
+	}))
+	defer testServer.Close()
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			response, err := GetWithLimit(testServer.URL, tt.maxBytes)
+			if tt.expectErr {
+				if !errors.Is(err, ErrResponseTooLarge) {
+					t.Fatalf("%s: got error %v, want %v", tt.desc, err, ErrResponseTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected Error In Making Request: %s", err.Error())
+			}
+			if tt.expectedData != string(response) {
+				t.Errorf("Returned unexpected response, want: %s, got: %s", tt.expectedData, string(response))
+			}
+		})
+	}
+}
+
+// roundTripperFunc serves requests without a network.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGetWithClient(t *testing.T) {
+	var requested string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = req.URL.String()
+		status := http.StatusOK
+		if req.URL.Path == "/missing" {
+			status = http.StatusNotFound
+		}
+		return &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Body:       io.NopCloser(strings.NewReader("fooey-baroque")),
+			Request:    req,
+		}, nil
+	})}
+
+	response, err := GetWithClient(client, "http://example.com/fooey")
+	if err != nil {
+		t.Fatalf("Unexpected Error In Making Request: %s", err.Error())
+	}
+	if requested != "http://example.com/fooey" {
+		t.Errorf("request made to wrong URL, got %s", requested)
+	}
+	if string(response) != "fooey-baroque" {
+		t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+	}
+
+	// The status and size checks still apply with a custom client.
+	if _, err := GetWithClient(client, "http://example.com/missing"); err == nil {
+		t.Errorf("expected an error for a non 200 response")
+	}
+	if _, err := GetWithOptions("http://example.com/fooey", Options{Client: client, MaxBytes: 5}); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("got error %v, want %v", err, ErrResponseTooLarge)
+	}
+}
+
+func TestGetWithTLSConfig(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testServer.Certificate().Raw})
+
+	trusted, err := NewTLSConfig(caBundle, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insecure, err := NewTLSConfig(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc      string
+		defaults  Options
+		opts      Options
+		expectErr bool
+	}{
+		{
+			desc:      "standard verification",
+			expectErr: true,
+		},
+		{
+			desc: "custom CA",
+			opts: Options{TLSConfig: trusted},
+		},
+		{
+			desc: "skip verify",
+			opts: Options{TLSConfig: insecure},
+		},
+		{
+			desc:      "client and TLS config",
+			opts:      Options{TLSConfig: trusted, Client: testServer.Client()},
+			expectErr: true,
+		},
+		{
+			desc:     "per call TLS config with a default client",
+			defaults: Options{Client: &http.Client{}},
+			opts:     Options{TLSConfig: trusted},
+		},
+		{
+			desc:     "per call client with a default TLS config",
+			defaults: Options{TLSConfig: insecure},
+			opts:     Options{Client: testServer.Client()},
+		},
+		{
+			desc:      "default client",
+			defaults:  Options{Client: &http.Client{}},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			defaults := Defaults
+			Defaults.Client = tt.defaults.Client
+			Defaults.TLSConfig = tt.defaults.TLSConfig
+			defer func() { Defaults = defaults }()
+
+			response, err := GetWithOptions(testServer.URL, tt.opts)
+			if gotErr := err != nil; gotErr != tt.expectErr {
+				t.Fatalf("%s: got error %v, want error %v", tt.desc, err, tt.expectErr)
+			}
+			if !tt.expectErr && string(response) != "fooey-baroque" {
+				t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+			}
+		})
+	}
+
+	if _, err := NewTLSConfig([]byte("not a certificate"), false); err == nil {
+		t.Errorf("expected an error for an invalid CA bundle")
+	}
+}
+
+func TestGetWithRetry(t *testing.T) {
+	tests := []struct {
+		desc             string
+		failures         int
+		status           int
+		attempts         int
+		expectedRequests int32
+		expectErr        bool
+	}{
+		{
+			desc:             "fail twice then succeed",
+			failures:         2,
+			status:           http.StatusServiceUnavailable,
+			attempts:         3,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "attempts exhausted",
+			failures:         3,
+			status:           http.StatusBadGateway,
+			attempts:         3,
+			expectedRequests: 3,
+			expectErr:        true,
+		},
+		{
+			desc:             "not retriable",
+			failures:         1,
+			status:           http.StatusNotFound,
+			attempts:         3,
+			expectedRequests: 1,
+			expectErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var requests int32
+			testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= int32(tt.failures) {
+					rw.WriteHeader(tt.status)
+					return
+				}
+				rw.Write([]byte("fooey-baroque"))
+			}))
+			defer testServer.Close()
+
+			response, err := GetWithRetry(testServer.URL, tt.attempts, time.Millisecond)
+			if gotErr := err != nil; gotErr != tt.expectErr {
+				t.Fatalf("%s: got error %v, want error %v", tt.desc, err, tt.expectErr)
+			}
+			var statusErr *StatusError
+			if tt.expectErr && (!errors.As(err, &statusErr) || statusErr.StatusCode != tt.status) {
+				t.Errorf("%s: got error %v, want status %d", tt.desc, err, tt.status)
+			}
+			if !tt.expectErr && string(response) != "fooey-baroque" {
+				t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.expectedRequests {
+				t.Errorf("%s: got %d requests, want %d", tt.desc, got, tt.expectedRequests)
+			}
+		})
+	}
+}
+
+func TestGetWithRetryConnectionError(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	url := testServer.URL
+	testServer.Close()
+
+	if _, err := GetWithRetry(url, 2, time.Millisecond); err == nil {
+		t.Fatalf("expected a connection error")
+	}
+
+	// Cancelling the context stops the retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := GetWithOptions(url, Options{Context: ctx, Attempts: 5, Backoff: time.Hour}); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if time.Since(start) > time.Minute {
+		t.Errorf("retries were not cancelled")
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestDownload(t *testing.T) {
+	data := strings.Repeat("fooey-baroque", 1024)
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte(data))
+	}))
+	defer testServer.Close()
+
+	t.Run("buffer", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := Download(testServer.URL, &buf)
+		if err != nil {
+			t.Fatalf("Unexpected Error In Making Request: %s", err.Error())
+		}
+		if n != int64(len(data)) || buf.String() != data {
+			t.Errorf("got %d bytes, want %d", n, len(data))
+		}
+	})
+	t.Run("failing writer", func(t *testing.T) {
+		if _, err := Download(testServer.URL, failingWriter{}); err == nil {
+			t.Errorf("expected the write error")
+		}
+	})
+	t.Run("status", func(t *testing.T) {
+		var buf bytes.Buffer
+		var statusErr *StatusError
+		if _, err := Download(testServer.URL+"/missing", &buf); !errors.As(err, &statusErr) {
+			t.Errorf("got error %v, want a status error", err)
+		}
+	})
+	t.Run("max bytes", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := DownloadWithOptions(testServer.URL, &buf, Options{MaxBytes: 100})
+		if !errors.Is(err, ErrResponseTooLarge) {
+			t.Fatalf("got error %v, want %v", err, ErrResponseTooLarge)
+		}
+		if n != 100 || buf.Len() != 100 {
+			t.Errorf("got %d bytes written, want 100", buf.Len())
+		}
+		if _, err := DownloadWithOptions(testServer.URL, &buf, Options{MaxBytes: int64(len(data))}); err != nil {
+			t.Errorf("Unexpected Error In Making Request: %s", err.Error())
+		}
+	})
+	t.Run("default max bytes", func(t *testing.T) {
+		defaults := Defaults
+		Defaults.MaxBytes = 100
+		defer func() { Defaults = defaults }()
+
+		var buf bytes.Buffer
+		if _, err := DownloadWithOptions(testServer.URL, &buf, Options{}); !errors.Is(err, ErrResponseTooLarge) {
+			t.Errorf("got error %v, want %v", err, ErrResponseTooLarge)
+		}
+		buf.Reset()
+		if n, err := DownloadWithOptions(testServer.URL, &buf, Options{MaxBytes: -1}); err != nil || n != int64(len(data)) {
+			t.Errorf("got %d bytes and error %v, want %d bytes", n, err, len(data))
+		}
+		buf.Reset()
+		if n, err := Download(testServer.URL, &buf); err != nil || n != int64(len(data)) {
+			t.Errorf("got %d bytes and error %v, want %d bytes", n, err, len(data))
+		}
+		if response, err := GetWithOptions(testServer.URL, Options{MaxBytes: -1}); err != nil || string(response) != data {
+			t.Errorf("got %d bytes and error %v, want %d bytes", len(response), err, len(data))
+		}
+	})
+}
+
+func TestGetDecompress(t *testing.T) {
+	const data = "fooey-baroque"
+	encode := func(encoding string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		if encoding == "gzip" {
+			w = gzip.NewWriter(&buf)
+		} else {
+			w = zlib.NewWriter(&buf)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		return buf.Bytes()
+	}
+	var acceptEncoding string
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		acceptEncoding = req.Header.Get("Accept-Encoding")
+		encoding := strings.TrimPrefix(req.URL.Path, "/")
+		rw.Header().Set("Content-Encoding", encoding)
+		rw.Write(encode(encoding))
+	}))
+	defer testServer.Close()
+	// The transport does not decode the responses itself.
+	rawClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		desc                   string
+		encoding               string
+		defaults               *Options
+		opts                   Options
+		expectedData           string
+		expectedAcceptEncoding string
+		expectErr              bool
+	}{
+		{
+			desc:                   "gzip",
+			encoding:               "gzip",
+			opts:                   Options{Client: rawClient, Decompress: Bool(true)},
+			expectedData:           data,
+			expectedAcceptEncoding: "gzip, deflate",
+		},
+		{
+			desc:                   "deflate",
+			encoding:               "deflate",
+			opts:                   Options{Client: rawClient, Decompress: Bool(true)},
+			expectedData:           data,
+			expectedAcceptEncoding: "gzip, deflate",
+		},
+		{
+			desc:         "raw",
+			encoding:     "gzip",
+			opts:         Options{Client: rawClient},
+			expectedData: string(encode("gzip")),
+		},
+		{
+			desc:      "decoded size limit",
+			encoding:  "gzip",
+			opts:      Options{Client: rawClient, Decompress: Bool(true), MaxBytes: 5},
+			expectErr: true,
+		},
+		{
+			desc:         "default turned off",
+			encoding:     "gzip",
+			defaults:     &Options{MaxBytes: DefaultMaxBytes, Decompress: Bool(true)},
+			opts:         Options{Client: rawClient, Decompress: Bool(false)},
+			expectedData: string(encode("gzip")),
+		},
+		{
+			desc:                   "default",
+			encoding:               "deflate",
+			defaults:               &Options{MaxBytes: DefaultMaxBytes, Decompress: Bool(true)},
+			opts:                   Options{Client: rawClient},
+			expectedData:           data,
+			expectedAcceptEncoding: "gzip, deflate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.defaults != nil {
+				defaults := Defaults
+				Defaults = *tt.defaults
+				defer func() { Defaults = defaults }()
+			}
+			response, err := GetWithOptions(testServer.URL+"/"+tt.encoding, tt.opts)
+			if gotErr := err != nil; gotErr != tt.expectErr {
+				t.Fatalf("%s: got error %v, want error %v", tt.desc, err, tt.expectErr)
+			}
+			if tt.expectErr {
+				return
+			}
+			if tt.expectedData != string(response) {
+				t.Errorf("Returned unexpected response, want: %q, got: %q", tt.expectedData, string(response))
+			}
+			if acceptEncoding != tt.expectedAcceptEncoding {
+				t.Errorf("%s: got Accept-Encoding %q, want %q", tt.desc, acceptEncoding, tt.expectedAcceptEncoding)
+			}
+		})
+	}
+}
+
+func TestGetJSON(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/valid":
+			rw.Write([]byte(`{"name": "fooey", "count": 2}`))
+		case "/invalid":
+			rw.Write([]byte(`{"name": "fooey", "count": `))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	var got payload
+	if err := GetJSON(testServer.URL+"/valid", &got); err != nil {
+		t.Fatalf("Unexpected Error In Making Request: %s", err.Error())
+	}
+	if want := (payload{Name: "fooey", Count: 2}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var statusErr *StatusError
+	if err := GetJSON(testServer.URL+"/missing", &got); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got error %v, want a 404 status error", err)
+	}
+
+	err := GetJSON(testServer.URL+"/invalid", &got)
+	if err == nil || !strings.Contains(err.Error(), "count") {
+		t.Errorf("got error %v, want an error quoting the response", err)
+	}
+}
+
+func TestGetWithAuth(t *testing.T) {
+	var authorization string
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+
+	tests := []struct {
+		desc                  string
+		auth                  *Auth
+		expectedAuthorization string
+		expectErr             bool
+	}{
+		{
+			desc: "no auth",
+		},
+		{
+			desc:                  "basic auth",
+			auth:                  &Auth{Username: "fooey", Password: "baroque"},
+			expectedAuthorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("fooey:baroque")),
+		},
+		{
+			desc:                  "bearer token",
+			auth:                  &Auth{BearerToken: "cazoo"},
+			expectedAuthorization: "Bearer cazoo",
+		},
+		{
+			desc:      "basic auth and bearer token",
+			auth:      &Auth{Username: "fooey", Password: "baroque", BearerToken: "cazoo"},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			authorization = ""
+			_, err := GetWithAuth(testServer.URL, tt.auth)
+			if gotErr := err != nil; gotErr != tt.expectErr {
+				t.Fatalf("%s: got error %v, want error %v", tt.desc, err, tt.expectErr)
+			}
+			if authorization != tt.expectedAuthorization {
+				t.Errorf("%s: got Authorization %q, want %q", tt.desc, authorization, tt.expectedAuthorization)
+			}
+			// The secrets are not printed.
+			for _, format := range []string{"%v", "%+v", "%#v"} {
+				printed := fmt.Sprintf(format, Options{Auth: tt.auth})
+				if strings.Contains(printed, "baroque") || strings.Contains(printed, "cazoo") {
+					t.Errorf("%s: credentials printed in %s", tt.desc, printed)
+				}
+			}
+		})
+	}
+}
+
+func TestGetWithSocketPath(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Host + req.URL.Path))
+	}))
+	testServer.Listener = listener
+	testServer.Start()
+	defer testServer.Close()
+
+	response, err := GetWithOptions("http://agent/fooey", Options{SocketPath: socketPath})
+	if err != nil {
+		t.Fatalf("Unexpected Error In Making Request: %s", err.Error())
+	}
+	if string(response) != "agent/fooey" {
+		t.Errorf("Returned unexpected response, want: agent/fooey, got: %s", string(response))
+	}
+
+	if _, err := GetWithOptions("http://agent/fooey", Options{SocketPath: socketPath, Client: &http.Client{}}); err == nil {
+		t.Errorf("expected an error for a socket path along with a client")
+	}
+}
+
+func TestHook(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	closedServer.Close()
+
+	tests := []struct {
+		desc      string
+		url       string
+		download  bool
+		expected  RequestInfo
+		expectErr bool
+	}{
+		{
+			desc:     "success",
+			url:      testServer.URL + "/fooey",
+			expected: RequestInfo{Method: http.MethodGet, StatusCode: http.StatusOK, Bytes: 13},
+		},
+		{
+			desc:     "download",
+			url:      testServer.URL + "/fooey",
+			download: true,
+			expected: RequestInfo{Method: http.MethodGet, StatusCode: http.StatusOK, Bytes: 13},
+		},
+		{
+			desc:      "status",
+			url:       testServer.URL + "/missing",
+			expected:  RequestInfo{Method: http.MethodGet, StatusCode: http.StatusNotFound},
+			expectErr: true,
+		},
+		{
+			desc:      "connection error",
+			url:       closedServer.URL,
+			expected:  RequestInfo{Method: http.MethodGet},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var observed []RequestInfo
+			opts := Options{Hook: HookFunc(func(info RequestInfo) {
+				observed = append(observed, info)
+			})}
+			var err error
+			if tt.download {
+				_, err = DownloadWithOptions(tt.url, io.Discard, opts)
+			} else {
+				_, err = GetWithOptions(tt.url, opts)
+			}
+			if len(observed) != 1 {
+				t.Fatalf("%s: got %d observed requests, want 1", tt.desc, len(observed))
+			}
+			got := observed[0]
+			if (got.Err != nil) != tt.expectErr || got.Err != err {
+				t.Errorf("%s: got hook error %v, want %v", tt.desc, got.Err, err)
+			}
+			if got.Duration <= 0 {
+				t.Errorf("%s: got duration %v", tt.desc, got.Duration)
+			}
+			tt.expected.URL = tt.url
+			got.Err, got.Duration = nil, 0
+			if got != tt.expected {
+				t.Errorf("%s: got %+v, want %+v", tt.desc, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	var inflight, maxInflight, requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if strings.HasPrefix(req.URL.Path, "/missing") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte(req.URL.Path))
+	}))
+	defer testServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	closedServer.Close()
+
+	urls := []string{
+		testServer.URL + "/fooey",
+		testServer.URL + "/baroque",
+		testServer.URL + "/missing",
+		testServer.URL + "/cazoo",
+		testServer.URL + "/fooey",
+		closedServer.URL + "/closed",
+	}
+	results, errs := GetAll(urls, 2)
+
+	if got := atomic.LoadInt32(&requests); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+	if got := atomic.LoadInt32(&maxInflight); got > 2 {
+		t.Errorf("got %d concurrent requests, want at most 2", got)
+	}
+	if len(results) != 3 {
+		t.Errorf("got %d results, want 3: %v", len(results), results)
+	}
+	for _, path := range []string{"/fooey", "/baroque", "/cazoo"} {
+		if got := string(results[testServer.URL+path]); got != path {
+			t.Errorf("got response %q for %s, want %q", got, path, path)
+		}
+	}
+	if len(errs) != 2 {
+		t.Errorf("got %d errors, want 2: %v", len(errs), errs)
+	}
+	var statusErr *StatusError
+	if err := errs[testServer.URL+"/missing"]; !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got error %v for /missing, want status %d", err, http.StatusNotFound)
+	}
+	if errs[closedServer.URL+"/closed"] == nil {
+		t.Errorf("got no error for the closed server")
+	}
+}
+
+func TestGetRedirects(t *testing.T) {
+	var requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// /redirect/N redirects N more times before answering.
+		var n int
+		if _, err := fmt.Sscanf(req.URL.Path, "/redirect/%d", &n); err == nil && n > 0 {
+			http.Redirect(rw, req, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+			return
+		}
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+
+	tests := []struct {
+		desc             string
+		opts             Options
+		redirects        int
+		expectedRequests int32
+		expectedErr      error
+		expectedStatus   int
+	}{
+		{
+			desc:             "client policy",
+			redirects:        3,
+			expectedRequests: 4,
+		},
+		{
+			desc:             "within limit",
+			opts:             Options{MaxRedirects: 3},
+			redirects:        3,
+			expectedRequests: 4,
+		},
+		{
+			desc:             "over limit",
+			opts:             Options{MaxRedirects: 2},
+			redirects:        3,
+			expectedRequests: 3,
+			expectedErr:      ErrTooManyRedirects,
+		},
+		{
+			desc:             "over limit not retried",
+			opts:             Options{MaxRedirects: 1, Attempts: 3, Backoff: time.Millisecond},
+			redirects:        3,
+			expectedRequests: 2,
+			expectedErr:      ErrTooManyRedirects,
+		},
+		{
+			desc:             "forbidden",
+			opts:             Options{NoRedirects: Bool(true)},
+			redirects:        1,
+			expectedRequests: 1,
+			expectedStatus:   http.StatusFound,
+		},
+		{
+			desc:             "forbidden without redirect",
+			opts:             Options{NoRedirects: Bool(true)},
+			expectedRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			response, err := GetWithOptions(fmt.Sprintf("%s/redirect/%d", testServer.URL, tt.redirects), tt.opts)
+			var statusErr *StatusError
+			switch {
+			case tt.expectedErr != nil:
+				if !errors.Is(err, tt.expectedErr) {
+					t.Errorf("%s: got error %v, want %v", tt.desc, err, tt.expectedErr)
+				}
+			case tt.expectedStatus != 0:
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.expectedStatus {
+					t.Errorf("%s: got error %v, want status %d", tt.desc, err, tt.expectedStatus)
+				}
+			case err != nil:
+				t.Errorf("%s: unexpected error %v", tt.desc, err)
+			case string(response) != "fooey-baroque":
+				t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.expectedRequests {
+				t.Errorf("%s: got %d requests, want %d", tt.desc, got, tt.expectedRequests)
+			}
+		})
+	}
+}
+
+func TestGetRedirectsSharedClient(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/redirect" {
+			http.Redirect(rw, req, "/", http.StatusFound)
+			return
+		}
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+
+	client := &http.Client{}
+	if _, err := GetWithOptions(testServer.URL+"/redirect", Options{Client: client, NoRedirects: Bool(true)}); err == nil {
+		t.Fatalf("got no error for a forbidden redirect")
+	}
+	if client.CheckRedirect != nil {
+		t.Errorf("the redirect policy was set on the shared client")
+	}
+	if _, err := GetWithOptions(testServer.URL+"/redirect", Options{Client: client}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGetRedirectsDefaultOverridden(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/redirect" {
+			http.Redirect(rw, req, "/", http.StatusFound)
+			return
+		}
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+
+	defaults := Defaults
+	Defaults.NoRedirects = Bool(true)
+	defer func() { Defaults = defaults }()
+
+	if _, err := GetWithOptions(testServer.URL+"/redirect", Options{}); err == nil {
+		t.Errorf("got no error for a redirect forbidden by default")
+	}
+	response, err := GetWithOptions(testServer.URL+"/redirect", Options{NoRedirects: Bool(false)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(response) != "fooey-baroque" {
+		t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		desc              string
+		defaults          Options
+		opts              Options
+		download          bool
+		expectedUserAgent string
+	}{
+		{
+			desc:              "default",
+			defaults:          Defaults,
+			expectedUserAgent: DefaultUserAgent,
+		},
+		{
+			desc:              "unset in package defaults",
+			defaults:          Options{MaxBytes: DefaultMaxBytes},
+			expectedUserAgent: DefaultUserAgent,
+		},
+		{
+			desc:              "custom",
+			defaults:          Defaults,
+			opts:              Options{UserAgent: "istioctl/1.20"},
+			expectedUserAgent: "istioctl/1.20",
+		},
+		{
+			desc:              "download",
+			defaults:          Options{},
+			download:          true,
+			expectedUserAgent: DefaultUserAgent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var got string
+			testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Get("User-Agent")
+				rw.Write([]byte("fooey-baroque"))
+			}))
+			defer testServer.Close()
+			defaults := Defaults
+			Defaults = tt.defaults
+			defer func() { Defaults = defaults }()
+
+			var err error
+			if tt.download {
+				_, err = DownloadWithOptions(testServer.URL, io.Discard, tt.opts)
+			} else {
+				_, err = GetWithOptions(testServer.URL, tt.opts)
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", tt.desc, err)
+			}
+			if got != tt.expectedUserAgent {
+				t.Errorf("%s: got User-Agent %q, want %q", tt.desc, got, tt.expectedUserAgent)
+			}
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// The dial hangs like the connection to an unreachable host, until its context is done.
+	slowDial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	dial := withConnectTimeout(slowDial, 10*time.Millisecond)
+
+	start := time.Now()
+	_, err := dial(context.Background(), "tcp", "10.0.0.1:80")
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "failed to connect to 10.0.0.1:80") {
+		t.Errorf("got error %v, want a connect timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the connect timeout fired after %v", elapsed)
+	}
+
+	// The connect timeout is not blamed for the cancellation of the request.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dial(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "failed to connect") {
+		t.Errorf("got error %v, want the request cancellation", err)
+	}
+
+	// Established connections are not affected by the connect timeout.
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+	response, err := GetWithOptions(testServer.URL, Options{ConnectTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(response) != "fooey-baroque" {
+		t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+	}
+
+	if _, err := GetWithOptions(testServer.URL, Options{Client: &http.Client{}, ConnectTimeout: time.Second}); err == nil {
+		t.Errorf("got no error for a connect timeout set along with a client")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow-headers" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		// A slow body is only limited by the overall timeout.
+		time.Sleep(50 * time.Millisecond)
+		rw.Write([]byte("fooey-baroque"))
+	}))
+	defer testServer.Close()
+
+	opts := Options{ResponseHeaderTimeout: 20 * time.Millisecond, Timeout: 5 * time.Second}
+	if _, err := GetWithOptions(testServer.URL+"/slow-headers", opts); err == nil ||
+		!strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("got error %v, want a response header timeout", err)
+	}
+	response, err := GetWithOptions(testServer.URL+"/slow-body", opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(response) != "fooey-baroque" {
+		t.Errorf("Returned unexpected response, want: fooey-baroque, got: %s", string(response))
+	}
+}
+
+func TestGetInvalidURL(t *testing.T) {
+	var observed int
+	opts := Options{Hook: HookFunc(func(RequestInfo) { observed++ })}
+	tests := []struct {
+		desc        string
+		url         string
+		expectedErr string
+	}{
+		{
+			desc:        "empty",
+			url:         "",
+			expectedErr: "the URL is empty",
+		},
+		{
+			desc:        "file",
+			url:         "file:///etc/passwd",
+			expectedErr: `unsupported scheme "file"`,
+		},
+		{
+			desc:        "no scheme",
+			url:         "example.com/manifest.yaml",
+			expectedErr: `unsupported scheme ""`,
+		},
+		{
+			desc:        "malformed",
+			url:         "http://[::1/manifest.yaml",
+			expectedErr: "missing ']' in host",
+		},
+		{
+			desc:        "no host",
+			url:         "http:///manifest.yaml",
+			expectedErr: "the URL has no host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := GetWithOptions(tt.url, opts); err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("%s: got error %v, want %q", tt.desc, err, tt.expectedErr)
+			}
+			if _, err := DownloadWithOptions(tt.url, io.Discard, opts); err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("%s: got download error %v, want %q", tt.desc, err, tt.expectedErr)
+			}
+		})
+	}
+	if observed != 0 {
+		t.Errorf("got %d observed requests, want none", observed)
+	}
+}
+
+func TestGetConditional(t *testing.T) {
+	etag := `"v1"`
+	var requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Write([]byte("fooey-baroque-" + etag))
+	}))
+	defer testServer.Close()
+
+	tests := []struct {
+		desc         string
+		etag         string
+		serverETag   string
+		expectedData string
+		expectedETag string
+		expectErr    error
+	}{
+		{
+			desc:         "unconditional",
+			serverETag:   `"v1"`,
+			expectedData: `fooey-baroque-"v1"`,
+			expectedETag: `"v1"`,
+		},
+		{
+			desc:       "not modified",
+			etag:       `"v1"`,
+			serverETag: `"v1"`,
+			expectErr:  ErrNotModified,
+		},
+		{
+			desc:         "modified",
+			etag:         `"v1"`,
+			serverETag:   `"v2"`,
+			expectedData: `fooey-baroque-"v2"`,
+			expectedETag: `"v2"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			etag = tt.serverETag
+			atomic.StoreInt32(&requests, 0)
+			// A 304 is not retried.
+			response, gotETag, err := GetConditionalWithOptions(testServer.URL, tt.etag, Options{Attempts: 3, Backoff: time.Millisecond})
+			if !errors.Is(err, tt.expectErr) || (tt.expectErr == nil) != (err == nil) {
+				t.Fatalf("%s: got error %v, want %v", tt.desc, err, tt.expectErr)
+			}
+			if string(response) != tt.expectedData {
+				t.Errorf("Returned unexpected response, want: %s, got: %s", tt.expectedData, string(response))
+			}
+			if gotETag != tt.expectedETag {
+				t.Errorf("%s: got ETag %s, want %s", tt.desc, gotETag, tt.expectedETag)
+			}
+			if got := atomic.LoadInt32(&requests); got != 1 {
+				t.Errorf("%s: got %d requests, want 1", tt.desc, got)
+			}
+		})
+	}
+}
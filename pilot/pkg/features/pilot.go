@@ -380,6 +380,10 @@ var (
 		return durationpb.New(defaultRequestTimeoutVar.Get())
 	}()
 
+	ClampPerTryTimeout = env.Register("PILOT_CLAMP_PER_TRY_TIMEOUT", false,
+		"If enabled, a retry per-try timeout exceeding the route timeout is lowered to the route timeout "+
+			"divided evenly across all attempts, instead of being silently capped by the route timeout.").Get()
+
 	LegacyIngressBehavior = env.Register("PILOT_LEGACY_INGRESS_BEHAVIOR", false,
 		"If this is set to true, istio ingress will perform the legacy behavior, "+
 			"which does not meet https://kubernetes.io/docs/concepts/services-networking/ingress/#multiple-matches.").Get()
@@ -473,6 +477,39 @@ var (
 	EnableRDSCaching = env.Register("PILOT_ENABLE_RDS_CACHE", true,
 		"If true, Pilot will cache RDS responses. Note: this depends on PILOT_ENABLE_XDS_CACHE.").Get()
 
+	EnableSidecarVirtualHostCache = env.Register("PILOT_ENABLE_SIDECAR_VIRTUAL_HOST_CACHE", false,
+		"If true, Pilot will reuse the virtual hosts built for a virtual service across sidecars with the same "+
+			"routing inputs, within a push.").Get()
+
+	SidecarVirtualHostConcurrency = env.Register("PILOT_SIDECAR_VIRTUAL_HOST_CONCURRENCY", 1,
+		"The number of virtual services whose virtual hosts are built concurrently when generating the routes "+
+			"of a sidecar. Virtual services are processed serially when 1 or less.").Get()
+
+	RegexMaxProgramSize = env.Register("PILOT_REGEX_MAX_PROGRAM_SIZE", 0,
+		"If set, the maximum program size of the RE2 regexes matching routes, bounding the memory used by "+
+			"complex patterns. Envoy rejects the regexes exceeding it. Envoy's default applies when 0.").Get()
+
+	HashCookieDefaultTTL = env.Register("PILOT_HASH_COOKIE_DEFAULT_TTL", time.Duration(0),
+		"If set, the TTL of the cookies generated for consistent hashing on a cookie without a TTL. Envoy only "+
+			"generates the cookie when a TTL is set, so without one clients must set the cookie themselves.").Get()
+
+	MostSpecificHeaderMutationsWins = env.Register("PILOT_MOST_SPECIFIC_HEADER_MUTATIONS_WINS", false,
+		"If enabled, the header mutations of a weighted destination take precedence over the ones of its route. "+
+			"By default, Envoy applies the route mutations last, so they win when both set the same header.").Get()
+
+	DenyServicesWithoutVirtualService = env.Register("PILOT_DENY_SERVICES_WITHOUT_VIRTUAL_SERVICE", false,
+		"If enabled, the default route of the sidecar virtual hosts for services without a virtual service "+
+			"answers 404 instead of forwarding to the service, so that only services with routing configured are reachable.").Get()
+
+	SortCatchAllRoutesByVirtualService = env.Register("PILOT_SORT_CATCH_ALL_ROUTES_BY_VIRTUAL_SERVICE", false,
+		"If enabled, the catch all routes merged into a virtual host are ordered by the namespace and name of their "+
+			"virtual service, rather than kept in the order the virtual services were listed, so that the catch all "+
+			"route serving unmatched traffic does not depend on that order.").Get()
+
+	EnableHeaderControlledFaults = env.Register("PILOT_ENABLE_HEADER_CONTROLLED_FAULTS", false,
+		"If enabled, routes may let clients trigger faults with the x-envoy-fault-delay-request and "+
+			"x-envoy-fault-abort-request headers. Only meant for test environments, as any client can then fail requests.").Get()
+
 	EnableXDSCacheMetrics = env.Register("PILOT_XDS_CACHE_STATS", false,
 		"If true, Pilot will collect metrics for XDS cache efficiency.").Get()
 
@@ -253,6 +253,17 @@ func mergeVirtualServicesIfNeeded(
 	return out, delegatesByRoot
 }
 
+// MergeDelegateHTTPRoutes inlines the routes of a delegate virtual service under the root route
+// delegating to it, the same way delegates are merged into the push context. Delegate routes
+// conflicting with the root match are dropped. The given routes are not modified.
+func MergeDelegateHTTPRoutes(root *networking.HTTPRoute, delegate []*networking.HTTPRoute) []*networking.HTTPRoute {
+	copied := make([]*networking.HTTPRoute, 0, len(delegate))
+	for _, r := range delegate {
+		copied = append(copied, r.DeepCopy())
+	}
+	return mergeHTTPRoutes(root.DeepCopy(), copied)
+}
+
 // merge root's route with delegate's and the merged route number equals the delegate's.
 // if there is a conflict with root, the route is ignored
 func mergeHTTPRoutes(root *networking.HTTPRoute, delegate []*networking.HTTPRoute) []*networking.HTTPRoute {
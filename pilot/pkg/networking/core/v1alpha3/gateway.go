@@ -394,8 +394,15 @@ func (configgen *ConfigGeneratorImpl) buildGatewayHTTPRouteConfig(node *model.Pr
 
 			if routes, exists = gatewayRoutes[gatewayName][vskey]; !exists {
 				hashByDestination := istio_route.GetConsistentHashForVirtualService(push, node, virtualService)
-				routes, err = istio_route.BuildHTTPRoutesForVirtualService(node, virtualService, nameToServiceMap,
-					hashByDestination, port, map[string]bool{gatewayName: true}, isH3DiscoveryNeeded, push.Mesh)
+				routes, err = istio_route.BuildHTTPRoutes(virtualService, istio_route.RouteOptions{
+					Node:                      node,
+					Push:                      push,
+					ServiceRegistry:           nameToServiceMap,
+					HashByDestination:         hashByDestination,
+					ListenPort:                port,
+					GatewayNames:              map[string]bool{gatewayName: true},
+					IsHTTP3AltSvcHeaderNeeded: isH3DiscoveryNeeded,
+				})
 				if err != nil {
 					log.Debugf("%s omitting routes for virtual service %v/%v due to error: %v", node.ID, virtualService.Namespace, virtualService.Name, err)
 					continue
@@ -467,9 +474,10 @@ func (configgen *ConfigGeneratorImpl) buildGatewayHTTPRouteConfig(node *model.Pr
 
 	routeCfg := &route.RouteConfiguration{
 		// Retain the routeName as its used by EnvoyFilter patching logic
-		Name:             routeName,
-		VirtualHosts:     virtualHosts,
-		ValidateClusters: proto.BoolFalse,
+		Name:                            routeName,
+		VirtualHosts:                    virtualHosts,
+		ValidateClusters:                proto.BoolFalse,
+		MostSpecificHeaderMutationsWins: features.MostSpecificHeaderMutationsWins,
 	}
 	if GatewayIgnorePort(node) {
 		routeCfg.IgnorePortInHostMatching = true
@@ -202,9 +202,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundHTTPRouteConfig(
 	}
 
 	out := &route.RouteConfiguration{
-		Name:             routeName,
-		VirtualHosts:     virtualHosts,
-		ValidateClusters: proto.BoolFalse,
+		Name:                            routeName,
+		VirtualHosts:                    virtualHosts,
+		ValidateClusters:                proto.BoolFalse,
+		MostSpecificHeaderMutationsWins: features.MostSpecificHeaderMutationsWins,
 	}
 	if SidecarIgnorePort(node) {
 		out.IgnorePortInHostMatching = true
@@ -539,6 +540,15 @@ func SidecarIgnorePort(node *model.Proxy) bool {
 	return util.IsIstioVersionGE115(node.IstioVersion) && !node.IsProxylessGrpc() && features.SidecarIgnorePort
 }
 
+// VirtualHostDomains returns the ordered list of domains of the virtual host for a service accessed from
+// a proxy node on the given port: the service hostname, its short and namespaced aliases within the proxy
+// DNS domain (e.g., foo, foo.default, foo.default.svc) and the service address, with the port appended
+// unless the proxy ignores ports in host matching.
+func VirtualHostDomains(service *model.Service, port int, node *model.Proxy) []string {
+	domains, _ := generateVirtualHostDomains(service, port, port, node)
+	return domains
+}
+
 // generateVirtualHostDomains generates the set of domain matches for a service being accessed from
 // a proxy node
 func generateVirtualHostDomains(service *model.Service, listenerPort int, port int, node *model.Proxy) ([]string, []string) {
@@ -756,17 +766,9 @@ func getUniqueAndSharedDNSDomain(fqdnHostname, proxyDomain string) (partsUnique
 
 func buildCatchAllVirtualHost(node *model.Proxy) *route.VirtualHost {
 	if util.IsAllowAnyOutbound(node) {
-		egressCluster := util.PassthroughCluster
+		egressCluster := istio_route.OutboundTrafficPolicyCluster(node)
 		notimeout := durationpb.New(0)
 
-		// no need to check for nil value as the previous if check has checked
-		if node.SidecarScope.OutboundTrafficPolicy.EgressProxy != nil {
-			// user has provided an explicit destination for all the unknown traffic.
-			// build a cluster out of this destination
-			egressCluster = istio_route.GetDestinationCluster(node.SidecarScope.OutboundTrafficPolicy.EgressProxy,
-				nil, 0)
-		}
-
 		routeAction := &route.RouteAction{
 			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: egressCluster},
 			// Disable timeout instead of assuming some defaults.
@@ -20,10 +20,12 @@ import (
 	"testing"
 	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 
 	meshapi "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/provider"
 	"istio.io/istio/pilot/test/xdstest"
@@ -326,6 +328,66 @@ func TestGenerateVirtualHostDomains(t *testing.T) {
 	}
 }
 
+func TestVirtualHostDomains(t *testing.T) {
+	node := &model.Proxy{
+		DNSDomain:    "default.svc.cluster.local",
+		IstioVersion: model.ParseIstioVersion("1.15.0"),
+	}
+	cases := []struct {
+		name     string
+		hostname host.Name
+		want     []string
+	}{
+		{
+			name:     "short name",
+			hostname: "foo.default.svc.cluster.local",
+			want: []string{
+				"foo.default.svc.cluster.local",
+				"foo",
+				"foo.default.svc",
+				"foo.default",
+			},
+		},
+		{
+			name:     "namespaced",
+			hostname: "bar.other.svc.cluster.local",
+			want: []string{
+				"bar.other.svc.cluster.local",
+				"bar.other",
+				"bar.other.svc",
+			},
+		},
+		{
+			name:     "fqdn",
+			hostname: "example.com",
+			want: []string{
+				"example.com",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			service := &model.Service{Hostname: c.hostname}
+			assert.Equal(t, VirtualHostDomains(service, 8080, node), c.want)
+		})
+	}
+	t.Run("port suffix", func(t *testing.T) {
+		legacy := &model.Proxy{
+			DNSDomain:    "default.svc.cluster.local",
+			IstioVersion: model.ParseIstioVersion("1.14.0"),
+		}
+		service := &model.Service{Hostname: "bar.other.svc.cluster.local"}
+		assert.Equal(t, VirtualHostDomains(service, 8080, legacy), []string{
+			"bar.other.svc.cluster.local",
+			"bar.other.svc.cluster.local:8080",
+			"bar.other",
+			"bar.other:8080",
+			"bar.other.svc",
+			"bar.other.svc:8080",
+		})
+	})
+}
+
 func TestSidecarOutboundHTTPRouteConfigWithDuplicateHosts(t *testing.T) {
 	virtualServiceSpec := &networking.VirtualService{
 		Hosts:    []string{"test-duplicate-domains.default.svc.cluster.local", "test-duplicate-domains.default"},
@@ -534,6 +596,76 @@ func TestSidecarOutboundHTTPRouteConfigWithDuplicateHosts(t *testing.T) {
 	}
 }
 
+func TestSidecarOutboundHTTPRouteConfigHeaderMutations(t *testing.T) {
+	setHeader := func(value string) *networking.Headers {
+		return &networking.Headers{Request: &networking.Headers_HeaderOperations{Set: map[string]string{"x-tier": value}}}
+	}
+	destination := func(subset string) *networking.HTTPRouteDestination {
+		return &networking.HTTPRouteDestination{
+			Destination: &networking.Destination{Host: "test.local", Subset: subset},
+			Weight:      50,
+			Headers:     setHeader(subset),
+		}
+	}
+	virtualService := config.Config{
+		Meta: config.Meta{
+			GroupVersionKind: gvk.VirtualService,
+			Name:             "acme",
+			Namespace:        "default",
+		},
+		Spec: &networking.VirtualService{
+			Hosts: []string{"test.local"},
+			Http: []*networking.HTTPRoute{{
+				Headers: setHeader("route"),
+				Route:   []*networking.HTTPRouteDestination{destination("a"), destination("b")},
+			}},
+		},
+	}
+	headerValue := func(opts []*core.HeaderValueOption) string {
+		for _, o := range opts {
+			if o.GetHeader().GetKey() == "x-tier" {
+				return o.GetHeader().GetValue()
+			}
+		}
+		return ""
+	}
+
+	for _, mostSpecificWins := range []bool{false, true} {
+		t.Run(fmt.Sprint(mostSpecificWins), func(t *testing.T) {
+			test.SetForTest(t, &features.MostSpecificHeaderMutationsWins, mostSpecificWins)
+			cg := NewConfigGenTest(t, TestOptions{
+				Services: []*model.Service{buildHTTPService("test.local", visibility.Public, "", "default", 80)},
+				Configs:  []config.Config{virtualService},
+			})
+			vHostCache := make(map[int][]*route.VirtualHost)
+			resource, _ := cg.ConfigGen.buildSidecarOutboundHTTPRouteConfig(
+				cg.SetupProxy(nil), &model.PushRequest{Push: cg.PushContext()}, "80", vHostCache, nil, nil)
+			routeCfg := &route.RouteConfiguration{}
+			resource.Resource.UnmarshalTo(routeCfg)
+			xdstest.ValidateRouteConfiguration(t, routeCfg)
+
+			// Envoy applies the mutations of the weighted clusters before the ones of the route, so the
+			// route wins unless most_specific_header_mutations_wins reverses the order.
+			assert.Equal(t, routeCfg.MostSpecificHeaderMutationsWins, mostSpecificWins)
+			var r *route.Route
+			for _, vh := range routeCfg.VirtualHosts {
+				if vh.Name == "test.local:80" {
+					r = vh.Routes[0]
+				}
+			}
+			if r == nil {
+				t.Fatal("route for test.local:80 not found")
+			}
+			assert.Equal(t, headerValue(r.RequestHeadersToAdd), "route")
+			got := map[string]string{}
+			for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+				got[c.Name] = headerValue(c.RequestHeadersToAdd)
+			}
+			assert.Equal(t, got, map[string]string{"outbound|80|a|test.local": "a", "outbound|80|b|test.local": "b"})
+		})
+	}
+}
+
 func TestSidecarOutboundHTTPRouteConfig(t *testing.T) {
 	services := []*model.Service{
 		buildHTTPService("bookinfo.com", visibility.Public, wildcardIPv4, "default", 9999, 70),
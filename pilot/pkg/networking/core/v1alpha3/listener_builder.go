@@ -218,22 +218,8 @@ func (lb *ListenerBuilder) getListeners() []*listener.Listener {
 }
 
 func buildOutboundCatchAllNetworkFiltersOnly(push *model.PushContext, node *model.Proxy) []*listener.Filter {
-	var egressCluster string
-
-	if util.IsAllowAnyOutbound(node) {
-		// We need a passthrough filter to fill in the filter stack for orig_dst listener
-		egressCluster = util.PassthroughCluster
-
-		// no need to check for nil value as the previous if check has checked
-		if node.SidecarScope.OutboundTrafficPolicy.EgressProxy != nil {
-			// user has provided an explicit destination for all the unknown traffic.
-			// build a cluster out of this destination
-			egressCluster = istio_route.GetDestinationCluster(node.SidecarScope.OutboundTrafficPolicy.EgressProxy,
-				nil, 0)
-		}
-	} else {
-		egressCluster = util.BlackHoleCluster
-	}
+	// We need a passthrough or blackhole filter to fill in the filter stack for orig_dst listener
+	egressCluster := istio_route.OutboundTrafficPolicyCluster(node)
 
 	tcpProxy := &tcp.TcpProxy{
 		StatPrefix:       egressCluster,
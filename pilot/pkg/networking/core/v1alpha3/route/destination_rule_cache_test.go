@@ -0,0 +1,72 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route
+
+import (
+	"testing"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+func TestDestinationRuleCache(t *testing.T) {
+	push := model.NewPushContext()
+	push.Mesh = mesh.DefaultMeshConfig()
+	push.AddPublicServices([]*model.Service{{
+		Hostname:   "foo.default.svc.cluster.local",
+		Attributes: model.ServiceAttributes{Namespace: "default"},
+	}})
+	destinationRule := func(namespace string) config.Config {
+		return config.Config{
+			Meta: config.Meta{GroupVersionKind: gvk.DestinationRule, Name: "foo", Namespace: namespace},
+			Spec: &networking.DestinationRule{
+				Host:    "foo.default.svc.cluster.local",
+				Subsets: []*networking.Subset{{Name: namespace}},
+			},
+		}
+	}
+	// Each namespace has its own rule for the same host.
+	push.SetDestinationRulesForTesting([]config.Config{destinationRule("ns1"), destinationRule("ns2")})
+
+	proxy := func(namespace string) *model.Proxy {
+		return &model.Proxy{
+			Metadata:     &model.NodeMetadata{Namespace: namespace},
+			SidecarScope: model.DefaultSidecarScopeForNamespace(push, namespace),
+		}
+	}
+	proxies := []*model.Proxy{proxy("ns1"), proxy("ns2"), proxy("other")}
+	drs := newDestinationRuleCache()
+	for i := 0; i < 2; i++ {
+		for _, node := range proxies {
+			for _, hostname := range []host.Name{"foo.default.svc.cluster.local", "bar.default.svc.cluster.local"} {
+				want := node.SidecarScope.DestinationRule(model.TrafficDirectionOutbound, node, hostname)
+				if got := drs.lookup(node, hostname); got != want {
+					t.Errorf("%s: lookup(%s) returned a different rule than the sidecar scope", node.Metadata.Namespace, hostname)
+				}
+			}
+		}
+	}
+	// The rule cached for one namespace must not be returned for the other.
+	for _, node := range proxies[:2] {
+		dr := drs.lookup(node, "foo.default.svc.cluster.local")
+		if dr == nil || dr.GetRule().Namespace != node.Metadata.Namespace {
+			t.Errorf("%s: got rule %v, want the rule of the namespace", node.Metadata.Namespace, dr)
+		}
+	}
+}
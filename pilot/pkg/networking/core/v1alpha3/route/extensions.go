@@ -0,0 +1,477 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route
+
+import (
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// HealthAwareClustersMetadataKey is the key, under the istio filter metadata of a route, listing the
+// clusters whose weight should be reduced as their endpoints become unhealthy.
+const HealthAwareClustersMetadataKey = "health_aware_clusters"
+
+// ResponseCodeDetailsMetadataKey is the key, under the istio filter metadata of a route, of the details of the
+// direct responses of the route. Envoy reports "direct_response" as %RESPONSE_CODE_DETAILS% of any direct
+// response, so access logs can print %METADATA(ROUTE:istio:response_code_details)% to tell them apart.
+const ResponseCodeDetailsMetadataKey = "response_code_details"
+
+// maintenanceMetadataKey is the key, under the istio filter metadata of a route, marking the routes built by
+// BuildMaintenanceRoute. Users cannot set route metadata, so unlike the route name it cannot be forged by a
+// virtual service.
+const maintenanceMetadataKey = "maintenance"
+
+// Extensions carries route translation settings that cannot be expressed through the VirtualService API.
+// Like DestinationHashMap, entries are keyed by the API message they refine. A nil Extensions, or a
+// message without an entry, produces exactly the routes described by the VirtualService alone.
+type Extensions struct {
+	// Routes holds settings applied to every Envoy route generated from an HTTPRoute.
+	Routes map[*networking.HTTPRoute]*RouteExtension
+	// Destinations holds settings applied to the cluster generated from an HTTPRouteDestination.
+	Destinations map[*networking.HTTPRouteDestination]*DestinationExtension
+	// Headers holds settings applied to the header operations of an HTTPRoute or HTTPRouteDestination.
+	Headers map[*networking.Headers]*HeadersExtension
+	// Matches holds settings applied to the Envoy route match generated from an HTTPMatchRequest.
+	Matches map[*networking.HTTPMatchRequest]*MatchExtension
+	// Maintenance, if set, serves a static maintenance response ahead of all routes of the virtual service.
+	Maintenance *Maintenance
+}
+
+// RouteExtension holds the settings for a single HTTPRoute.
+type RouteExtension struct {
+	// HostRewriteHeader names a request header whose value replaces the Host header when forwarding.
+	// A literal authority rewrite, from either Rewrite or the header operations, takes precedence.
+	HostRewriteHeader string
+	// PreserveHost forwards the Host header as received. Any host rewrite, from Rewrite, the header operations
+	// or HostRewriteHeader, is ignored. Envoy never rewrites the host on its own unless configured to.
+	PreserveHost bool
+	// AppendXForwardedHost appends the original Host header to X-Forwarded-Host when the host is rewritten,
+	// so that upstreams can still learn the host the client asked for.
+	AppendXForwardedHost bool
+	// OriginalPathHeader names a request header that receives the original request path whenever the
+	// route rewrites the path, so that upstreams can recover it (e.g. "x-envoy-original-path").
+	OriginalPathHeader string
+	// CohortHeader names a request header used to pick among the weighted destinations of the route, so
+	// that requests carrying the same header value are consistently sent to the same destination, e.g. to
+	// keep a user in the same canary cohort. Envoy reads the header value as an unsigned integer and picks
+	// the destination at value modulo the total weight, so the header should carry a stable numeric bucket,
+	// such as a hash of the user id. Requests without a numeric value are distributed randomly.
+	CohortHeader string
+	// WebsocketUpgrade explicitly enables or disables websocket upgrades on the route. When nil, the
+	// listener setting applies.
+	WebsocketUpgrade *bool
+	// ConnectTunnel, if set, terminates the HTTP CONNECT requests of the route and tunnels their payload to
+	// the TCP upstream, e.g. with a CONNECT match. The listener must accept CONNECT requests.
+	ConnectTunnel *ConnectTunnel
+	// Mirrors lists additional destinations mirroring a percentage of the traffic each, e.g. to shadow
+	// test several canary subsets at once. They apply in addition to the Mirror of the HTTPRoute.
+	Mirrors []*Mirror
+	// InternalRedirect, if set, makes Envoy follow redirects from the upstream internally instead of
+	// returning them to the client.
+	InternalRedirect *InternalRedirect
+	// Hedge, if set, makes Envoy send additional attempts of a request before the previous ones
+	// complete, trading upstream load for lower tail latency.
+	Hedge *Hedge
+	// PerRequestBufferLimitBytes overrides the connection buffer limit for requests matching the route,
+	// e.g. to allow large uploads. The connection limit applies when zero.
+	PerRequestBufferLimitBytes uint32
+	// Tracing holds the tracing settings of the route. The global tracing settings apply when nil.
+	Tracing *RouteTracing
+	// GrpcTimeout, if set, bounds the timeouts gRPC clients request in the grpc-timeout header.
+	GrpcTimeout *GrpcTimeout
+	// Decorator holds the settings of the operation reported in the traces of the route.
+	Decorator *RouteDecorator
+	// RateLimits lists the rate limit descriptors generated for requests matching the route.
+	RateLimits []*RateLimit
+	// IncludeVirtualHostRateLimits applies the rate limits of the virtual host in addition to RateLimits.
+	// Envoy otherwise skips the virtual host rate limits of routes having their own.
+	IncludeVirtualHostRateLimits bool
+	// LocalRateLimit, if set, limits the requests matching the route with a token bucket local to each
+	// proxy. It only applies when the local rate limit filter is in the filter chain of the listener,
+	// e.g. inserted by an EnvoyFilter.
+	LocalRateLimit *LocalRateLimit
+	// HeaderControlledFaults lets clients delay and abort the requests matching the route with the
+	// x-envoy-fault-delay-request and x-envoy-fault-abort-request headers, in place of the delay and abort of
+	// the fault of the route. The percentages of that fault, if any, still bound the requests faulted.
+	// It is ignored unless PILOT_ENABLE_HEADER_CONTROLLED_FAULTS is set.
+	HeaderControlledFaults bool
+	// FaultLimits, if set, bounds the resources used by the faults injected into the route and its destinations.
+	FaultLimits *FaultLimits
+	// HashOnRequestID adds a consistent hash policy on the x-request-id header, so that the requests
+	// of a request chain, e.g. retries and tracing follow-ups carrying the same ID, stick to the same
+	// host. It only applies to destinations with a consistent hash load balancer.
+	HashOnRequestID bool
+	// RetriableRequestHeaders restricts retries to the requests carrying all the given headers, keyed by
+	// name, e.g. to only retry the requests that clients mark as idempotent. An empty match requires the
+	// header to be present. It has no effect when the route does not retry.
+	RetriableRequestHeaders map[string]*networking.StringMatch
+	// RetryResetBeforeRequestOnly restricts the retries of the route to the requests that did not reach the
+	// upstream service, e.g. reset before being sent, for routes serving non-idempotent requests like POST.
+	// It has no effect when the route does not retry.
+	RetryResetBeforeRequestOnly bool
+	// TimeoutHeaderOverride marks the route timeout as a default that clients override per request with
+	// the x-envoy-upstream-rq-timeout-ms header, e.g. to disable it with 0 for long running requests. The
+	// per-try timeout is then not clamped to the route timeout, which would cut the requests the header
+	// extends. Envoy only honors the header from trusted clients.
+	TimeoutHeaderOverride bool
+	// RelativeTimeout, if set, computes the route timeout as a percentage of a base timeout, so that tuning
+	// the base propagates to the routes. A timeout set by the virtual service takes precedence.
+	RelativeTimeout *RelativeTimeout
+	// ClusterNotFoundResponseCode is the status returned when the destination cluster of the route does
+	// not exist, so that clients can tell a missing cluster from an upstream failure. Envoy supports 404,
+	// 500 and 503. Envoy returns 503 when zero, or 500 for routes with gateway semantics.
+	ClusterNotFoundResponseCode uint32
+	// ResponseCodeDetails, if set, is recorded under ResponseCodeDetailsMetadataKey for the direct response
+	// of the route, so that access logs can tell the responses generated by the mesh apart, e.g. "mesh_denied".
+	ResponseCodeDetails string
+}
+
+// Mirror describes a destination mirroring a percentage of the traffic of a route.
+type Mirror struct {
+	// Destination receives the mirrored requests.
+	Destination *networking.Destination
+	// Cluster, if set, names a statically configured cluster, e.g. declared in the bootstrap, that
+	// receives the mirrored requests instead of Destination. The name is used as is.
+	Cluster string
+	// Percentage is the percentage of requests mirrored. Nothing is mirrored when zero.
+	Percentage *networking.Percent
+}
+
+// ConnectTunnel describes how HTTP CONNECT requests are tunneled to a TCP upstream.
+type ConnectTunnel struct {
+	// AllowPost also tunnels the payload of POST requests, for clients that cannot send CONNECT requests.
+	AllowPost bool
+	// ProxyProtocol sends a PROXY protocol v2 header to the upstream, so that it learns the client address.
+	ProxyProtocol bool
+}
+
+// InternalRedirect describes which upstream redirects Envoy follows internally.
+type InternalRedirect struct {
+	// MaxRedirects is the maximum number of redirects followed for a single request. Envoy follows
+	// a single redirect when zero.
+	MaxRedirects uint32
+	// ResponseCodes are the redirect status codes that are followed. Envoy only follows 302 when empty.
+	ResponseCodes []uint32
+	// AllowCrossSchemeRedirect allows following redirects to a different scheme than the request.
+	AllowCrossSchemeRedirect bool
+}
+
+// Hedge describes how requests are hedged across several upstream attempts.
+type Hedge struct {
+	// InitialRequests is the number of requests sent upstream at once. Envoy sends one when zero.
+	InitialRequests uint32
+	// AdditionalRequestChance is the chance of sending one more initial request, e.g. 20% to send
+	// InitialRequests+1 requests to a fifth of the requests. No additional request is sent when nil.
+	AdditionalRequestChance *networking.Percent
+	// HedgeOnPerTryTimeout sends a new attempt when the per-try timeout of the retry policy expires,
+	// without canceling the attempt in flight; the first response wins. It requires a per-try timeout.
+	HedgeOnPerTryTimeout bool
+}
+
+// RouteTracing holds the tracing settings of a route.
+type RouteTracing struct {
+	// CustomTags are added to the spans of requests matching the route, keyed by tag name.
+	CustomTags map[string]*meshconfig.Tracing_CustomTag
+	// ClientSampling is the percentage of requests, with a client requested trace, that are traced.
+	// The global setting applies when nil; likewise for RandomSampling and OverallSampling.
+	ClientSampling *networking.Percent
+	// RandomSampling is the percentage of requests that are randomly selected for tracing.
+	RandomSampling *networking.Percent
+	// OverallSampling caps the percentage of requests traced, after all other sampling is applied.
+	OverallSampling *networking.Percent
+}
+
+// MaxRelativeTimeoutPercent bounds the percentage of a RelativeTimeout.
+const MaxRelativeTimeoutPercent = 1000
+
+// RelativeTimeout expresses a route timeout as a percentage of a base timeout.
+type RelativeTimeout struct {
+	// Percent of the base timeout, e.g. 50 or 150. It must be greater than 0 and at most
+	// MaxRelativeTimeoutPercent, or the relative timeout is ignored.
+	Percent float64
+	// Base is the timeout the percentage applies to, e.g. the timeout of the service. The default request
+	// timeout applies when zero, so that the route has no timeout either if the default is disabled.
+	Base time.Duration
+}
+
+// GrpcTimeout holds the settings of the timeouts requested by gRPC clients.
+type GrpcTimeout struct {
+	// HeaderMax caps the timeout requested in the grpc-timeout header. The route timeout applies when zero,
+	// and caps it otherwise. A zero route timeout leaves a zero HeaderMax, i.e. the header value, unbounded.
+	HeaderMax time.Duration
+	// HeaderOffset is subtracted from the timeout requested in the grpc-timeout header, e.g. to leave time
+	// for the response to reach the client before it gives up.
+	HeaderOffset time.Duration
+}
+
+// RouteDecorator holds the settings of the operation reported in traces by a route.
+type RouteDecorator struct {
+	// Operation names the operation, e.g. for tracing dashboards. When empty, the operation is derived
+	// from the destination, or the virtual service, and the path of the route.
+	Operation string
+	// Propagate explicitly enables or disables sending the operation to the upstream, in the
+	// x-envoy-decorator-operation header, e.g. to keep internal route names private. When nil,
+	// Envoy propagates the operation.
+	Propagate *bool
+}
+
+// RateLimit describes a rate limit descriptor generated by a route.
+type RateLimit struct {
+	// Stage selects the rate limit filters, by their configured stage, that apply this descriptor.
+	Stage uint32
+	// DisableKey is the runtime key that disables this descriptor when set to false.
+	DisableKey string
+	// Actions produce, in order, the entries of the descriptor.
+	Actions []RateLimitAction
+}
+
+// RateLimitAction produces a single descriptor entry. Exactly one of its fields should be set.
+type RateLimitAction struct {
+	// RequestHeader produces an entry from the value of a request header.
+	RequestHeader *RateLimitRequestHeader
+	// RemoteAddress produces a "remote_address" entry from the trusted address of the client.
+	RemoteAddress bool
+	// GenericKey produces a static entry.
+	GenericKey *RateLimitGenericKey
+}
+
+// RateLimitRequestHeader produces a descriptor entry from a request header.
+type RateLimitRequestHeader struct {
+	HeaderName    string
+	DescriptorKey string
+}
+
+// RateLimitGenericKey produces a static descriptor entry. The key defaults to "generic_key".
+type RateLimitGenericKey struct {
+	DescriptorKey   string
+	DescriptorValue string
+}
+
+// LocalRateLimit describes a token bucket limiting the requests of a route on each proxy.
+type LocalRateLimit struct {
+	// MaxTokens is the capacity of the bucket, i.e. the maximum burst of requests. Nothing is limited when zero.
+	MaxTokens uint32
+	// TokensPerFill is the number of tokens added to the bucket at each fill. Defaults to MaxTokens.
+	TokensPerFill uint32
+	// FillInterval is the interval between fills. Defaults to one second.
+	FillInterval time.Duration
+	// StatusCode is the status returned for the limited requests. Envoy returns 429 when zero.
+	StatusCode uint32
+}
+
+// FaultLimits bounds the resources used by the faults injected into a route.
+type FaultLimits struct {
+	// MaxActiveFaults caps the faults active at once on each proxy. Requests arriving beyond it are not faulted.
+	// The faults are unbounded when zero.
+	MaxActiveFaults uint32
+	// RequestBufferLimitBytes bounds the request body Envoy buffers while a fault delays the request, e.g. during
+	// large uploads. The fault filter has no limit of its own, so it is set as the per request buffer limit of
+	// a route injecting faults. PerRequestBufferLimitBytes takes precedence, and the connection limit applies
+	// when zero.
+	RequestBufferLimitBytes uint32
+}
+
+// DestinationExtension holds the settings for a single HTTPRouteDestination.
+type DestinationExtension struct {
+	// HealthAwareWeight marks the destination cluster as health aware: its effective weight should drop
+	// as its endpoints become unhealthy, shifting traffic to the other clusters of the route.
+	// Envoy does not adjust weighted cluster weights by itself, so the route only records the cluster
+	// under HealthAwareClustersMetadataKey. The cluster builder is expected to read that list and
+	// configure the cluster (e.g. its panic threshold and priority load) so that unhealthy hosts shed load.
+	HealthAwareWeight bool
+	// Fault, if set, injects faults into the requests sent to the destination, e.g. to test the resilience
+	// of clients against a canary only. It applies instead of the fault of the HTTPRoute, if any.
+	Fault *networking.HTTPFaultInjection
+	// LocalRateLimit, if set, limits the requests sent to the destination. It applies instead of the local
+	// rate limit of the route, if any.
+	LocalRateLimit *LocalRateLimit
+}
+
+// HeadersExtension holds the settings for a single set of header operations.
+type HeadersExtension struct {
+	// KeepEmptyValue keeps headers that are set or added with an empty value. By default Envoy drops them,
+	// while some integrations rely on a present but empty header as a signal.
+	KeepEmptyValue bool
+	// ClientCert selects how the x-forwarded-client-cert header of the requests is handled.
+	ClientCert ClientCertDetails
+}
+
+// ClientCertDetails selects how a route handles the x-forwarded-client-cert (XFCC) header, which carries the
+// details of the client certificate of mTLS connections.
+type ClientCertDetails int
+
+const (
+	// ClientCertDefault leaves the header to the settings of the listener and the remove list of the headers.
+	ClientCertDefault ClientCertDetails = iota
+	// ClientCertSanitize removes the header from the requests before forwarding them upstream.
+	ClientCertSanitize
+	// ClientCertForward forwards the header upstream, even when the remove list of the headers includes it.
+	ClientCertForward
+)
+
+// MatchExtension holds the settings for a single HTTPMatchRequest.
+type MatchExtension struct {
+	// PathTemplate matches the request path against a URI template, e.g. "/users/{id}/posts/*", with
+	// the Envoy uri_template extension. It replaces the uri match of the HTTPMatchRequest, if any.
+	// The URI rewrite of the route, if any, is then a template rewrite, e.g. "/v2/users/{id}".
+	PathTemplate string
+	// PathSeparatedPrefix makes a prefix uri match respect path segment boundaries, so that "/foo" matches
+	// "/foo" and "/foo/bar" but not "/foobar". Routes with ingress or gateway semantics always do so.
+	PathSeparatedPrefix bool
+	// Grpc restricts the match to gRPC requests, i.e. requests with an application/grpc content type.
+	Grpc bool
+	// GrpcService restricts the match to the calls of a fully qualified gRPC service, e.g. "helloworld.Greeter",
+	// by matching the request path. It replaces the uri match and path template, if any, and implies Grpc.
+	GrpcService string
+	// GrpcMethod restricts the match to a single method of GrpcService, e.g. "SayHello".
+	GrpcMethod string
+	// Percentage restricts the match to a random percentage of the requests, e.g. for a percentage canary.
+	// The remaining requests fall through to the next routes. A zero percentage never matches.
+	Percentage *networking.Percent
+	// Methods restricts the match to requests with any of the given HTTP methods, e.g. GET or POST.
+	// It replaces the method match of the HTTPMatchRequest, if any.
+	Methods []string
+	// WithoutQueryParams restricts the match to requests not carrying the given query parameters, keyed by
+	// name. Like QueryParams, a parameter matches on its exact or regex value, or on its presence when the
+	// value match is empty.
+	WithoutQueryParams map[string]*networking.StringMatch
+	// DynamicMetadata restricts the match to requests whose dynamic metadata, set by earlier filters such as
+	// an external authorization filter, matches all the given entries.
+	DynamicMetadata []*MetadataMatch
+	// Connect matches HTTP CONNECT requests, e.g. to tunnel TCP through the HTTP connection manager, instead
+	// of matching the request path. It cannot be combined with a path based match, such as a uri, a path
+	// template, a gRPC service or query parameters; such a match is dropped.
+	Connect bool
+	// SNIHosts restricts the match to requests for any of the given server names, e.g. "foo.example.com" or
+	// "*.example.com", such as the SNI of a TLS route consolidated into an HTTP route. HTTP routes do not see
+	// the SNI of the connection, so the host of the :authority header is matched instead, ignoring case and
+	// any port. Clients may send an authority differing from the SNI, so it does not replace an L4 SNI match
+	// to restrict access.
+	SNIHosts []string
+}
+
+// MetadataMatch matches a value of the dynamic metadata of a request.
+type MetadataMatch struct {
+	// Filter is the metadata namespace, usually the name of the filter setting the metadata,
+	// e.g. "envoy.filters.http.ext_authz".
+	Filter string
+	// Path is the path of the value in the metadata namespace, e.g. ["auth", "tier"].
+	Path []string
+	// Value matches the string value. An empty match requires the value to be present.
+	Value *networking.StringMatch
+}
+
+// Maintenance describes a static response served in place of the routes of a virtual service,
+// typically while the subset backing it is drained during a deploy.
+type Maintenance struct {
+	// Prefix restricts the maintenance response to request paths with this prefix. Defaults to "/".
+	Prefix string
+	// RetryAfter is advertised to clients in the Retry-After header, rounded up to whole seconds.
+	// The header is omitted when zero.
+	RetryAfter time.Duration
+	// Body is returned inline as the response body.
+	Body string
+}
+
+var (
+	emptyRouteExtension       = &RouteExtension{}
+	emptyDestinationExtension = &DestinationExtension{}
+	emptyHeadersExtension     = &HeadersExtension{}
+	emptyMatchExtension       = &MatchExtension{}
+)
+
+// forRoute returns the settings for the given HTTPRoute. It never returns nil.
+func (e *Extensions) forRoute(in *networking.HTTPRoute) *RouteExtension {
+	if e == nil {
+		return emptyRouteExtension
+	}
+	if rx := e.Routes[in]; rx != nil {
+		return rx
+	}
+	return emptyRouteExtension
+}
+
+// forDestination returns the settings for the given HTTPRouteDestination. It never returns nil.
+func (e *Extensions) forDestination(in *networking.HTTPRouteDestination) *DestinationExtension {
+	if e == nil {
+		return emptyDestinationExtension
+	}
+	if dx := e.Destinations[in]; dx != nil {
+		return dx
+	}
+	return emptyDestinationExtension
+}
+
+// forHeaders returns the settings for the given header operations. It never returns nil.
+func (e *Extensions) forHeaders(in *networking.Headers) *HeadersExtension {
+	if e == nil {
+		return emptyHeadersExtension
+	}
+	if hx := e.Headers[in]; hx != nil {
+		return hx
+	}
+	return emptyHeadersExtension
+}
+
+// forMatch returns the settings for the given HTTPMatchRequest. It never returns nil.
+func (e *Extensions) forMatch(in *networking.HTTPMatchRequest) *MatchExtension {
+	if e == nil {
+		return emptyMatchExtension
+	}
+	if mx := e.Matches[in]; mx != nil {
+		return mx
+	}
+	return emptyMatchExtension
+}
+
+// addHealthAwareClusters records the health aware clusters of a route in its istio filter metadata.
+func addHealthAwareClusters(out *route.Route, clusters []string) {
+	values := make([]*structpb.Value, 0, len(clusters))
+	for _, c := range clusters {
+		values = append(values, structpb.NewStringValue(c))
+	}
+	addIstioMetadata(out, HealthAwareClustersMetadataKey, structpb.NewListValue(&structpb.ListValue{Values: values}))
+}
+
+// addResponseCodeDetails records the details of the direct responses of a route in its istio filter metadata.
+func addResponseCodeDetails(out *route.Route, details string) {
+	addIstioMetadata(out, ResponseCodeDetailsMetadataKey, structpb.NewStringValue(details))
+}
+
+// addIstioMetadata sets a field of the istio filter metadata of a route.
+func addIstioMetadata(out *route.Route, key string, value *structpb.Value) {
+	if out.Metadata == nil {
+		out.Metadata = &core.Metadata{FilterMetadata: map[string]*structpb.Struct{}}
+	}
+	if _, ok := out.Metadata.FilterMetadata[util.IstioMetadataKey]; !ok {
+		out.Metadata.FilterMetadata[util.IstioMetadataKey] = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	}
+	out.Metadata.FilterMetadata[util.IstioMetadataKey].Fields[key] = value
+}
+
+// maintenance returns the maintenance settings of the virtual service, or nil if it is not under maintenance.
+func (e *Extensions) maintenance() *Maintenance {
+	if e == nil {
+		return nil
+	}
+	return e.Maintenance
+}
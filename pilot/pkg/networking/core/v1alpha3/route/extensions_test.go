@@ -0,0 +1,1636 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoyroute "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	xdshttpfault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	uritemplate "github.com/envoyproxy/go-control-plane/envoy/extensions/path/match/uri_template/v3"
+	uritemplaterewrite "github.com/envoyproxy/go-control-plane/envoy/extensions/path/rewrite/uri_template/v3"
+	xdstype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/route"
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pilot/test/xdstest"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/test"
+)
+
+var extensionsServiceRegistry = map[host.Name]*model.Service{
+	"*.example.org": {
+		Hostname:       "*.example.org",
+		DefaultAddress: "1.1.1.1",
+		Ports: model.PortList{
+			&model.Port{
+				Name:     "default",
+				Port:     8080,
+				Protocol: protocol.HTTP,
+			},
+		},
+	},
+}
+
+// buildRoutesWithExtensions builds the routes of a single HTTPRoute virtual service with the given extensions.
+func buildRoutesWithExtensions(t *testing.T, in *networking.HTTPRoute, ext *route.Extensions) []*envoyroute.Route {
+	t.Helper()
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+	node := cg.SetupProxy(&model.Proxy{
+		Type:        model.SidecarProxy,
+		IPAddresses: []string{"1.1.1.1"},
+		ID:          "someID",
+		DNSDomain:   "foo.com",
+	})
+	vs := config.Config{
+		Meta: config.Meta{
+			GroupVersionKind: gvk.VirtualService,
+			Name:             "acme",
+		},
+		Spec: &networking.VirtualService{
+			Hosts:    []string{},
+			Gateways: []string{"some-gateway"},
+			Http:     []*networking.HTTPRoute{in},
+		},
+	}
+	routes, err := route.BuildHTTPRoutes(vs, route.RouteOptions{
+		Node:            node,
+		ServiceRegistry: extensionsServiceRegistry,
+		ListenPort:      8080,
+		GatewayNames:    map[string]bool{"some-gateway": true},
+		Extensions:      ext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xdstest.ValidateRoutes(t, routes)
+	return routes
+}
+
+func exampleDestination(weight int32) *networking.HTTPRouteDestination {
+	return &networking.HTTPRouteDestination{
+		Destination: &networking.Destination{
+			Host: "*.example.org",
+			Port: &networking.PortSelector{
+				Number: 8484,
+			},
+		},
+		Weight: weight,
+	}
+}
+
+func TestHostRewriteHeader(t *testing.T) {
+	t.Run("header rewrite", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {HostRewriteHeader: "x-upstream-host"},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetRoute().GetHostRewriteHeader()).To(gomega.Equal("x-upstream-host"))
+		g.Expect(routes[0].GetRoute().GetHostRewriteLiteral()).To(gomega.BeEmpty())
+	})
+
+	t.Run("literal rewrite takes precedence", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Rewrite: &networking.HTTPRewrite{Authority: "foo.extsvc.com"},
+			Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {HostRewriteHeader: "x-upstream-host"},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetRoute().GetHostRewriteLiteral()).To(gomega.Equal("foo.extsvc.com"))
+		g.Expect(routes[0].GetRoute().GetHostRewriteHeader()).To(gomega.BeEmpty())
+	})
+
+	t.Run("no extension", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		routes := buildRoutesWithExtensions(t, in, nil)
+		g.Expect(routes[0].GetRoute().GetHostRewriteSpecifier()).To(gomega.BeNil())
+	})
+}
+
+func TestAppendXForwardedHost(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Rewrite: &networking.HTTPRewrite{Uri: "/v2", Authority: "foo.extsvc.com"},
+		Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {AppendXForwardedHost: true},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetHostRewriteLiteral()).To(gomega.Equal("foo.extsvc.com"))
+	g.Expect(routes[0].GetRoute().GetAppendXForwardedHost()).To(gomega.BeTrue())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetAppendXForwardedHost()).To(gomega.BeFalse())
+}
+
+func TestPreserveHost(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Rewrite: &networking.HTTPRewrite{Authority: "foo.extsvc.com"},
+		Route: []*networking.HTTPRouteDestination{
+			exampleDestination(50),
+			{
+				Destination: &networking.Destination{Host: "*.example.org", Subset: "v2", Port: &networking.PortSelector{Number: 8484}},
+				Weight:      50,
+				Headers: &networking.Headers{
+					Request: &networking.Headers_HeaderOperations{Set: map[string]string{"host": "v2.extsvc.com"}},
+				},
+			},
+		},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {PreserveHost: true, HostRewriteHeader: "x-upstream-host"},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetHostRewriteSpecifier()).To(gomega.BeNil())
+	for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+		g.Expect(c.GetHostRewriteSpecifier()).To(gomega.BeNil())
+	}
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetHostRewriteLiteral()).To(gomega.Equal("foo.extsvc.com"))
+	for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+		if c.GetName() == "outbound|8484|v2|*.example.org" {
+			g.Expect(c.GetHostRewriteLiteral()).To(gomega.Equal("v2.extsvc.com"))
+		}
+	}
+}
+
+func TestHealthAwareWeight(t *testing.T) {
+	g := gomega.NewWithT(t)
+	canary := exampleDestination(20)
+	canary.Destination.Subset = "canary"
+	stable := exampleDestination(80)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{stable, canary},
+	}
+	ext := &route.Extensions{
+		Destinations: map[*networking.HTTPRouteDestination]*route.DestinationExtension{
+			canary: {HealthAwareWeight: true},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	istioMeta := routes[0].GetMetadata().GetFilterMetadata()[util.IstioMetadataKey]
+	g.Expect(istioMeta.GetFields()["config"]).NotTo(gomega.BeNil())
+	clusters := istioMeta.GetFields()[route.HealthAwareClustersMetadataKey].GetListValue().GetValues()
+	g.Expect(clusters).To(gomega.HaveLen(1))
+	g.Expect(clusters[0].GetStringValue()).To(gomega.Equal("outbound|8484|canary|*.example.org"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()).
+		NotTo(gomega.HaveKey(route.HealthAwareClustersMetadataKey))
+}
+
+func TestResponseCodeDetails(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		DirectResponse: &networking.HTTPDirectResponse{Status: 403},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {ResponseCodeDetails: "mesh_denied"},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetDirectResponse().GetStatus()).To(gomega.Equal(uint32(403)))
+	istioMeta := routes[0].GetMetadata().GetFilterMetadata()[util.IstioMetadataKey]
+	g.Expect(istioMeta.GetFields()["config"]).NotTo(gomega.BeNil())
+	g.Expect(istioMeta.GetFields()[route.ResponseCodeDetailsMetadataKey].GetStringValue()).To(gomega.Equal("mesh_denied"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()).
+		NotTo(gomega.HaveKey(route.ResponseCodeDetailsMetadataKey))
+
+	// The details only describe direct responses.
+	forwarded := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext.Routes[forwarded] = &route.RouteExtension{ResponseCodeDetails: "mesh_denied"}
+	routes = buildRoutesWithExtensions(t, forwarded, ext)
+	g.Expect(routes[0].GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()).
+		NotTo(gomega.HaveKey(route.ResponseCodeDetailsMetadataKey))
+}
+
+func TestMaintenance(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{{
+			Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/api"}},
+		}},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Maintenance: &route.Maintenance{
+			Prefix:     "/api",
+			RetryAfter: 2 * time.Minute,
+			Body:       "down for maintenance",
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes).To(gomega.HaveLen(2))
+
+	// The maintenance route takes precedence over the routes of the virtual service.
+	maintenance := routes[0]
+	g.Expect(maintenance.GetName()).To(gomega.Equal(route.MaintenanceRouteName))
+	g.Expect(maintenance.GetMatch().GetPrefix()).To(gomega.Equal("/api"))
+	g.Expect(maintenance.GetDirectResponse().GetStatus()).To(gomega.Equal(uint32(503)))
+	g.Expect(maintenance.GetDirectResponse().GetBody().GetInlineString()).To(gomega.Equal("down for maintenance"))
+	g.Expect(maintenance.GetResponseHeadersToAdd()).To(gomega.HaveLen(1))
+	g.Expect(maintenance.GetResponseHeadersToAdd()[0].GetHeader().GetKey()).To(gomega.Equal(route.HeaderRetryAfter))
+	g.Expect(maintenance.GetResponseHeadersToAdd()[0].GetHeader().GetValue()).To(gomega.Equal("120"))
+	g.Expect(routes[1].GetRoute().GetCluster()).To(gomega.Equal("outbound|8484||*.example.org"))
+
+	routes = buildRoutesWithExtensions(t, in, &route.Extensions{Maintenance: &route.Maintenance{}})
+	g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.Equal("/"))
+	g.Expect(routes[0].GetResponseHeadersToAdd()).To(gomega.BeEmpty())
+}
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	cases := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{retryAfter: time.Millisecond, want: "1"},
+		{retryAfter: 500 * time.Millisecond, want: "1"},
+		{retryAfter: time.Second, want: "1"},
+		{retryAfter: 1500 * time.Millisecond, want: "2"},
+		{retryAfter: 2 * time.Minute, want: "120"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.retryAfter.String(), func(t *testing.T) {
+			r := route.BuildMaintenanceRoute(config.Config{}, &route.Maintenance{RetryAfter: tt.retryAfter}, 8080)
+			if got := r.GetResponseHeadersToAdd()[0].GetHeader().GetValue(); got != tt.want {
+				t.Errorf("got Retry-After %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepEmptyHeaderValue(t *testing.T) {
+	newRoute := func() *networking.HTTPRoute {
+		return &networking.HTTPRoute{
+			Headers: &networking.Headers{
+				Request: &networking.Headers_HeaderOperations{
+					Set: map[string]string{"x-signal": ""},
+				},
+			},
+			Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+	}
+
+	t.Run("keep empty value", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := newRoute()
+		ext := &route.Extensions{
+			Headers: map[*networking.Headers]*route.HeadersExtension{
+				in.Headers: {KeepEmptyValue: true},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetRequestHeadersToAdd()).To(gomega.HaveLen(1))
+		g.Expect(routes[0].GetRequestHeadersToAdd()[0].GetHeader().GetKey()).To(gomega.Equal("x-signal"))
+		g.Expect(routes[0].GetRequestHeadersToAdd()[0].GetKeepEmptyValue()).To(gomega.BeTrue())
+	})
+
+	t.Run("drop empty value", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		routes := buildRoutesWithExtensions(t, newRoute(), nil)
+		g.Expect(routes[0].GetRequestHeadersToAdd()).To(gomega.HaveLen(1))
+		g.Expect(routes[0].GetRequestHeadersToAdd()[0].GetKeepEmptyValue()).To(gomega.BeFalse())
+	})
+}
+
+func TestClientCertHeader(t *testing.T) {
+	cases := []struct {
+		name       string
+		remove     []string
+		clientCert route.ClientCertDetails
+		want       []string
+	}{
+		{
+			name:   "removed by the headers",
+			remove: []string{"x-forwarded-client-cert"},
+			want:   []string{"x-forwarded-client-cert"},
+		},
+		{
+			name:       "sanitize",
+			remove:     []string{"x-debug"},
+			clientCert: route.ClientCertSanitize,
+			want:       []string{"x-debug", "x-forwarded-client-cert"},
+		},
+		{
+			name:       "sanitize already removed",
+			remove:     []string{"X-Forwarded-Client-Cert"},
+			clientCert: route.ClientCertSanitize,
+			want:       []string{"X-Forwarded-Client-Cert"},
+		},
+		{
+			name:       "forward",
+			remove:     []string{"x-forwarded-client-cert", "x-debug"},
+			clientCert: route.ClientCertForward,
+			want:       []string{"x-debug"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Headers: &networking.Headers{
+					Request: &networking.Headers_HeaderOperations{Remove: tt.remove},
+				},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			ext := &route.Extensions{
+				Headers: map[*networking.Headers]*route.HeadersExtension{
+					in.Headers: {ClientCert: tt.clientCert},
+				},
+			}
+			routes := buildRoutesWithExtensions(t, in, ext)
+			g.Expect(routes[0].GetRequestHeadersToRemove()).To(gomega.Equal(tt.want))
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				RateLimits: []*route.RateLimit{{
+					Stage:      1,
+					DisableKey: "acme_ratelimit",
+					Actions: []route.RateLimitAction{
+						{RequestHeader: &route.RateLimitRequestHeader{HeaderName: "x-tenant", DescriptorKey: "tenant"}},
+						{RemoteAddress: true},
+					},
+				}},
+			},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	rateLimits := routes[0].GetRoute().GetRateLimits()
+	g.Expect(rateLimits).To(gomega.HaveLen(1))
+	g.Expect(rateLimits[0].GetStage().GetValue()).To(gomega.Equal(uint32(1)))
+	g.Expect(rateLimits[0].GetDisableKey()).To(gomega.Equal("acme_ratelimit"))
+	actions := rateLimits[0].GetActions()
+	g.Expect(actions).To(gomega.HaveLen(2))
+	g.Expect(actions[0].GetRequestHeaders().GetHeaderName()).To(gomega.Equal("x-tenant"))
+	g.Expect(actions[0].GetRequestHeaders().GetDescriptorKey()).To(gomega.Equal("tenant"))
+	g.Expect(actions[1].GetRemoteAddress()).NotTo(gomega.BeNil())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetRateLimits()).To(gomega.BeEmpty())
+}
+
+func TestRetryResetBeforeRequestOnly(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		Retries: &networking.HTTPRetry{Attempts: 3, RetryOn: "5xx,connect-failure"},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {RetryResetBeforeRequestOnly: true},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policy := routes[0].GetRoute().GetRetryPolicy()
+	g.Expect(policy.GetRetryOn()).To(gomega.Equal("connect-failure,reset-before-request"))
+	g.Expect(policy.GetNumRetries().GetValue()).To(gomega.Equal(uint32(3)))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetRetryPolicy().GetRetryOn()).To(gomega.Equal("5xx,connect-failure"))
+
+	in.Retries = &networking.HTTPRetry{Attempts: 0}
+	routes = buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetRetryPolicy()).To(gomega.BeNil())
+}
+
+func TestIncludeVirtualHostRateLimits(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				RateLimits:                   []*route.RateLimit{{Actions: []route.RateLimitAction{{RemoteAddress: true}}}},
+				IncludeVirtualHostRateLimits: true,
+			},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetRateLimits()).To(gomega.HaveLen(1))
+	g.Expect(routes[0].GetRoute().GetIncludeVhRateLimits().GetValue()).To(gomega.BeTrue()) // nolint: staticcheck
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetIncludeVhRateLimits()).To(gomega.BeNil()) // nolint: staticcheck
+}
+
+func TestOriginalPathHeader(t *testing.T) {
+	t.Run("rewrite", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Rewrite: &networking.HTTPRewrite{Uri: "/v2"},
+			Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {OriginalPathHeader: "x-envoy-original-path"},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetRoute().GetPrefixRewrite()).To(gomega.Equal("/v2"))
+		g.Expect(routes[0].GetRequestHeadersToAdd()).To(gomega.HaveLen(1))
+		g.Expect(routes[0].GetRequestHeadersToAdd()[0].GetHeader().GetKey()).To(gomega.Equal("x-envoy-original-path"))
+		g.Expect(routes[0].GetRequestHeadersToAdd()[0].GetHeader().GetValue()).To(gomega.Equal("%REQ(:PATH)%"))
+	})
+
+	t.Run("no rewrite", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {OriginalPathHeader: "x-envoy-original-path"},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetRequestHeadersToAdd()).To(gomega.BeEmpty())
+	})
+}
+
+func TestCohortHeader(t *testing.T) {
+	g := gomega.NewWithT(t)
+	canary := exampleDestination(20)
+	canary.Destination.Subset = "canary"
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(80), canary},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {CohortHeader: "x-user-bucket"},
+		},
+	}
+	// The cluster is picked from the header value alone, so the clusters must keep the virtual service
+	// order for requests with the same header value to stay in the same cohort: header values below 80
+	// go to the first destination, although the canary cluster sorts first by name.
+	first := buildRoutesWithExtensions(t, in, ext)[0].GetRoute().GetWeightedClusters()
+	g.Expect(first.GetHeaderName()).To(gomega.Equal("x-user-bucket"))
+	g.Expect(first.GetTotalWeight().GetValue()).To(gomega.Equal(uint32(100)))
+	g.Expect(first.GetClusters()).To(gomega.HaveLen(2))
+	g.Expect(first.GetClusters()[0].GetName()).To(gomega.Equal("outbound|8484||*.example.org"))
+	g.Expect(first.GetClusters()[0].GetWeight().GetValue()).To(gomega.Equal(uint32(80)))
+	g.Expect(first.GetClusters()[1].GetName()).To(gomega.Equal("outbound|8484|canary|*.example.org"))
+
+	// Adding a destination keeps the cohorts of the existing ones in place.
+	beta := exampleDestination(0)
+	beta.Destination.Subset = "beta"
+	in.Route = append(in.Route, beta)
+	second := buildRoutesWithExtensions(t, in, ext)[0].GetRoute().GetWeightedClusters()
+	for i, c := range first.GetClusters() {
+		g.Expect(second.GetClusters()[i].GetName()).To(gomega.Equal(c.GetName()))
+		g.Expect(second.GetClusters()[i].GetWeight().GetValue()).To(gomega.Equal(c.GetWeight().GetValue()))
+	}
+
+	routes := buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetWeightedClusters().GetRandomValueSpecifier()).To(gomega.BeNil())
+}
+
+func TestRouteTracingCustomTags(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				Tracing: &route.RouteTracing{
+					CustomTags: map[string]*meshconfig.Tracing_CustomTag{
+						"tenant": {
+							Type: &meshconfig.Tracing_CustomTag_Header{
+								Header: &meshconfig.Tracing_RequestHeader{Name: "x-tenant", DefaultValue: "unknown"},
+							},
+						},
+						"team": {
+							Type: &meshconfig.Tracing_CustomTag_Literal{
+								Literal: &meshconfig.Tracing_Literal{Value: "payments"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	tags := routes[0].GetTracing().GetCustomTags()
+	g.Expect(tags).To(gomega.HaveLen(2))
+	g.Expect(tags[0].GetTag()).To(gomega.Equal("team"))
+	g.Expect(tags[0].GetLiteral().GetValue()).To(gomega.Equal("payments"))
+	g.Expect(tags[1].GetTag()).To(gomega.Equal("tenant"))
+	g.Expect(tags[1].GetRequestHeader().GetName()).To(gomega.Equal("x-tenant"))
+	g.Expect(tags[1].GetRequestHeader().GetDefaultValue()).To(gomega.Equal("unknown"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetTracing()).To(gomega.BeNil())
+}
+
+func TestRouteTracingSampling(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				Tracing: &route.RouteTracing{
+					RandomSampling: &networking.Percent{Value: 10},
+				},
+			},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	tracing := routes[0].GetTracing()
+	g.Expect(tracing.GetRandomSampling().GetNumerator()).To(gomega.Equal(uint32(100000)))
+	g.Expect(tracing.GetRandomSampling().GetDenominator()).To(gomega.Equal(xdstype.FractionalPercent_MILLION))
+	// Unset sampling percentages inherit the global settings.
+	g.Expect(tracing.GetClientSampling()).To(gomega.BeNil())
+	g.Expect(tracing.GetOverallSampling()).To(gomega.BeNil())
+	g.Expect(tracing.GetCustomTags()).To(gomega.BeEmpty())
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	for name, enabled := range map[string]bool{"enable": true, "disable": false} {
+		enabled := enabled
+		t.Run(name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			ext := &route.Extensions{
+				Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+					in: {WebsocketUpgrade: &enabled},
+				},
+			}
+			routes := buildRoutesWithExtensions(t, in, ext)
+			upgrades := routes[0].GetRoute().GetUpgradeConfigs()
+			g.Expect(upgrades).To(gomega.HaveLen(1))
+			g.Expect(upgrades[0].GetUpgradeType()).To(gomega.Equal("websocket"))
+			g.Expect(upgrades[0].GetEnabled().GetValue()).To(gomega.Equal(enabled))
+		})
+	}
+
+	t.Run("unset", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{
+			Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		routes := buildRoutesWithExtensions(t, in, nil)
+		g.Expect(routes[0].GetRoute().GetUpgradeConfigs()).To(gomega.BeEmpty())
+	})
+}
+
+func TestInternalRedirect(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				InternalRedirect: &route.InternalRedirect{
+					MaxRedirects:  3,
+					ResponseCodes: []uint32{301, 302, 307},
+				},
+			},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policy := routes[0].GetRoute().GetInternalRedirectPolicy()
+	g.Expect(policy.GetMaxInternalRedirects().GetValue()).To(gomega.Equal(uint32(3)))
+	g.Expect(policy.GetRedirectResponseCodes()).To(gomega.Equal([]uint32{301, 302, 307}))
+	g.Expect(policy.GetAllowCrossSchemeRedirect()).To(gomega.BeFalse())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetInternalRedirectPolicy()).To(gomega.BeNil())
+}
+
+func TestPerRequestBufferLimit(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {PerRequestBufferLimitBytes: 64 * 1024 * 1024},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetPerRequestBufferLimitBytes().GetValue()).To(gomega.Equal(uint32(64 * 1024 * 1024)))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetPerRequestBufferLimitBytes()).To(gomega.BeNil())
+}
+
+func TestClusterNotFoundResponseCode(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	build := func(code uint32) envoyroute.RouteAction_ClusterNotFoundResponseCode {
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {ClusterNotFoundResponseCode: code},
+			},
+		}
+		return buildRoutesWithExtensions(t, in, ext)[0].GetRoute().GetClusterNotFoundResponseCode()
+	}
+	g.Expect(build(404)).To(gomega.Equal(envoyroute.RouteAction_NOT_FOUND))
+	g.Expect(build(500)).To(gomega.Equal(envoyroute.RouteAction_INTERNAL_SERVER_ERROR))
+	g.Expect(build(503)).To(gomega.Equal(envoyroute.RouteAction_SERVICE_UNAVAILABLE))
+	// Unsupported codes are ignored.
+	g.Expect(build(418)).To(gomega.Equal(envoyroute.RouteAction_SERVICE_UNAVAILABLE))
+
+	routes := buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetClusterNotFoundResponseCode()).To(gomega.Equal(envoyroute.RouteAction_SERVICE_UNAVAILABLE))
+}
+
+func TestPathTemplate(t *testing.T) {
+	g := gomega.NewWithT(t)
+	match := &networking.HTTPMatchRequest{
+		Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/users"}},
+	}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{match},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			match: {PathTemplate: "/users/{id}/posts/*"},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policy := routes[0].GetMatch().GetPathMatchPolicy()
+	g.Expect(policy.GetName()).To(gomega.Equal("envoy.path.match.uri_template.uri_template_matcher"))
+	config := &uritemplate.UriTemplateMatchConfig{}
+	g.Expect(policy.GetTypedConfig().UnmarshalTo(config)).To(gomega.Succeed())
+	g.Expect(config.GetPathTemplate()).To(gomega.Equal("/users/{id}/posts/*"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.Equal("/users"))
+}
+
+func TestPathTemplateRewrite(t *testing.T) {
+	build := func(rewrite string) *envoyroute.Route {
+		match := &networking.HTTPMatchRequest{}
+		in := &networking.HTTPRoute{
+			Match:   []*networking.HTTPMatchRequest{match},
+			Rewrite: &networking.HTTPRewrite{Uri: rewrite},
+			Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		ext := &route.Extensions{
+			Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+				match: {PathTemplate: "/users/{id}/posts/*"},
+			},
+		}
+		return buildRoutesWithExtensions(t, in, ext)[0]
+	}
+
+	t.Run("template rewrite", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		action := build("/v2/users/{id}").GetRoute()
+		g.Expect(action.GetPrefixRewrite()).To(gomega.BeEmpty())
+		policy := action.GetPathRewritePolicy()
+		g.Expect(policy.GetName()).To(gomega.Equal("envoy.path.rewrite.uri_template.uri_template_rewriter"))
+		config := &uritemplaterewrite.UriTemplateRewriteConfig{}
+		g.Expect(policy.GetTypedConfig().UnmarshalTo(config)).To(gomega.Succeed())
+		g.Expect(config.GetPathTemplateRewrite()).To(gomega.Equal("/v2/users/{id}"))
+	})
+	t.Run("rewrite not a path", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		action := build("v2").GetRoute()
+		g.Expect(action.GetPrefixRewrite()).To(gomega.BeEmpty())
+		g.Expect(action.GetPathRewritePolicy()).To(gomega.BeNil())
+	})
+}
+
+func TestPathSeparatedPrefix(t *testing.T) {
+	for _, prefix := range []string{"/foo", "/foo/"} {
+		t.Run(prefix, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			match := &networking.HTTPMatchRequest{
+				Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: prefix}},
+			}
+			in := &networking.HTTPRoute{
+				Match: []*networking.HTTPMatchRequest{match},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			ext := &route.Extensions{
+				Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+					match: {PathSeparatedPrefix: true},
+				},
+			}
+			// /foo matches /foo and /foo/bar, but not /foobar.
+			routes := buildRoutesWithExtensions(t, in, ext)
+			g.Expect(routes[0].GetMatch().GetPathSeparatedPrefix()).To(gomega.Equal("/foo"))
+			g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.BeEmpty())
+
+			// A plain prefix match also matches /foobar.
+			routes = buildRoutesWithExtensions(t, in, nil)
+			g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.Equal(prefix))
+			g.Expect(routes[0].GetMatch().GetPathSeparatedPrefix()).To(gomega.BeEmpty())
+		})
+	}
+}
+
+func TestGrpcMatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		mx       *route.MatchExtension
+		wantPath string
+		wantPref string
+	}{
+		{name: "any gRPC call", mx: &route.MatchExtension{Grpc: true}, wantPref: "/"},
+		{name: "service", mx: &route.MatchExtension{GrpcService: "helloworld.Greeter"}, wantPref: "/helloworld.Greeter/"},
+		{
+			name:     "method",
+			mx:       &route.MatchExtension{GrpcService: "helloworld.Greeter", GrpcMethod: "SayHello"},
+			wantPath: "/helloworld.Greeter/SayHello",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			match := &networking.HTTPMatchRequest{Name: "grpc"}
+			in := &networking.HTTPRoute{
+				Match: []*networking.HTTPMatchRequest{match},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			ext := &route.Extensions{
+				Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{match: tt.mx},
+			}
+			routes := buildRoutesWithExtensions(t, in, ext)
+			g.Expect(routes[0].GetMatch().GetGrpc()).NotTo(gomega.BeNil())
+			g.Expect(routes[0].GetMatch().GetPath()).To(gomega.Equal(tt.wantPath))
+			g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.Equal(tt.wantPref))
+
+			routes = buildRoutesWithExtensions(t, in, nil)
+			g.Expect(routes[0].GetMatch().GetGrpc()).To(gomega.BeNil())
+		})
+	}
+}
+
+func TestSNIHostsMatch(t *testing.T) {
+	g := gomega.NewWithT(t)
+	match := &networking.HTTPMatchRequest{Name: "sni"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{match},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			match: {SNIHosts: []string{"foo.example.com", "*.example.org"}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	xdstest.ValidateRoutes(t, routes)
+	headers := routes[0].GetMatch().GetHeaders()
+	g.Expect(headers).To(gomega.HaveLen(1))
+	g.Expect(headers[0].GetName()).To(gomega.Equal(route.HeaderAuthority))
+	regex := headers[0].GetStringMatch().GetSafeRegex().GetRegex()
+	g.Expect(regex).To(gomega.Equal(`(?i)(foo\.example\.com|[^.:]+\.example\.org)(:[0-9]+)?`))
+
+	// Envoy requires the regex to match the whole header value.
+	re := regexp.MustCompile("^(?:" + regex + ")$")
+	for authority, want := range map[string]bool{
+		"foo.example.com":      true,
+		"FOO.example.com:8443": true,
+		"bar.example.org":      true,
+		"bar.example.org:443":  true,
+		"foo.example.com.evil": false,
+		"fooxexample.com":      false,
+		"a.b.example.org":      false,
+		"example.org":          false,
+	} {
+		g.Expect(re.MatchString(authority)).To(gomega.Equal(want), authority)
+	}
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetHeaders()).To(gomega.BeEmpty())
+}
+
+func TestConnectMatch(t *testing.T) {
+	g := gomega.NewWithT(t)
+	connect := &networking.HTTPMatchRequest{Name: "connect"}
+	withPrefix := &networking.HTTPMatchRequest{
+		Name: "connect-prefix",
+		Uri:  &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/tunnel"}},
+	}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{withPrefix, connect},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			connect:    {Connect: true},
+			withPrefix: {Connect: true},
+		},
+	}
+	// The match combining CONNECT and a uri prefix is dropped.
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes).To(gomega.HaveLen(1))
+	g.Expect(routes[0].GetName()).To(gomega.Equal(".connect"))
+	g.Expect(routes[0].GetMatch().GetConnectMatcher()).NotTo(gomega.BeNil())
+	g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.BeEmpty())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes).To(gomega.HaveLen(2))
+	g.Expect(routes[0].GetMatch().GetPrefix()).To(gomega.Equal("/tunnel"))
+	g.Expect(routes[1].GetMatch().GetConnectMatcher()).To(gomega.BeNil())
+}
+
+func TestConnectTunnel(t *testing.T) {
+	g := gomega.NewWithT(t)
+	connect := &networking.HTTPMatchRequest{Name: "connect"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{connect},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	websocket := false
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {
+				WebsocketUpgrade: &websocket,
+				ConnectTunnel:    &route.ConnectTunnel{AllowPost: true, ProxyProtocol: true},
+			},
+		},
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{connect: {Connect: true}},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetMatch().GetConnectMatcher()).NotTo(gomega.BeNil())
+	upgrades := routes[0].GetRoute().GetUpgradeConfigs()
+	g.Expect(upgrades).To(gomega.HaveLen(2))
+	g.Expect(upgrades[0].GetUpgradeType()).To(gomega.Equal("websocket"))
+	g.Expect(upgrades[1].GetUpgradeType()).To(gomega.Equal("CONNECT"))
+	g.Expect(upgrades[1].GetConnectConfig().GetAllowPost()).To(gomega.BeTrue())
+	g.Expect(upgrades[1].GetConnectConfig().GetProxyProtocolConfig().GetVersion()).To(gomega.Equal(core.ProxyProtocolConfig_V2))
+	g.Expect(routes[0].GetRoute().GetCluster()).To(gomega.Equal("outbound|8484||*.example.org"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetUpgradeConfigs()).To(gomega.BeEmpty())
+}
+
+func TestPercentageMatch(t *testing.T) {
+	g := gomega.NewWithT(t)
+	canary := &networking.HTTPMatchRequest{Name: "canary"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{canary},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	build := func(percent float64) *envoyroute.RouteMatch {
+		ext := &route.Extensions{
+			Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+				canary: {Percentage: &networking.Percent{Value: percent}},
+			},
+		}
+		return buildRoutesWithExtensions(t, in, ext)[0].GetMatch()
+	}
+
+	fraction := build(5).GetRuntimeFraction().GetDefaultValue()
+	g.Expect(fraction.GetNumerator()).To(gomega.Equal(uint32(50000)))
+	g.Expect(fraction.GetDenominator()).To(gomega.Equal(xdstype.FractionalPercent_MILLION))
+
+	// A 0% match never applies.
+	fraction = build(0).GetRuntimeFraction().GetDefaultValue()
+	g.Expect(fraction).NotTo(gomega.BeNil())
+	g.Expect(fraction.GetNumerator()).To(gomega.Equal(uint32(0)))
+
+	routes := buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetRuntimeFraction()).To(gomega.BeNil())
+}
+
+func TestMethodsMatch(t *testing.T) {
+	g := gomega.NewWithT(t)
+	match := &networking.HTTPMatchRequest{Name: "read-write"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{match},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			match: {Methods: []string{"GET", "POST"}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	headers := routes[0].GetMatch().GetHeaders()
+	g.Expect(headers).To(gomega.HaveLen(1))
+	g.Expect(headers[0].GetName()).To(gomega.Equal(":method"))
+	// Envoy matches the regex against the full header value.
+	re := regexp.MustCompile("^(?:" + headers[0].GetStringMatch().GetSafeRegex().GetRegex() + ")$")
+	g.Expect(re.MatchString("GET")).To(gomega.BeTrue())
+	g.Expect(re.MatchString("POST")).To(gomega.BeTrue())
+	g.Expect(re.MatchString("PUT")).To(gomega.BeFalse())
+	g.Expect(re.MatchString("GETPOST")).To(gomega.BeFalse())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetHeaders()).To(gomega.BeEmpty())
+}
+
+func TestWithoutQueryParams(t *testing.T) {
+	g := gomega.NewWithT(t)
+	match := &networking.HTTPMatchRequest{Name: "not-debug"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{match},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			match: {WithoutQueryParams: map[string]*networking.StringMatch{
+				"debug":   {},
+				"version": {MatchType: &networking.StringMatch_Exact{Exact: "v1"}},
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	headers := routes[0].GetMatch().GetHeaders()
+	g.Expect(headers).To(gomega.HaveLen(2))
+	// matches reports whether the route matches the path, as Envoy would.
+	matches := func(path string) bool {
+		for _, h := range headers {
+			g.Expect(h.GetName()).To(gomega.Equal(":path"))
+			g.Expect(h.GetInvertMatch()).To(gomega.BeTrue())
+			re := regexp.MustCompile("^(?:" + h.GetStringMatch().GetSafeRegex().GetRegex() + ")$")
+			if re.MatchString(path) {
+				return false
+			}
+		}
+		return true
+	}
+	g.Expect(matches("/foo")).To(gomega.BeTrue())
+	g.Expect(matches("/foo?page=1")).To(gomega.BeTrue())
+	g.Expect(matches("/foo?debugger=1")).To(gomega.BeTrue())
+	g.Expect(matches("/foo?version=v2")).To(gomega.BeTrue())
+	g.Expect(matches("/debug")).To(gomega.BeTrue())
+	g.Expect(matches("/foo?debug")).To(gomega.BeFalse())
+	g.Expect(matches("/foo?page=1&debug=true")).To(gomega.BeFalse())
+	g.Expect(matches("/foo?version=v1&page=1")).To(gomega.BeFalse())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetHeaders()).To(gomega.BeEmpty())
+}
+
+func TestDecoratorPropagate(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	propagate := false
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {Decorator: &route.RouteDecorator{Propagate: &propagate}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetDecorator().GetPropagate()).NotTo(gomega.BeNil())
+	g.Expect(routes[0].GetDecorator().GetPropagate().GetValue()).To(gomega.BeFalse())
+	g.Expect(routes[0].GetDecorator().GetOperation()).NotTo(gomega.BeEmpty())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetDecorator().GetPropagate()).To(gomega.BeNil())
+}
+
+func TestDecoratorOperation(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {Decorator: &route.RouteDecorator{Operation: "checkout"}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetDecorator().GetOperation()).To(gomega.Equal("checkout"))
+	g.Expect(routes[0].GetDecorator().GetPropagate()).To(gomega.BeNil())
+
+	// The operation is derived from the destination and path by default.
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetDecorator().GetOperation()).To(gomega.Equal("*.example.org:8484/*"))
+}
+
+func TestRetriableRequestHeaders(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {RetriableRequestHeaders: map[string]*networking.StringMatch{
+				"x-idempotent":    {MatchType: &networking.StringMatch_Exact{Exact: "true"}},
+				"idempotency-key": {},
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	headers := routes[0].GetRoute().GetRetryPolicy().GetRetriableRequestHeaders()
+	g.Expect(headers).To(gomega.HaveLen(2))
+	g.Expect(headers[0].GetName()).To(gomega.Equal("idempotency-key"))
+	g.Expect(headers[0].GetPresentMatch()).To(gomega.BeTrue())
+	g.Expect(headers[1].GetName()).To(gomega.Equal("x-idempotent"))
+	g.Expect(headers[1].GetStringMatch().GetExact()).To(gomega.Equal("true"))
+
+	// Routes that do not retry are left untouched.
+	in.Retries = &networking.HTTPRetry{Attempts: 0}
+	routes = buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetRetryPolicy()).To(gomega.BeNil())
+
+	in.Retries = nil
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetRetryPolicy().GetRetriableRequestHeaders()).To(gomega.BeEmpty())
+}
+
+func TestMirrors(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	subset := func(name string) *networking.Destination {
+		return &networking.Destination{Host: "*.example.org", Subset: name, Port: &networking.PortSelector{Number: 8484}}
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {Mirrors: []*route.Mirror{
+				{Destination: subset("canary-a"), Percentage: &networking.Percent{Value: 10}},
+				{Destination: subset("canary-b"), Percentage: &networking.Percent{Value: 5}},
+				{Destination: subset("canary-c"), Percentage: &networking.Percent{Value: 0}},
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policies := routes[0].GetRoute().GetRequestMirrorPolicies()
+	g.Expect(policies).To(gomega.HaveLen(2))
+	g.Expect(policies[0].GetCluster()).To(gomega.Equal("outbound|8484|canary-a|*.example.org"))
+	g.Expect(policies[0].GetRuntimeFraction().GetDefaultValue().GetNumerator()).To(gomega.Equal(uint32(100000)))
+	g.Expect(policies[1].GetCluster()).To(gomega.Equal("outbound|8484|canary-b|*.example.org"))
+	g.Expect(policies[1].GetRuntimeFraction().GetDefaultValue().GetNumerator()).To(gomega.Equal(uint32(50000)))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetRequestMirrorPolicies()).To(gomega.BeEmpty())
+}
+
+func TestStaticClusterMirror(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {Mirrors: []*route.Mirror{
+				{Cluster: "shadow_cluster", Percentage: &networking.Percent{Value: 20}},
+				{
+					Cluster:     "audit_cluster",
+					Destination: &networking.Destination{Host: "*.example.org", Port: &networking.PortSelector{Number: 8484}},
+					Percentage:  &networking.Percent{Value: 1},
+				},
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policies := routes[0].GetRoute().GetRequestMirrorPolicies()
+	g.Expect(policies).To(gomega.HaveLen(2))
+	g.Expect(policies[0].GetCluster()).To(gomega.Equal("shadow_cluster"))
+	g.Expect(policies[0].GetRuntimeFraction().GetDefaultValue().GetNumerator()).To(gomega.Equal(uint32(200000)))
+	g.Expect(policies[1].GetCluster()).To(gomega.Equal("audit_cluster"))
+}
+
+func TestLocalRateLimit(t *testing.T) {
+	cases := []struct {
+		name           string
+		rateLimit      *route.LocalRateLimit
+		fault          *networking.HTTPFaultInjection
+		wantBucket     *xdstype.TokenBucket
+		wantStatusCode xdstype.StatusCode
+	}{
+		{
+			name:      "token bucket",
+			rateLimit: &route.LocalRateLimit{MaxTokens: 100, TokensPerFill: 10, FillInterval: 100 * time.Millisecond, StatusCode: 503},
+			wantBucket: &xdstype.TokenBucket{
+				MaxTokens:     100,
+				TokensPerFill: wrapperspb.UInt32(10),
+				FillInterval:  durationpb.New(100 * time.Millisecond),
+			},
+			wantStatusCode: xdstype.StatusCode_ServiceUnavailable,
+		},
+		{
+			name:      "defaults",
+			rateLimit: &route.LocalRateLimit{MaxTokens: 50},
+			wantBucket: &xdstype.TokenBucket{
+				MaxTokens:     50,
+				TokensPerFill: wrapperspb.UInt32(50),
+				FillInterval:  durationpb.New(time.Second),
+			},
+		},
+		{
+			name:      "with fault",
+			rateLimit: &route.LocalRateLimit{MaxTokens: 50},
+			fault: &networking.HTTPFaultInjection{
+				Abort: &networking.HTTPFaultInjection_Abort{ErrorType: &networking.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 500}},
+			},
+			wantBucket: &xdstype.TokenBucket{
+				MaxTokens:     50,
+				TokensPerFill: wrapperspb.UInt32(50),
+				FillInterval:  durationpb.New(time.Second),
+			},
+		},
+		{
+			name:      "no tokens",
+			rateLimit: &route.LocalRateLimit{},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+				Fault: tt.fault,
+			}
+			ext := &route.Extensions{
+				Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+					in: {LocalRateLimit: tt.rateLimit},
+				},
+			}
+			routes := buildRoutesWithExtensions(t, in, ext)
+			perFilter := routes[0].GetTypedPerFilterConfig()
+			// The rate limit is attached alongside the fault config.
+			if tt.fault != nil {
+				g.Expect(perFilter).To(gomega.HaveKey(wellknown.Fault))
+			} else {
+				g.Expect(perFilter).NotTo(gomega.HaveKey(wellknown.Fault))
+			}
+			if tt.wantBucket == nil {
+				g.Expect(perFilter).NotTo(gomega.HaveKey("envoy.filters.http.local_ratelimit"))
+				return
+			}
+			g.Expect(perFilter).To(gomega.HaveKey("envoy.filters.http.local_ratelimit"))
+			got := &localratelimit.LocalRateLimit{}
+			g.Expect(perFilter["envoy.filters.http.local_ratelimit"].UnmarshalTo(got)).To(gomega.Succeed())
+			g.Expect(proto.Equal(got.GetTokenBucket(), tt.wantBucket)).To(gomega.BeTrue(), "token bucket %v", got.GetTokenBucket())
+			g.Expect(got.GetStatus().GetCode()).To(gomega.Equal(tt.wantStatusCode))
+			g.Expect(got.GetFilterEnforced().GetDefaultValue().GetNumerator()).To(gomega.Equal(uint32(100)))
+			g.Expect(got.GetFilterEnabled().GetDefaultValue().GetNumerator()).To(gomega.Equal(uint32(100)))
+		})
+	}
+}
+
+func TestHedge(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		Retries: &networking.HTTPRetry{Attempts: 2, PerTryTimeout: durationpb.New(100 * time.Millisecond)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {Hedge: &route.Hedge{
+				InitialRequests:         2,
+				AdditionalRequestChance: &networking.Percent{Value: 25},
+				HedgeOnPerTryTimeout:    true,
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	hedge := routes[0].GetRoute().GetHedgePolicy()
+	g.Expect(hedge.GetInitialRequests().GetValue()).To(gomega.Equal(uint32(2)))
+	g.Expect(hedge.GetAdditionalRequestChance().GetNumerator()).To(gomega.Equal(uint32(250000)))
+	g.Expect(hedge.GetAdditionalRequestChance().GetDenominator()).To(gomega.Equal(xdstype.FractionalPercent_MILLION))
+	g.Expect(hedge.GetHedgeOnPerTryTimeout()).To(gomega.BeTrue())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetHedgePolicy()).To(gomega.BeNil())
+}
+
+func TestDestinationPerFilterConfig(t *testing.T) {
+	abort := &networking.HTTPFaultInjection{
+		Abort: &networking.HTTPFaultInjection_Abort{
+			ErrorType:  &networking.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 503},
+			Percentage: &networking.Percent{Value: 50},
+		},
+	}
+	subset := func(name string, weight int32) *networking.HTTPRouteDestination {
+		dst := exampleDestination(weight)
+		dst.Destination.Subset = name
+		return dst
+	}
+
+	t.Run("weighted clusters", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		stable, canary := subset("stable", 90), subset("canary", 10)
+		in := &networking.HTTPRoute{Route: []*networking.HTTPRouteDestination{stable, canary}}
+		ext := &route.Extensions{
+			Destinations: map[*networking.HTTPRouteDestination]*route.DestinationExtension{
+				canary: {Fault: abort},
+			},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetTypedPerFilterConfig()).To(gomega.BeEmpty())
+		clusters := map[string]*envoyroute.WeightedCluster_ClusterWeight{}
+		for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+			clusters[c.Name] = c
+		}
+		g.Expect(clusters).To(gomega.HaveLen(2))
+		g.Expect(clusters["outbound|8484|stable|*.example.org"].GetTypedPerFilterConfig()).To(gomega.BeEmpty())
+		canaryConfig := clusters["outbound|8484|canary|*.example.org"].GetTypedPerFilterConfig()
+		g.Expect(canaryConfig).To(gomega.HaveKey(wellknown.Fault))
+		fault := &xdshttpfault.HTTPFault{}
+		g.Expect(canaryConfig[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+		g.Expect(fault.GetAbort().GetHttpStatus()).To(gomega.Equal(uint32(503)))
+	})
+
+	t.Run("single cluster", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		canary := subset("canary", 100)
+		in := &networking.HTTPRoute{
+			Route: []*networking.HTTPRouteDestination{canary},
+			Fault: &networking.HTTPFaultInjection{
+				Delay: &networking.HTTPFaultInjection_Delay{
+					HttpDelayType: &networking.HTTPFaultInjection_Delay_FixedDelay{FixedDelay: durationpb.New(time.Second)},
+				},
+			},
+		}
+		ext := &route.Extensions{
+			Destinations: map[*networking.HTTPRouteDestination]*route.DestinationExtension{
+				canary: {Fault: abort, LocalRateLimit: &route.LocalRateLimit{MaxTokens: 10}},
+			},
+		}
+		// The config of the lone cluster moves to the route, replacing the route fault.
+		routes := buildRoutesWithExtensions(t, in, ext)
+		perFilter := routes[0].GetTypedPerFilterConfig()
+		g.Expect(perFilter).To(gomega.HaveLen(2))
+		g.Expect(perFilter).To(gomega.HaveKey("envoy.filters.http.local_ratelimit"))
+		fault := &xdshttpfault.HTTPFault{}
+		g.Expect(perFilter[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+		g.Expect(fault.GetAbort()).NotTo(gomega.BeNil())
+		g.Expect(fault.GetDelay()).To(gomega.BeNil())
+	})
+}
+
+func TestFaultLimits(t *testing.T) {
+	delay := &networking.HTTPFaultInjection{
+		Delay: &networking.HTTPFaultInjection_Delay{
+			HttpDelayType: &networking.HTTPFaultInjection_Delay_FixedDelay{FixedDelay: durationpb.New(time.Second)},
+			Percentage:    &networking.Percent{Value: 10},
+		},
+	}
+	limits := &route.FaultLimits{MaxActiveFaults: 5, RequestBufferLimitBytes: 1024 * 1024}
+
+	t.Run("route fault", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{Route: []*networking.HTTPRouteDestination{exampleDestination(100)}, Fault: delay}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{in: {FaultLimits: limits}},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		fault := &xdshttpfault.HTTPFault{}
+		g.Expect(routes[0].GetTypedPerFilterConfig()[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+		g.Expect(fault.GetMaxActiveFaults().GetValue()).To(gomega.Equal(uint32(5)))
+		g.Expect(routes[0].GetPerRequestBufferLimitBytes().GetValue()).To(gomega.Equal(uint32(1024 * 1024)))
+
+		routes = buildRoutesWithExtensions(t, in, nil)
+		g.Expect(routes[0].GetTypedPerFilterConfig()[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+		g.Expect(fault.GetMaxActiveFaults()).To(gomega.BeNil())
+		g.Expect(routes[0].GetPerRequestBufferLimitBytes()).To(gomega.BeNil())
+	})
+
+	t.Run("destination fault", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		stable, canary := exampleDestination(90), exampleDestination(10)
+		stable.Destination.Subset, canary.Destination.Subset = "stable", "canary"
+		in := &networking.HTTPRoute{Route: []*networking.HTTPRouteDestination{stable, canary}}
+		ext := &route.Extensions{
+			Routes:       map[*networking.HTTPRoute]*route.RouteExtension{in: {FaultLimits: limits}},
+			Destinations: map[*networking.HTTPRouteDestination]*route.DestinationExtension{canary: {Fault: delay}},
+		}
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetPerRequestBufferLimitBytes().GetValue()).To(gomega.Equal(uint32(1024 * 1024)))
+		for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+			if c.Name != "outbound|8484|canary|*.example.org" {
+				continue
+			}
+			fault := &xdshttpfault.HTTPFault{}
+			g.Expect(c.GetTypedPerFilterConfig()[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+			g.Expect(fault.GetMaxActiveFaults().GetValue()).To(gomega.Equal(uint32(5)))
+		}
+	})
+
+	t.Run("no fault", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		in := &networking.HTTPRoute{Route: []*networking.HTTPRouteDestination{exampleDestination(100)}}
+		ext := &route.Extensions{
+			Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+				in: {FaultLimits: limits, PerRequestBufferLimitBytes: 4096},
+			},
+		}
+		// Without a fault the limits have no effect, and the buffer limit of the route is kept.
+		routes := buildRoutesWithExtensions(t, in, ext)
+		g.Expect(routes[0].GetTypedPerFilterConfig()).To(gomega.BeEmpty())
+		g.Expect(routes[0].GetPerRequestBufferLimitBytes().GetValue()).To(gomega.Equal(uint32(4096)))
+	})
+}
+
+func TestHeaderControlledFaults(t *testing.T) {
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+		Fault: &networking.HTTPFaultInjection{
+			Abort: &networking.HTTPFaultInjection_Abort{
+				ErrorType:  &networking.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 503},
+				Percentage: &networking.Percent{Value: 50},
+			},
+		},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{in: {HeaderControlledFaults: true}},
+	}
+	routeFault := func(g *gomega.WithT, r *envoyroute.Route) *xdshttpfault.HTTPFault {
+		fault := &xdshttpfault.HTTPFault{}
+		g.Expect(r.GetTypedPerFilterConfig()[wellknown.Fault].UnmarshalTo(fault)).To(gomega.Succeed())
+		return fault
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		test.SetForTest(t, &features.EnableHeaderControlledFaults, true)
+		g := gomega.NewWithT(t)
+		fault := routeFault(g, buildRoutesWithExtensions(t, in, ext)[0])
+		g.Expect(fault.GetDelay().GetHeaderDelay()).NotTo(gomega.BeNil())
+		g.Expect(fault.GetDelay().GetPercentage().GetNumerator()).To(gomega.Equal(uint32(100)))
+		g.Expect(fault.GetDelay().GetPercentage().GetDenominator()).To(gomega.Equal(xdstype.FractionalPercent_HUNDRED))
+		g.Expect(fault.GetAbort().GetHeaderAbort()).NotTo(gomega.BeNil())
+		g.Expect(fault.GetAbort().GetPercentage().GetNumerator()).To(gomega.Equal(uint32(50 * 10000)))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		test.SetForTest(t, &features.EnableHeaderControlledFaults, false)
+		g := gomega.NewWithT(t)
+		fault := routeFault(g, buildRoutesWithExtensions(t, in, ext)[0])
+		g.Expect(fault.GetDelay()).To(gomega.BeNil())
+		g.Expect(fault.GetAbort().GetHttpStatus()).To(gomega.Equal(uint32(503)))
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		test.SetForTest(t, &features.EnableHeaderControlledFaults, true)
+		g := gomega.NewWithT(t)
+		fault := routeFault(g, buildRoutesWithExtensions(t, in, nil)[0])
+		g.Expect(fault.GetAbort().GetHeaderAbort()).To(gomega.BeNil())
+		g.Expect(fault.GetAbort().GetHttpStatus()).To(gomega.Equal(uint32(503)))
+	})
+}
+
+func TestTimeoutHeaderOverride(t *testing.T) {
+	test.SetForTest(t, &features.ClampPerTryTimeout, true)
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		Timeout: durationpb.New(10 * time.Second),
+		Retries: &networking.HTTPRetry{Attempts: 1, PerTryTimeout: durationpb.New(time.Minute)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {TimeoutHeaderOverride: true},
+		},
+	}
+	// The route timeout is still set, clients extend it with the x-envoy-upstream-rq-timeout-ms header.
+	routes := buildRoutesWithExtensions(t, in, ext)
+	g.Expect(routes[0].GetRoute().GetTimeout().AsDuration()).To(gomega.Equal(10 * time.Second))
+	g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout().AsDuration()).To(gomega.Equal(time.Minute))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetTimeout().AsDuration()).To(gomega.Equal(10 * time.Second))
+	g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout().AsDuration()).To(gomega.Equal(5 * time.Second))
+}
+
+func TestRelativeTimeout(t *testing.T) {
+	test.SetForTest(t, &features.DefaultRequestTimeout, durationpb.New(10*time.Second))
+	cases := []struct {
+		name     string
+		timeout  *durationpb.Duration
+		relative *route.RelativeTimeout
+		want     time.Duration
+	}{
+		{
+			name:     "half of the default",
+			relative: &route.RelativeTimeout{Percent: 50},
+			want:     5 * time.Second,
+		},
+		{
+			name:     "more than the default",
+			relative: &route.RelativeTimeout{Percent: 150},
+			want:     15 * time.Second,
+		},
+		{
+			name:     "service base",
+			relative: &route.RelativeTimeout{Percent: 150, Base: 2 * time.Second},
+			want:     3 * time.Second,
+		},
+		{
+			name:     "zero percent",
+			relative: &route.RelativeTimeout{Percent: 0},
+			want:     10 * time.Second,
+		},
+		{
+			name:     "negative percent",
+			relative: &route.RelativeTimeout{Percent: -50},
+			want:     10 * time.Second,
+		},
+		{
+			name:     "percent over the maximum",
+			relative: &route.RelativeTimeout{Percent: route.MaxRelativeTimeoutPercent + 1},
+			want:     10 * time.Second,
+		},
+		{
+			name:     "virtual service timeout",
+			timeout:  durationpb.New(time.Second),
+			relative: &route.RelativeTimeout{Percent: 50},
+			want:     time.Second,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+				Timeout: tt.timeout,
+			}
+			ext := &route.Extensions{
+				Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+					in: {RelativeTimeout: tt.relative},
+				},
+			}
+			routes := buildRoutesWithExtensions(t, in, ext)
+			g.Expect(routes[0].GetRoute().GetTimeout().AsDuration()).To(gomega.Equal(tt.want))
+		})
+	}
+}
+
+func TestGrpcTimeout(t *testing.T) {
+	cases := []struct {
+		name          string
+		timeout       *durationpb.Duration
+		grpcTimeout   *route.GrpcTimeout
+		wantHeaderMax time.Duration
+	}{
+		{
+			name:          "header max",
+			timeout:       durationpb.New(10 * time.Second),
+			grpcTimeout:   &route.GrpcTimeout{HeaderMax: 5 * time.Second, HeaderOffset: 100 * time.Millisecond},
+			wantHeaderMax: 5 * time.Second,
+		},
+		{
+			name:          "bounded by the route timeout",
+			timeout:       durationpb.New(10 * time.Second),
+			grpcTimeout:   &route.GrpcTimeout{HeaderMax: time.Minute},
+			wantHeaderMax: 10 * time.Second,
+		},
+		{
+			name:          "defaults to the route timeout",
+			timeout:       durationpb.New(10 * time.Second),
+			grpcTimeout:   &route.GrpcTimeout{},
+			wantHeaderMax: 10 * time.Second,
+		},
+		{
+			name:          "no route timeout",
+			timeout:       durationpb.New(0),
+			grpcTimeout:   &route.GrpcTimeout{HeaderMax: time.Minute},
+			wantHeaderMax: time.Minute,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Timeout: tt.timeout,
+				Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			ext := &route.Extensions{
+				Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+					in: {GrpcTimeout: tt.grpcTimeout},
+				},
+			}
+			action := buildRoutesWithExtensions(t, in, ext)[0].GetRoute()
+			g.Expect(action.GetMaxStreamDuration().GetGrpcTimeoutHeaderMax().AsDuration()).To(gomega.Equal(tt.wantHeaderMax))
+			g.Expect(action.GetMaxStreamDuration().GetGrpcTimeoutHeaderOffset().AsDuration()).To(gomega.Equal(tt.grpcTimeout.HeaderOffset))
+			g.Expect(action.GetMaxGrpcTimeout()).To(gomega.BeNil()) // nolint: staticcheck
+		})
+	}
+
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Timeout: durationpb.New(10 * time.Second),
+		Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	action := buildRoutesWithExtensions(t, in, nil)[0].GetRoute()
+	g.Expect(action.GetMaxStreamDuration()).To(gomega.BeNil())
+	g.Expect(action.GetMaxGrpcTimeout().AsDuration()).To(gomega.Equal(10 * time.Second)) // nolint: staticcheck
+}
+
+func TestDynamicMetadataMatch(t *testing.T) {
+	g := gomega.NewWithT(t)
+	match := &networking.HTTPMatchRequest{Name: "premium"}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{match},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Matches: map[*networking.HTTPMatchRequest]*route.MatchExtension{
+			match: {DynamicMetadata: []*route.MetadataMatch{
+				{
+					Filter: "envoy.filters.http.ext_authz",
+					Path:   []string{"auth", "tier"},
+					Value:  &networking.StringMatch{MatchType: &networking.StringMatch_Exact{Exact: "premium"}},
+				},
+				{Filter: "envoy.filters.http.ext_authz", Path: []string{"user"}},
+			}},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	metadata := routes[0].GetMatch().GetDynamicMetadata()
+	g.Expect(metadata).To(gomega.HaveLen(2))
+	g.Expect(metadata[0].GetFilter()).To(gomega.Equal("envoy.filters.http.ext_authz"))
+	g.Expect(metadata[0].GetPath()).To(gomega.HaveLen(2))
+	g.Expect(metadata[0].GetPath()[0].GetKey()).To(gomega.Equal("auth"))
+	g.Expect(metadata[0].GetPath()[1].GetKey()).To(gomega.Equal("tier"))
+	g.Expect(metadata[0].GetValue().GetStringMatch().GetExact()).To(gomega.Equal("premium"))
+	g.Expect(metadata[1].GetPath()[0].GetKey()).To(gomega.Equal("user"))
+	g.Expect(metadata[1].GetValue().GetPresentMatch()).To(gomega.BeTrue())
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetMatch().GetDynamicMetadata()).To(gomega.BeEmpty())
+}
+
+func TestHashOnRequestID(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	ext := &route.Extensions{
+		Routes: map[*networking.HTTPRoute]*route.RouteExtension{
+			in: {HashOnRequestID: true},
+		},
+	}
+	routes := buildRoutesWithExtensions(t, in, ext)
+	policies := routes[0].GetRoute().GetHashPolicy()
+	g.Expect(policies).To(gomega.HaveLen(1))
+	g.Expect(policies[0].GetHeader().GetHeaderName()).To(gomega.Equal("x-request-id"))
+
+	routes = buildRoutesWithExtensions(t, in, nil)
+	g.Expect(routes[0].GetRoute().GetHashPolicy()).To(gomega.BeEmpty())
+}
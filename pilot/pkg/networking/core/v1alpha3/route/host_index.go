@@ -0,0 +1,164 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// hostIndex finds the services of a registry matching a wildcard host without looping through the
+// whole registry. Hostnames are stored in a trie keyed by their labels in reverse order, so that
+// the services under a wildcard suffix are found in a single subtree. The trie is built on first use,
+// and may be shared by concurrent callers.
+type hostIndex struct {
+	serviceRegistry map[host.Name]*model.Service
+	once            sync.Once
+	root            *hostIndexNode
+	// unindexed holds the services whose hostname could not be indexed.
+	unindexed []*model.Service
+}
+
+type hostIndexNode struct {
+	children map[string]*hostIndexNode
+	// service is the service whose hostname ends at this node, e.g. foo.global.
+	service *model.Service
+	// wildcard is the service whose wildcard hostname ends at this node, e.g. *.foo.global.
+	wildcard *model.Service
+}
+
+func newHostIndex(serviceRegistry map[host.Name]*model.Service) *hostIndex {
+	return &hostIndex{serviceRegistry: serviceRegistry}
+}
+
+// build indexes the registry. Services with hostnames that are not indexable are kept aside and
+// matched one by one instead.
+func (h *hostIndex) build() {
+	h.root = &hostIndexNode{}
+	for hostname, svc := range h.serviceRegistry {
+		labels, wildcard, ok := splitHost(hostname)
+		if !ok {
+			h.unindexed = append(h.unindexed, svc)
+			continue
+		}
+		n := h.root
+		for i := len(labels) - 1; i >= 0; i-- {
+			n = n.child(labels[i])
+		}
+		if wildcard {
+			n.wildcard = svc
+		} else {
+			n.service = svc
+		}
+	}
+}
+
+func (n *hostIndexNode) child(label string) *hostIndexNode {
+	if n.children == nil {
+		n.children = map[string]*hostIndexNode{}
+	}
+	c, f := n.children[label]
+	if !f {
+		c = &hostIndexNode{}
+		n.children[label] = c
+	}
+	return c
+}
+
+// splitHost returns the labels of a hostname, without the leading "*" of a wildcard hostname.
+// It returns false for wildcard hostnames other than "*" and "*.suffix".
+func splitHost(hostname host.Name) ([]string, bool, bool) {
+	name := string(hostname)
+	if !hostname.IsWildCarded() {
+		return strings.Split(name, "."), false, true
+	}
+	if name == "*" {
+		return nil, true, true
+	}
+	if !strings.HasPrefix(name, "*.") {
+		return nil, true, false
+	}
+	return strings.Split(name[2:], "."), true, true
+}
+
+// matches returns the services of the registry matching the wildcard hostname, as host.Name.Matches
+// would, sorted by hostname.
+func (h *hostIndex) matches(wildcard host.Name) []*model.Service {
+	labels, _, ok := splitHost(wildcard)
+	if !ok {
+		return h.slowMatches(wildcard)
+	}
+	h.once.Do(h.build)
+	var out []*model.Service
+	n := h.root
+	// Wildcard services along the path are broader than the wildcard host, e.g. *.global for *.foo.global.
+	for i := len(labels) - 1; i >= 0 && n != nil; i-- {
+		if n.wildcard != nil {
+			out = append(out, n.wildcard)
+		}
+		n = n.children[labels[i]]
+	}
+	if n != nil {
+		// The wildcard service at the suffix itself matches, but the plain hostname does not,
+		// e.g. for *.global, *.global matches while global does not.
+		if n.wildcard != nil {
+			out = append(out, n.wildcard)
+		}
+		for _, c := range n.children {
+			out = c.appendAll(out)
+		}
+	}
+	for _, svc := range h.unindexed {
+		if svc.Hostname.Matches(wildcard) {
+			out = append(out, svc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
+
+// appendAll appends all the services in the subtree of the node.
+func (n *hostIndexNode) appendAll(out []*model.Service) []*model.Service {
+	if n.service != nil {
+		out = append(out, n.service)
+	}
+	if n.wildcard != nil {
+		out = append(out, n.wildcard)
+	}
+	for _, c := range n.children {
+		out = c.appendAll(out)
+	}
+	return out
+}
+
+// slowMatches loops through all services in the registry.
+func (h *hostIndex) slowMatches(wildcard host.Name) []*model.Service {
+	var out []*model.Service
+	for svcHost, svc := range h.serviceRegistry {
+		if svcHost.Matches(wildcard) {
+			out = append(out, svc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out
+}
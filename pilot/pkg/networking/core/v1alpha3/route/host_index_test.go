@@ -0,0 +1,120 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+func registryOf(hostnames ...string) map[host.Name]*model.Service {
+	out := make(map[host.Name]*model.Service, len(hostnames))
+	for _, h := range hostnames {
+		out[host.Name(h)] = &model.Service{Hostname: host.Name(h)}
+	}
+	return out
+}
+
+func hostnamesOf(services []*model.Service) []string {
+	out := make([]string, 0, len(services))
+	for _, svc := range services {
+		out = append(out, string(svc.Hostname))
+	}
+	return out
+}
+
+func TestHostIndexMatches(t *testing.T) {
+	registry := registryOf(
+		"*",
+		"global",
+		"a.global",
+		"b.foo.global",
+		"*.global",
+		"*.foo.global",
+		"*.bar.global",
+		"a.xglobal",
+		"foo.com",
+		"*foo.com",
+	)
+	wildcards := []host.Name{"*", "*.global", "*.foo.global", "*.a.global", "*.com", "*.org", "*oo.com"}
+	index := newHostIndex(registry)
+	for _, wildcard := range wildcards {
+		t.Run(string(wildcard), func(t *testing.T) {
+			got := hostnamesOf(index.matches(wildcard))
+			// The index must find exactly the services the slow path loops through.
+			want := hostnamesOf(index.slowMatches(wildcard))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("matches(%s): got %v, want %v", wildcard, got, want)
+			}
+		})
+	}
+}
+
+func TestSeparateVSHostsAndServicesOrder(t *testing.T) {
+	registry := registryOf("a.global", "b.global", "exact.com")
+	vs := config.Config{
+		Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme"},
+		Spec: &networking.VirtualService{
+			Hosts: []string{"*.global", "exact.com", "*.org", "plain.com"},
+		},
+	}
+	hosts, services := separateVSHostsAndServices(vs, registry, newHostIndex(registry))
+	// Non wildcard hosts come first, followed by the matches of each wildcard host in turn.
+	if want := []string{"plain.com", "*.org"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got hosts %v, want %v", hosts, want)
+	}
+	if want := []string{"exact.com", "a.global", "b.global"}; !reflect.DeepEqual(hostnamesOf(services), want) {
+		t.Errorf("got services %v, want %v", hostnamesOf(services), want)
+	}
+}
+
+func BenchmarkSeparateVSHostsAndServices(b *testing.B) {
+	hostnames := make([]string, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		hostnames = append(hostnames, fmt.Sprintf("svc-%d.ns-%d.svc.cluster.local", i, i%100))
+	}
+	registry := registryOf(hostnames...)
+	vsHosts := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		vsHosts = append(vsHosts, fmt.Sprintf("*.ns-%d.svc.cluster.local", i))
+	}
+	vs := config.Config{
+		Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme"},
+		Spec: &networking.VirtualService{Hosts: vsHosts},
+	}
+
+	b.Run("index", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			separateVSHostsAndServices(vs, registry, newHostIndex(registry))
+		}
+	})
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		index := newHostIndex(registry)
+		for n := 0; n < b.N; n++ {
+			for _, h := range vsHosts {
+				index.slowMatches(host.Name(h))
+			}
+		}
+	})
+}
@@ -26,10 +26,18 @@ import (
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/util/protoconv"
 	xdsfilters "istio.io/istio/pilot/pkg/xds/filters"
+	"istio.io/istio/pkg/util/sets"
 )
 
 var defaultRetryPriorityTypedConfig = protoconv.MessageToAny(buildPreviousPrioritiesConfig())
 
+// ResetBeforeRequest is the retry condition of a request whose stream was reset before any of its headers
+// were sent upstream.
+const ResetBeforeRequest = "reset-before-request"
+
+// safeRetryOn lists the retry conditions under which the request did not reach the upstream service.
+var safeRetryOn = sets.New("connect-failure", "refused-stream", ResetBeforeRequest)
+
 // DefaultPolicy gets a copy of the default retry policy.
 func DefaultPolicy() *route.RetryPolicy {
 	policy := route.RetryPolicy{
@@ -102,6 +110,24 @@ func ConvertPolicy(in *networking.HTTPRetry) *route.RetryPolicy {
 	return out
 }
 
+// ResetBeforeRequestOnly restricts the policy to retrying the requests that did not reach the upstream service,
+// so that non-idempotent requests, e.g. POST, are never processed twice. The other retry conditions, including
+// the retriable status codes, are dropped and reset-before-request is added.
+func ResetBeforeRequestOnly(policy *route.RetryPolicy) {
+	if policy == nil {
+		return
+	}
+	retryOn := make([]string, 0, safeRetryOn.Len())
+	for _, part := range strings.Split(policy.RetryOn, ",") {
+		part = strings.TrimSpace(part)
+		if safeRetryOn.Contains(part) && part != ResetBeforeRequest {
+			retryOn = append(retryOn, part)
+		}
+	}
+	policy.RetryOn = strings.Join(append(retryOn, ResetBeforeRequest), ",")
+	policy.RetriableStatusCodes = nil
+}
+
 func parseRetryOn(retryOn string) (string, []uint32) {
 	codes := make([]uint32, 0)
 	tojoin := make([]string, 0)
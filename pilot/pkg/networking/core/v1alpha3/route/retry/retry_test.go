@@ -225,3 +225,45 @@ func TestRetry(t *testing.T) {
 		})
 	}
 }
+
+func TestResetBeforeRequestOnly(t *testing.T) {
+	testCases := []struct {
+		name    string
+		retries *networking.HTTPRetry
+		retryOn string
+	}{
+		{
+			name:    "TestDefaultPolicy",
+			retryOn: "connect-failure,refused-stream,reset-before-request",
+		},
+		{
+			name: "TestUnsafeConditionsAreDropped",
+			retries: &networking.HTTPRetry{
+				Attempts: 2,
+				RetryOn:  "5xx,reset,gateway-error,connect-failure,503",
+			},
+			retryOn: "connect-failure,reset-before-request",
+		},
+		{
+			name: "TestResetBeforeRequestIsNotDuplicated",
+			retries: &networking.HTTPRetry{
+				Attempts: 2,
+				RetryOn:  "reset-before-request, refused-stream",
+			},
+			retryOn: "refused-stream,reset-before-request",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			policy := retry.ConvertPolicy(tc.retries)
+			retry.ResetBeforeRequestOnly(policy)
+			g.Expect(policy.RetryOn).To(Equal(tc.retryOn))
+			g.Expect(policy.RetriableStatusCodes).To(BeEmpty())
+			g.Expect(policy.NumRetries).To(Equal(retry.ConvertPolicy(tc.retries).NumRetries))
+		})
+	}
+
+	// A route that does not retry is left as is.
+	retry.ResetBeforeRequestOnly(nil)
+}
@@ -15,22 +15,31 @@
 package route
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	xdsfault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/common/fault/v3"
 	xdshttpfault "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	uritemplate "github.com/envoyproxy/go-control-plane/envoy/extensions/path/match/uri_template/v3"
+	uritemplaterewrite "github.com/envoyproxy/go-control-plane/envoy/extensions/path/rewrite/uri_template/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	tracing "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v3"
 	xdstype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"github.com/golang/protobuf/ptypes/duration"
 	anypb "google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	wrappers "google.golang.org/protobuf/types/known/wrapperspb"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
@@ -47,6 +56,7 @@ import (
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/xds"
 	"istio.io/istio/pkg/proto"
 	"istio.io/istio/pkg/util/grpc"
 	"istio.io/pkg/log"
@@ -57,15 +67,62 @@ const (
 	HeaderMethod    = ":method"
 	HeaderAuthority = ":authority"
 	HeaderScheme    = ":scheme"
+	HeaderPath      = ":path"
 )
 
 // DefaultRouteName is the name assigned to a route generated by default in absence of a virtual service.
 const DefaultRouteName = "default"
 
+// MaintenanceRouteName is the name assigned to the route serving the maintenance response of a virtual service.
+const MaintenanceRouteName = "maintenance"
+
+// HeaderRetryAfter is the header advertising when a client may retry a request rejected for maintenance.
+const HeaderRetryAfter = "Retry-After"
+
+// HeaderRequestID is the header carrying the ID Envoy generates for each request, and propagates along
+// the chain of requests it triggers.
+const HeaderRequestID = "x-request-id"
+
+// HeaderForwardedClientCert is the header carrying the details of the client certificate of mTLS connections.
+const HeaderForwardedClientCert = "x-forwarded-client-cert"
+
 // prefixMatchRegex optionally matches "/..." at the end of a path.
 // regex taken from https://github.com/projectcontour/contour/blob/2b3376449bedfea7b8cea5fbade99fb64009c0f6/internal/envoy/v3/route.go#L59
 const prefixMatchRegex = `((\/).*)?`
 
+// uriTemplateMatcher is the name of the Envoy extension matching paths against URI templates.
+const uriTemplateMatcher = "envoy.path.match.uri_template.uri_template_matcher"
+
+// uriTemplateRewriter is the name of the Envoy extension rewriting paths matched by URI templates.
+const uriTemplateRewriter = "envoy.path.rewrite.uri_template.uri_template_rewriter"
+
+// localRateLimitFilter is the name of the Envoy HTTP filter limiting requests with a local token bucket.
+const localRateLimitFilter = "envoy.filters.http.local_ratelimit"
+
+// caseInsensitiveRegexFlag makes an RE2 regex case insensitive.
+const caseInsensitiveRegexFlag = "(?i)"
+
+var (
+	// ErrNotVirtualService is returned when routes are built for a config that is not a virtual service.
+	ErrNotVirtualService = errors.New("in not a virtual service")
+	// ErrNoRoutesMatched is returned when none of the routes of a virtual service apply to the proxy.
+	ErrNoRoutesMatched = errors.New("no routes matched")
+	// ErrDelegateCycle is returned when a virtual service delegates, directly or not, to itself.
+	ErrDelegateCycle = errors.New("delegate cycle")
+	// ErrDelegateTooDeep is returned when delegates are nested deeper than maxDelegateDepth.
+	ErrDelegateTooDeep = errors.New("delegates nested too deep")
+	// ErrUnknownDestinationHost is reported for destinations whose host is not in the service registry.
+	ErrUnknownDestinationHost = errors.New("destination host not found in the service registry")
+	// ErrUnknownDestinationPort is reported for destinations selecting a port their service does not expose.
+	ErrUnknownDestinationPort = errors.New("destination port not exposed by the service")
+	// ErrAmbiguousDestinationPort is reported for destinations without a port, whose service exposes
+	// several ports but not the listener port.
+	ErrAmbiguousDestinationPort = errors.New("destination port is required as the service exposes several ports")
+)
+
+// maxDelegateDepth is the maximum nesting of delegate virtual services expanded by BuildHTTPRoutes.
+const maxDelegateDepth = 8
+
 var notimeout = durationpb.New(0)
 
 type DestinationHashMap map[*networking.HTTPRouteDestination]*networking.LoadBalancerSettings_ConsistentHashLB
@@ -73,14 +130,15 @@ type DestinationHashMap map[*networking.HTTPRouteDestination]*networking.LoadBal
 // VirtualHostWrapper is a context-dependent virtual host entry with guarded routes.
 // Note: Currently we are not fully utilizing this structure. We could invoke this logic
 // once for all sidecars in the cluster to compute all RDS for inside the mesh and arrange
-// it by listener port. However to properly use such an optimization, we need to have an
-// eventing subsystem to invalidate the computed routes if any service changes/virtual Services change.
+// it by listener port. When features.EnableSidecarVirtualHostCache is set, the wrappers built
+// for a virtual service are reused across sidecars with the same routing inputs within a push.
 type VirtualHostWrapper struct {
 	// Port is the listener port for outbound sidecar (e.g. service port)
 	Port int
 
 	// Services are the Services from the registry. Each service
-	// in this list should have a virtual host entry
+	// in this list should have a virtual host entry, whose domains are
+	// computed by v1alpha3.VirtualHostDomains.
 	Services []*model.Service
 
 	// VirtualServiceHosts is a list of hosts defined in the virtual service
@@ -105,12 +163,45 @@ func BuildSidecarVirtualHostWrapper(routeCache *Cache, node *model.Proxy, push *
 	// the virtualservices, which have consistent hash policy.
 	dependentDestinationRules := []*model.ConsolidatedDestRule{}
 
+	// The index is shared by all virtual services, to resolve their wildcard hosts.
+	index := newHostIndex(serviceRegistry)
+	drs := newDestinationRuleCache()
+	var registry uint64
+	if features.EnableSidecarVirtualHostCache {
+		registry = registryDigest(serviceRegistry)
+	}
+
 	// First build virtual host wrappers for services that have virtual services.
-	for _, virtualService := range virtualServices {
-		hashByDestination, destinationRules := hashForVirtualService(push, node, virtualService)
-		dependentDestinationRules = append(dependentDestinationRules, destinationRules...)
-		wrappers := buildSidecarVirtualHostsForVirtualService(node, virtualService, serviceRegistry, hashByDestination, listenPort, push.Mesh)
-		out = append(out, wrappers...)
+	// The results are merged in the order of the virtual services, whether they are built serially or not.
+	wrappers := make([][]VirtualHostWrapper, len(virtualServices))
+	destinationRules := make([][]*model.ConsolidatedDestRule, len(virtualServices))
+	build := func(i int) {
+		wrappers[i], destinationRules[i] = buildVirtualServiceWrappers(node, push, virtualServices[i], serviceRegistry,
+			index, drs, registry, listenPort)
+	}
+	if workers := features.SidecarVirtualHostConcurrency; workers > 1 && len(virtualServices) > 1 {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, workers)
+		for i := range virtualServices {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				build(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range virtualServices {
+			build(i)
+		}
+	}
+	for i := range virtualServices {
+		dependentDestinationRules = append(dependentDestinationRules, destinationRules[i]...)
+		out = append(out, wrappers[i]...)
 	}
 
 	// Now exclude the services that have virtual services.
@@ -120,10 +211,20 @@ func BuildSidecarVirtualHostWrapper(routeCache *Cache, node *model.Proxy, push *
 		}
 	}
 
-	for _, svc := range serviceRegistry {
+	// The services left are iterated by hostname, so that the default virtual hosts come in a stable order.
+	// The ports of each service are kept in their declared order.
+	missing := make([]host.Name, 0, len(serviceRegistry))
+	for hostname := range serviceRegistry {
+		missing = append(missing, hostname)
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i] < missing[j]
+	})
+	for _, hostname := range missing {
+		svc := serviceRegistry[hostname]
 		for _, port := range svc.Ports {
 			if port.Protocol.IsHTTP() || util.IsProtocolSniffingEnabledForPort(port) {
-				hash, destinationRule := hashForService(push, node, svc, port)
+				hash, destinationRule := hashForService(push, node, svc, port, drs)
 				if hash != nil {
 					dependentDestinationRules = append(dependentDestinationRules, destinationRule)
 				}
@@ -140,10 +241,35 @@ func BuildSidecarVirtualHostWrapper(routeCache *Cache, node *model.Proxy, push *
 	return out
 }
 
+// buildVirtualServiceWrappers creates the virtual hosts of a single virtual service, and returns them along with
+// the destination rules they depend on. It is safe to call concurrently for different virtual services.
+func buildVirtualServiceWrappers(node *model.Proxy, push *model.PushContext, virtualService config.Config,
+	serviceRegistry map[host.Name]*model.Service, index *hostIndex, drs *destinationRuleCache, registry uint64, listenPort int,
+) ([]VirtualHostWrapper, []*model.ConsolidatedDestRule) {
+	if !features.EnableSidecarVirtualHostCache {
+		hashByDestination, destinationRules := hashForVirtualService(push, node, virtualService, drs)
+		return buildSidecarVirtualHostsForVirtualService(node, virtualService, serviceRegistry, index,
+			hashByDestination, listenPort, push.Mesh), destinationRules
+	}
+	key := newVirtualHostCacheKey(node, virtualService, listenPort, registry)
+	entry, f := sidecarVirtualHostCache.get(push, key)
+	if !f {
+		hashByDestination, destinationRules := hashForVirtualService(push, node, virtualService, drs)
+		entry = &virtualHostCacheEntry{
+			wrappers: buildSidecarVirtualHostsForVirtualService(node, virtualService, serviceRegistry, index,
+				hashByDestination, listenPort, push.Mesh),
+			destinationRules: destinationRules,
+		}
+		sidecarVirtualHostCache.add(push, key, entry)
+	}
+	return resolveServices(entry.wrappers, serviceRegistry), entry.destinationRules
+}
+
 // separateVSHostsAndServices splits the virtual service hosts into Services (if they are found in the registry) and
-// plain non-registry hostnames
+// plain non-registry hostnames. Wildcard hosts are resolved through the index of the registry.
 func separateVSHostsAndServices(virtualService config.Config,
 	serviceRegistry map[host.Name]*model.Service,
+	index *hostIndex,
 ) ([]string, []*model.Service) {
 	rule := virtualService.Spec.(*networking.VirtualService)
 	hosts := make([]string, 0)
@@ -166,25 +292,20 @@ func separateVSHostsAndServices(virtualService config.Config,
 		}
 	}
 
-	// Now process wild card hosts as they need to follow the slow path of looping through all Services in the registry.
+	// Now process wild card hosts as they need to be matched against the Services in the registry.
 	for _, hostname := range wchosts {
 		if model.UseGatewaySemantics(virtualService) {
 			hosts = append(hosts, string(hostname))
 			continue
 		}
-		// Say host is *.global
-		foundSvcMatch := false
-		// Say we have Services *.foo.global, *.bar.global
-		for svcHost, svc := range serviceRegistry {
-			// *.foo.global matches *.global
-			if svcHost.Matches(hostname) {
-				servicesInVirtualService = append(servicesInVirtualService, svc)
-				foundSvcMatch = true
-			}
-		}
-		if !foundSvcMatch {
+		// Say host is *.global, and we have Services *.foo.global, *.bar.global;
+		// *.foo.global matches *.global
+		matches := index.matches(hostname)
+		if len(matches) == 0 {
 			hosts = append(hosts, string(hostname))
+			continue
 		}
+		servicesInVirtualService = append(servicesInVirtualService, matches...)
 	}
 
 	return hosts, servicesInVirtualService
@@ -197,18 +318,25 @@ func buildSidecarVirtualHostsForVirtualService(
 	node *model.Proxy,
 	virtualService config.Config,
 	serviceRegistry map[host.Name]*model.Service,
+	index *hostIndex,
 	hashByDestination DestinationHashMap,
 	listenPort int,
 	mesh *meshconfig.MeshConfig,
 ) []VirtualHostWrapper {
 	meshGateway := map[string]bool{constants.IstioMeshGateway: true}
-	routes, err := BuildHTTPRoutesForVirtualService(node, virtualService, serviceRegistry, hashByDestination,
-		listenPort, meshGateway, false /* isH3DiscoveryNeeded */, mesh)
+	routes, err := BuildHTTPRoutes(virtualService, RouteOptions{
+		Node:              node,
+		ServiceRegistry:   serviceRegistry,
+		HashByDestination: hashByDestination,
+		ListenPort:        listenPort,
+		GatewayNames:      meshGateway,
+		Mesh:              mesh,
+	})
 	if err != nil || len(routes) == 0 {
 		return nil
 	}
 
-	hosts, servicesInVirtualService := separateVSHostsAndServices(virtualService, serviceRegistry)
+	hosts, servicesInVirtualService := separateVSHostsAndServices(virtualService, serviceRegistry, index)
 
 	// Now group these Services by port so that we can infer the destination.port if the user
 	// doesn't specify any port for a multiport service. We need to know the destination port in
@@ -252,6 +380,13 @@ func buildSidecarVirtualHostForService(svc *model.Service,
 ) VirtualHostWrapper {
 	cluster := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", svc.Hostname, port.Port)
 	traceOperation := telemetry.TraceOperation(string(svc.Hostname), port.Port)
+	if features.DenyServicesWithoutVirtualService {
+		return VirtualHostWrapper{
+			Port:     port.Port,
+			Services: []*model.Service{svc},
+			Routes:   []*route.Route{BuildDefaultDenyRoute(traceOperation)},
+		}
+	}
 	httpRoute := BuildDefaultHTTPOutboundRoute(cluster, traceOperation, mesh)
 
 	// if this host has no virtualservice, the consistentHash on its destinationRule will be useless
@@ -266,6 +401,21 @@ func buildSidecarVirtualHostForService(svc *model.Service,
 	}
 }
 
+// OutboundTrafficPolicyCluster returns the cluster of the traffic to destinations unknown to the proxy, according
+// to its outbound traffic policy: the egress proxy, if set, or PassthroughCluster with ALLOW_ANY, and
+// BlackHoleCluster with REGISTRY_ONLY.
+func OutboundTrafficPolicyCluster(node *model.Proxy) string {
+	if !util.IsAllowAnyOutbound(node) {
+		return util.BlackHoleCluster
+	}
+	if egressProxy := node.SidecarScope.OutboundTrafficPolicy.EgressProxy; egressProxy != nil {
+		// user has provided an explicit destination for all the unknown traffic.
+		// build a cluster out of this destination
+		return GetDestinationCluster(egressProxy, nil, 0)
+	}
+	return util.PassthroughCluster
+}
+
 // GetDestinationCluster generates a cluster name for the route, or error if no cluster
 // can be found. Called by translateRule to determine if
 func GetDestinationCluster(destination *networking.Destination, service *model.Service, listenerPort int) string {
@@ -289,14 +439,119 @@ func GetDestinationCluster(destination *networking.Destination, service *model.S
 	return model.BuildSubsetKey(model.TrafficDirectionOutbound, destination.Subset, host.Name(destination.Host), port)
 }
 
+// DestinationCluster is the cluster a destination of a virtual service resolves to.
+type DestinationCluster struct {
+	// Destination is the destination, as referenced by the virtual service.
+	Destination *networking.Destination
+	// Cluster is the name of the cluster the destination resolves to.
+	Cluster string
+	// Err, if set, explains why the cluster may not receive the traffic of the destination.
+	Err error
+}
+
+// ResolveDestinationClusters returns the clusters of every destination referenced by the HTTP, TLS and TCP routes
+// of a virtual service, including mirrors, in order, without building the routes. Destinations without a port
+// resolve the same way as in the routes served on listenPort. It allows tooling to validate the destinations of
+// a virtual service against a registry.
+func ResolveDestinationClusters(
+	virtualService config.Config,
+	serviceRegistry map[host.Name]*model.Service,
+	listenPort int,
+) ([]DestinationCluster, error) {
+	vs, ok := virtualService.Spec.(*networking.VirtualService)
+	if !ok {
+		return nil, ErrNotVirtualService
+	}
+	var destinations []*networking.Destination
+	for _, http := range vs.Http {
+		for _, dst := range http.Route {
+			destinations = append(destinations, dst.Destination)
+		}
+		if http.Mirror != nil {
+			destinations = append(destinations, http.Mirror)
+		}
+	}
+	for _, tls := range vs.Tls {
+		for _, dst := range tls.Route {
+			destinations = append(destinations, dst.Destination)
+		}
+	}
+	for _, tcp := range vs.Tcp {
+		for _, dst := range tcp.Route {
+			destinations = append(destinations, dst.Destination)
+		}
+	}
+
+	out := make([]DestinationCluster, 0, len(destinations))
+	for _, dst := range destinations {
+		svc := serviceRegistry[host.Name(dst.GetHost())]
+		out = append(out, DestinationCluster{
+			Destination: dst,
+			Cluster:     GetDestinationCluster(dst, svc, listenPort),
+			Err:         destinationClusterError(dst, svc, listenPort),
+		})
+	}
+	return out, nil
+}
+
+// destinationClusterError returns why the cluster of the destination may not receive its traffic, if anything.
+func destinationClusterError(dst *networking.Destination, svc *model.Service, listenPort int) error {
+	if svc == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownDestinationHost, dst.GetHost())
+	}
+	if dst.GetPort() != nil {
+		if _, ok := svc.Ports.GetByPort(int(dst.GetPort().GetNumber())); !ok {
+			return fmt.Errorf("%w: %s:%d", ErrUnknownDestinationPort, dst.GetHost(), dst.GetPort().GetNumber())
+		}
+		return nil
+	}
+	if len(svc.Ports) > 1 {
+		if _, ok := svc.Ports.GetByPort(listenPort); !ok {
+			return fmt.Errorf("%w: %s", ErrAmbiguousDestinationPort, dst.GetHost())
+		}
+	}
+	return nil
+}
+
+// RouteOptions holds the inputs of BuildHTTPRoutes, beyond the virtual service.
+type RouteOptions struct {
+	// Node is the proxy the routes are built for.
+	Node *model.Proxy
+	// Push is the push context the routes are built for. Its mesh config is used when Mesh is unset.
+	Push *model.PushContext
+	// ServiceRegistry holds the services the routes may send traffic to, indexed by hostname.
+	ServiceRegistry map[host.Name]*model.Service
+	// HashByDestination holds the consistent hash policies of the destinations, if any.
+	HashByDestination DestinationHashMap
+	// ListenPort is the port the routes are served on.
+	ListenPort int
+	// GatewayNames holds the gateways the routes are built for, or the mesh gateway for sidecars.
+	GatewayNames map[string]bool
+	// IsHTTP3AltSvcHeaderNeeded adds an alt-svc header advertising HTTP/3 to the responses.
+	IsHTTP3AltSvcHeaderNeeded bool
+	// Mesh is the mesh config.
+	Mesh *meshconfig.MeshConfig
+	// Extensions holds the settings that the VirtualService API cannot express, and may be nil.
+	Extensions *Extensions
+	// ResolveDelegate looks up the delegate virtual services referenced by the routes. When set,
+	// delegating routes are replaced by the routes of their delegate. Virtual services from the push
+	// context have their delegates merged already, so this is only needed for unmerged configs.
+	ResolveDelegate DelegateResolver
+}
+
+// DelegateResolver returns the delegate virtual service with the given name and namespace, if any.
+type DelegateResolver func(name, namespace string) (config.Config, bool)
+
+func (o RouteOptions) mesh() *meshconfig.MeshConfig {
+	if o.Mesh == nil && o.Push != nil {
+		return o.Push.Mesh
+	}
+	return o.Mesh
+}
+
 // BuildHTTPRoutesForVirtualService creates data plane HTTP routes from the virtual service spec.
-// The rule should be adapted to destination names (outbound clusters).
-// Each rule is guarded by source labels.
-//
-// This is called for each port to compute virtual hosts.
-// Each VirtualService is tried, with a list of Services that listen on the port.
-// Error indicates the given virtualService can't be used on the port.
-// This function is used by both the gateway and the sidecar
+// It is kept for compatibility with existing callers and will be removed in a future release;
+// use BuildHTTPRoutes instead.
 func BuildHTTPRoutesForVirtualService(
 	node *model.Proxy,
 	virtualService config.Config,
@@ -307,25 +562,59 @@ func BuildHTTPRoutesForVirtualService(
 	isHTTP3AltSvcHeaderNeeded bool,
 	mesh *meshconfig.MeshConfig,
 ) ([]*route.Route, error) {
+	return BuildHTTPRoutes(virtualService, RouteOptions{
+		Node:                      node,
+		ServiceRegistry:           serviceRegistry,
+		HashByDestination:         hashByDestination,
+		ListenPort:                listenPort,
+		GatewayNames:              gatewayNames,
+		IsHTTP3AltSvcHeaderNeeded: isHTTP3AltSvcHeaderNeeded,
+		Mesh:                      mesh,
+	})
+}
+
+// BuildHTTPRoutes creates data plane HTTP routes from the virtual service spec.
+// The rule should be adapted to destination names (outbound clusters).
+// Each rule is guarded by source labels.
+//
+// This is called for each port to compute virtual hosts.
+// Each VirtualService is tried, with a list of Services that listen on the port.
+// Error indicates the given virtualService can't be used on the port.
+// This function is used by both the gateway and the sidecar
+func BuildHTTPRoutes(virtualService config.Config, opts RouteOptions) ([]*route.Route, error) {
 	vs, ok := virtualService.Spec.(*networking.VirtualService)
 	if !ok { // should never happen
-		return nil, fmt.Errorf("in not a virtual service: %#v", virtualService)
+		return nil, fmt.Errorf("%w: %#v", ErrNotVirtualService, virtualService)
 	}
 
-	out := make([]*route.Route, 0, len(vs.Http))
+	httpRoutes := vs.Http
+	if opts.ResolveDelegate != nil {
+		visited := map[string]bool{virtualService.Namespace + "/" + virtualService.Name: true}
+		var err error
+		if httpRoutes, err = expandDelegates(httpRoutes, virtualService.Namespace, opts.ResolveDelegate, visited); err != nil {
+			return nil, fmt.Errorf("virtual service %s/%s: %w", virtualService.Namespace, virtualService.Name, err)
+		}
+	}
+
+	mesh := opts.mesh()
+	out := make([]*route.Route, 0, len(httpRoutes))
+	if m := opts.Extensions.maintenance(); m != nil {
+		// The maintenance route goes first so that it takes precedence over all other routes.
+		out = append(out, BuildMaintenanceRoute(virtualService, m, opts.ListenPort))
+	}
 
 	catchall := false
-	for _, http := range vs.Http {
+	for _, http := range httpRoutes {
 		if len(http.Match) == 0 {
-			if r := translateRoute(node, http, nil, listenPort, virtualService, serviceRegistry,
-				hashByDestination, gatewayNames, isHTTP3AltSvcHeaderNeeded, mesh); r != nil {
+			if r := translateRoute(opts.Node, http, nil, opts.ListenPort, virtualService, opts.ServiceRegistry,
+				opts.HashByDestination, opts.GatewayNames, opts.IsHTTP3AltSvcHeaderNeeded, mesh, opts.Extensions); r != nil {
 				out = append(out, r)
 			}
 			catchall = true
 		} else {
 			for _, match := range http.Match {
-				if r := translateRoute(node, http, match, listenPort, virtualService, serviceRegistry,
-					hashByDestination, gatewayNames, isHTTP3AltSvcHeaderNeeded, mesh); r != nil {
+				if r := translateRoute(opts.Node, http, match, opts.ListenPort, virtualService, opts.ServiceRegistry,
+					opts.HashByDestination, opts.GatewayNames, opts.IsHTTP3AltSvcHeaderNeeded, mesh, opts.Extensions); r != nil {
 					out = append(out, r)
 					// This is a catch all path. Routes are matched in order, so we will never go beyond this match
 					// As an optimization, we can just top sending any more routes here.
@@ -342,7 +631,54 @@ func BuildHTTPRoutesForVirtualService(
 	}
 
 	if len(out) == 0 {
-		return nil, fmt.Errorf("no routes matched")
+		return nil, ErrNoRoutesMatched
+	}
+	return out, nil
+}
+
+// expandDelegates replaces the delegating routes with the routes of their delegate, merged under the
+// delegating route match. Delegates that cannot be resolved are skipped, as in the push context.
+// visited holds the virtual services being expanded, keyed by namespace/name.
+func expandDelegates(
+	routes []*networking.HTTPRoute,
+	namespace string,
+	resolve DelegateResolver,
+	visited map[string]bool,
+) ([]*networking.HTTPRoute, error) {
+	out := make([]*networking.HTTPRoute, 0, len(routes))
+	for _, http := range routes {
+		if http.Delegate == nil {
+			out = append(out, http)
+			continue
+		}
+		delegateNamespace := http.Delegate.Namespace
+		if delegateNamespace == "" {
+			delegateNamespace = namespace
+		}
+		key := delegateNamespace + "/" + http.Delegate.Name
+		if visited[key] {
+			return nil, fmt.Errorf("%w: %s", ErrDelegateCycle, key)
+		}
+		if len(visited) > maxDelegateDepth {
+			return nil, fmt.Errorf("%w: %s", ErrDelegateTooDeep, key)
+		}
+		delegate, ok := resolve(http.Delegate.Name, delegateNamespace)
+		if !ok {
+			log.Debugf("delegate virtual service %s not found", key)
+			continue
+		}
+		delegateVS, ok := delegate.Spec.(*networking.VirtualService)
+		if !ok {
+			log.Debugf("delegate %s is not a virtual service", key)
+			continue
+		}
+		visited[key] = true
+		delegateRoutes, err := expandDelegates(delegateVS.Http, delegateNamespace, resolve, visited)
+		delete(visited, key)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, model.MergeDelegateHTTPRoutes(http, delegateRoutes)...)
 	}
 	return out, nil
 }
@@ -380,6 +716,7 @@ func translateRoute(
 	gatewayNames map[string]bool,
 	isHTTP3AltSvcHeaderNeeded bool,
 	mesh *meshconfig.MeshConfig,
+	ext *Extensions,
 ) *route.Route {
 	// When building routes, it's okay if the target cluster cannot be
 	// resolved Traffic to such clusters will blackhole.
@@ -398,9 +735,15 @@ func translateRoute(
 		routeName = routeName + "." + match.Name
 	}
 
+	if mx := ext.forMatch(match); mx.Connect && hasPathMatch(match, mx) {
+		log.Warnf("virtual service %s/%s route %q matches CONNECT requests and their path, dropping the match",
+			virtualService.Namespace, virtualService.Name, routeName)
+		return nil
+	}
+
 	out := &route.Route{
 		Name:     routeName,
-		Match:    translateRouteMatch(node, virtualService, match),
+		Match:    translateRouteMatch(node, virtualService, match, ext.forMatch(match)),
 		Metadata: util.BuildConfigInfoMetadata(virtualService.Meta),
 	}
 
@@ -410,7 +753,7 @@ func translateRoute(
 
 	authority := ""
 	if in.Headers != nil {
-		operations := translateHeadersOperations(in.Headers)
+		operations := translateHeadersOperations(in.Headers, ext.forHeaders(in.Headers))
 		out.RequestHeadersToAdd = operations.requestHeadersToAdd
 		out.ResponseHeadersToAdd = operations.responseHeadersToAdd
 		out.RequestHeadersToRemove = operations.requestHeadersToRemove
@@ -418,20 +761,39 @@ func translateRoute(
 		authority = operations.authority
 	}
 
+	// A redirect takes precedence over a direct response, which takes precedence over the route destinations.
+	// Validation rejects routes setting several of them, but configs written before it may still do so.
+	if ignored := ignoredRouteActions(in); len(ignored) > 0 {
+		log.Warnf("virtual service %s/%s route %q sets conflicting actions, ignoring %s",
+			virtualService.Namespace, virtualService.Name, in.Name, strings.Join(ignored, " and "))
+	}
 	if in.Redirect != nil {
 		applyRedirect(out, in.Redirect, listenPort)
 	} else if in.DirectResponse != nil {
 		applyDirectResponse(out, in.DirectResponse)
+		if details := ext.forRoute(in).ResponseCodeDetails; details != "" {
+			addResponseCodeDetails(out, details)
+		}
 	} else {
-		applyHTTPRouteDestination(out, node, virtualService, in, mesh, authority, serviceRegistry, listenPort, hashByDestination)
+		applyHTTPRouteDestination(out, node, virtualService, in, mesh, authority, serviceRegistry, listenPort, hashByDestination, ext)
+		if match.GetUri().GetRegex() != "" {
+			translateRegexMatchRewrite(out)
+		}
+		translatePathTemplateRewrite(out, virtualService)
 	}
 
-	out.Decorator = &route.Decorator{
-		Operation: getRouteOperation(out, virtualService.Name, listenPort),
+	out.Decorator = translateDecorator(ext.forRoute(in).Decorator, getRouteOperation(out, virtualService.Name, listenPort))
+	out.Tracing = translateRouteTracing(ext.forRoute(in).Tracing)
+	perFilterConfig := translatePerFilterConfig(in.Fault, ext.forRoute(in).FaultLimits, ext.forRoute(in).LocalRateLimit)
+	if ext.forRoute(in).HeaderControlledFaults && features.EnableHeaderControlledFaults {
+		perFilterConfig = mergePerFilterConfig(perFilterConfig, map[string]*anypb.Any{
+			wellknown.Fault: protoconv.MessageToAny(translateHeaderFault(in.Fault, ext.forRoute(in).FaultLimits)),
+		})
 	}
-	if in.Fault != nil {
-		out.TypedPerFilterConfig = make(map[string]*anypb.Any)
-		out.TypedPerFilterConfig[wellknown.Fault] = protoconv.MessageToAny(translateFault(in.Fault))
+	out.TypedPerFilterConfig = mergePerFilterConfig(perFilterConfig, out.TypedPerFilterConfig)
+	if limits := ext.forRoute(in).FaultLimits; limits != nil && limits.RequestBufferLimitBytes > 0 &&
+		out.PerRequestBufferLimitBytes == nil && injectsFault(out) {
+		out.PerRequestBufferLimitBytes = &wrappers.UInt32Value{Value: limits.RequestBufferLimitBytes}
 	}
 
 	if isHTTP3AltSvcHeaderNeeded {
@@ -455,7 +817,9 @@ func applyHTTPRouteDestination(
 	serviceRegistry map[host.Name]*model.Service,
 	listenerPort int,
 	hashByDestination DestinationHashMap,
+	ext *Extensions,
 ) {
+	rx := ext.forRoute(in)
 	policy := in.Retries
 	if policy == nil {
 		// No VS policy set, use mesh defaults
@@ -464,17 +828,70 @@ func applyHTTPRouteDestination(
 	action := &route.RouteAction{
 		Cors:        translateCORSPolicy(in.CorsPolicy),
 		RetryPolicy: retry.ConvertPolicy(policy),
+		RateLimits:  translateRateLimits(rx.RateLimits),
+	}
+	if rx.IncludeVirtualHostRateLimits {
+		// nolint: staticcheck
+		action.IncludeVhRateLimits = &wrappers.BoolValue{Value: true}
+	}
+	if rx.RetryResetBeforeRequestOnly {
+		retry.ResetBeforeRequestOnly(action.RetryPolicy)
+	}
+	if action.RetryPolicy != nil && len(rx.RetriableRequestHeaders) > 0 {
+		action.RetryPolicy.RetriableRequestHeaders = translateRetriableRequestHeaders(rx.RetriableRequestHeaders)
+	}
+	if rx.InternalRedirect != nil {
+		action.InternalRedirectPolicy = translateInternalRedirect(rx.InternalRedirect)
+	}
+	if rx.Hedge != nil {
+		action.HedgePolicy = translateHedge(rx.Hedge)
+	}
+	if rx.WebsocketUpgrade != nil {
+		action.UpgradeConfigs = []*route.RouteAction_UpgradeConfig{{
+			UpgradeType: "websocket",
+			Enabled:     &wrappers.BoolValue{Value: *rx.WebsocketUpgrade},
+		}}
+	}
+	if rx.ConnectTunnel != nil {
+		action.UpgradeConfigs = append(action.UpgradeConfigs, translateConnectTunnel(rx.ConnectTunnel))
 	}
 
-	setTimeout(action, in.Timeout, node)
+	timeout := in.Timeout
+	if rx.RelativeTimeout != nil {
+		if timeout != nil {
+			log.Warnf("virtual service %s/%s route %q sets a timeout, ignoring its relative timeout", vs.Namespace, vs.Name, in.Name)
+		} else if relative, err := translateRelativeTimeout(rx.RelativeTimeout); err != nil {
+			log.Warnf("invalid relative timeout in route %q of virtual service %s/%s, ignoring: %v", in.Name, vs.Namespace, vs.Name, err)
+		} else {
+			timeout = relative
+		}
+	}
+	setTimeout(action, timeout, node)
+	if rx.GrpcTimeout != nil {
+		setGrpcTimeout(action, rx.GrpcTimeout)
+	}
+	if features.ClampPerTryTimeout && !rx.TimeoutHeaderOverride {
+		clampPerTryTimeout(action)
+	}
 
 	if model.UseGatewaySemantics(vs) && util.IsIstioVersionGE115(node.IstioVersion) {
 		// return 500 for invalid backends
 		// https://github.com/kubernetes-sigs/gateway-api/blob/cea484e38e078a2c1997d8c7a62f410a1540f519/apis/v1beta1/httproute_types.go#L204
 		action.ClusterNotFoundResponseCode = route.RouteAction_INTERNAL_SERVER_ERROR
 	}
+	if rx.ClusterNotFoundResponseCode != 0 {
+		if code, ok := translateClusterNotFoundResponseCode(rx.ClusterNotFoundResponseCode); ok {
+			action.ClusterNotFoundResponseCode = code
+		} else {
+			log.Warnf("unsupported cluster not found response code %d in route %q of virtual service %s/%s, ignoring",
+				rx.ClusterNotFoundResponseCode, in.Name, vs.Namespace, vs.Name)
+		}
+	}
 
 	out.Action = &route.Route_Route{Route: action}
+	if rx.PerRequestBufferLimitBytes > 0 {
+		out.PerRequestBufferLimitBytes = &wrappers.UInt32Value{Value: rx.PerRequestBufferLimitBytes}
+	}
 
 	if in.Rewrite != nil {
 		action.PrefixRewrite = in.Rewrite.GetUri()
@@ -482,13 +899,37 @@ func applyHTTPRouteDestination(
 			authority = in.Rewrite.GetAuthority()
 		}
 	}
+	if rx.OriginalPathHeader != "" && (action.PrefixRewrite != "" || action.RegexRewrite != nil) {
+		// Route level headers are evaluated before the path is rewritten, so the header captures the original path.
+		out.RequestHeadersToAdd = append(out.RequestHeadersToAdd, &core.HeaderValueOption{
+			Header: &core.HeaderValue{
+				Key:   rx.OriginalPathHeader,
+				Value: "%REQ(:PATH)%",
+			},
+			Append: &wrappers.BoolValue{Value: false},
+		})
+	}
 	if authority != "" {
 		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{
 			HostRewriteLiteral: authority,
 		}
+		if rx.HostRewriteHeader != "" {
+			log.Warnf("virtual service %s/%s route %q rewrites the authority to %q, ignoring host rewrite from header %q",
+				vs.Namespace, vs.Name, in.Name, authority, rx.HostRewriteHeader)
+		}
+	} else if rx.HostRewriteHeader != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteHeader{
+			HostRewriteHeader: rx.HostRewriteHeader,
+		}
 	}
+	action.AppendXForwardedHost = rx.AppendXForwardedHost
 
 	if in.Mirror != nil {
+		// nolint: staticcheck
+		if in.MirrorPercentage != nil && in.MirrorPercent != nil {
+			log.Warnf("virtual service %s/%s route %q sets both mirrorPercent and mirrorPercentage, ignoring mirrorPercent",
+				vs.Namespace, vs.Name, in.Name)
+		}
 		if mp := mirrorPercent(in); mp != nil {
 			action.RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{{
 				Cluster:         GetDestinationCluster(in.Mirror, serviceRegistry[host.Name(in.Mirror.Host)], listenerPort),
@@ -497,30 +938,49 @@ func applyHTTPRouteDestination(
 			}}
 		}
 	}
+	for _, m := range rx.Mirrors {
+		if (m.Destination == nil && m.Cluster == "") || m.Percentage.GetValue() <= 0 {
+			continue
+		}
+		cluster := m.Cluster
+		if cluster == "" {
+			cluster = GetDestinationCluster(m.Destination, serviceRegistry[host.Name(m.Destination.Host)], listenerPort)
+		}
+		action.RequestMirrorPolicies = append(action.RequestMirrorPolicies, &route.RouteAction_RequestMirrorPolicy{
+			Cluster: cluster,
+			RuntimeFraction: &core.RuntimeFractionalPercent{
+				DefaultValue: translatePercentToFractionalPercent(m.Percentage),
+			},
+			TraceSampled: &wrappers.BoolValue{Value: false},
+		})
+	}
 
+	// The total weight is always the sum of the configured weights, so weights are not required to add up to 100.
 	var totalWeight uint32
-	// TODO: eliminate this logic and use the total_weight option in envoy route
 	weighted := make([]*route.WeightedCluster_ClusterWeight, 0)
+	var healthAware []string
 	for _, dst := range in.Route {
-		weight := &wrappers.UInt32Value{Value: uint32(dst.Weight)}
-		if dst.Weight == 0 {
-			// Ignore 0 weighted clusters if there are other clusters in the route.
-			// But if this is the only cluster in the route, then add it as a cluster with weight 100
-			if len(in.Route) == 1 {
-				weight.Value = uint32(100)
-			} else {
-				continue
-			}
+		// Ignore 0 weighted clusters if there are other clusters in the route.
+		// A lone cluster is kept regardless of its weight; it is rewritten to a single cluster below.
+		if dst.Weight == 0 && len(in.Route) > 1 {
+			continue
 		}
+		weight := &wrappers.UInt32Value{Value: uint32(dst.Weight)}
 		hostname := host.Name(dst.GetDestination().GetHost())
-		n := GetDestinationCluster(dst.Destination, serviceRegistry[hostname], listenerPort)
+		svc := serviceRegistry[hostname]
+		if svc == nil {
+			// The route is kept, so that fixing the host, or adding the service, is enough to route the traffic.
+			log.WithLabels("virtualservice", vs.Namespace+"/"+vs.Name, "host", hostname).
+				Warnf("destination host not found in the service registry, its traffic will not be routed")
+		}
+		n := GetDestinationCluster(dst.Destination, svc, listenerPort)
 		clusterWeight := &route.WeightedCluster_ClusterWeight{
 			Name:   n,
 			Weight: weight,
 		}
 		totalWeight += weight.GetValue()
 		if dst.Headers != nil {
-			operations := translateHeadersOperations(dst.Headers)
+			operations := translateHeadersOperations(dst.Headers, ext.forHeaders(dst.Headers))
 			clusterWeight.RequestHeadersToAdd = operations.requestHeadersToAdd
 			clusterWeight.RequestHeadersToRemove = operations.requestHeadersToRemove
 			clusterWeight.ResponseHeadersToAdd = operations.responseHeadersToAdd
@@ -532,7 +992,13 @@ func applyHTTPRouteDestination(
 			}
 		}
 
+		dx := ext.forDestination(dst)
+		clusterWeight.TypedPerFilterConfig = translatePerFilterConfig(dx.Fault, rx.FaultLimits, dx.LocalRateLimit)
+
 		weighted = append(weighted, clusterWeight)
+		if dx.HealthAwareWeight {
+			healthAware = append(healthAware, n)
+		}
 		hash := hashByDestination[dst]
 		hashPolicy := consistentHashToHashPolicy(hash)
 		if hashPolicy != nil {
@@ -540,30 +1006,168 @@ func applyHTTPRouteDestination(
 		}
 	}
 
+	if rx.HashOnRequestID {
+		action.HashPolicy = appendRequestIDHashPolicy(action.HashPolicy)
+	}
+
+	if len(healthAware) > 0 {
+		addHealthAwareClusters(out, healthAware)
+	}
+
 	// rewrite to a single cluster if there is only weighted cluster
 	if len(weighted) == 1 {
 		action.ClusterSpecifier = &route.RouteAction_Cluster{Cluster: weighted[0].Name}
-		out.RequestHeadersToAdd = append(out.RequestHeadersToAdd, weighted[0].RequestHeadersToAdd...)
-		out.RequestHeadersToRemove = append(out.RequestHeadersToRemove, weighted[0].RequestHeadersToRemove...)
-		out.ResponseHeadersToAdd = append(out.ResponseHeadersToAdd, weighted[0].ResponseHeadersToAdd...)
-		out.ResponseHeadersToRemove = append(out.ResponseHeadersToRemove, weighted[0].ResponseHeadersToRemove...)
-		if weighted[0].HostRewriteSpecifier != nil && action.HostRewriteSpecifier == nil {
+		out.RequestHeadersToAdd = mergeHeaderValueOptions(out.RequestHeadersToAdd, weighted[0].RequestHeadersToAdd)
+		out.RequestHeadersToRemove = mergeHeadersToRemove(out.RequestHeadersToRemove, weighted[0].RequestHeadersToRemove)
+		out.ResponseHeadersToAdd = mergeHeaderValueOptions(out.ResponseHeadersToAdd, weighted[0].ResponseHeadersToAdd)
+		out.ResponseHeadersToRemove = mergeHeadersToRemove(out.ResponseHeadersToRemove, weighted[0].ResponseHeadersToRemove)
+		out.TypedPerFilterConfig = mergePerFilterConfig(out.TypedPerFilterConfig, weighted[0].TypedPerFilterConfig)
+		if weighted[0].HostRewriteSpecifier != nil && action.GetHostRewriteLiteral() == "" {
 			// Ideally, if the weighted cluster overwrites authority, it has precedence. This mirrors behavior of headers,
 			// because for headers we append the weighted last which allows it to Set and wipe out previous Adds.
 			// However, Envoy behavior is different when we set at both cluster level and route level, and we want
 			// behavior to be consistent with a single cluster and multiple clusters.
-			// As a result, we only override if the top level rewrite is not set
+			// As a result, we only override if the top level rewrite is not set to a literal; a literal
+			// authority always wins over a rewrite from a header.
 			action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{
 				HostRewriteLiteral: weighted[0].GetHostRewriteLiteral(),
 			}
 		}
 	} else {
-		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
-			WeightedClusters: &route.WeightedCluster{
-				Clusters:    weighted,
-				TotalWeight: wrappers.UInt32(totalWeight),
-			},
+		// Sort the clusters so that destinations listed in a different order produce the same route,
+		// rather than churning the xDS output. A cohort header maps each header value to a position in
+		// the clusters, so they then keep the virtual service order: sorting would move cohorts between
+		// destinations whenever a destination is added or renamed.
+		if rx.CohortHeader == "" {
+			sort.SliceStable(weighted, func(i, j int) bool {
+				return weighted[i].Name < weighted[j].Name
+			})
+		}
+		weightedClusters := &route.WeightedCluster{
+			Clusters:    weighted,
+			TotalWeight: wrappers.UInt32(totalWeight),
 		}
+		if rx.CohortHeader != "" {
+			weightedClusters.RandomValueSpecifier = &route.WeightedCluster_HeaderName{HeaderName: rx.CohortHeader}
+		}
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: weightedClusters}
+	}
+
+	if rx.PreserveHost && clearHostRewrites(action) {
+		log.Warnf("virtual service %s/%s route %q preserves the host, ignoring its host rewrites", vs.Namespace, vs.Name, in.Name)
+	}
+}
+
+// clearHostRewrites removes the host rewrites of the route action and its weighted clusters, so that
+// the Host header is forwarded as is. It returns whether any rewrite was removed.
+func clearHostRewrites(action *route.RouteAction) bool {
+	cleared := action.HostRewriteSpecifier != nil
+	action.HostRewriteSpecifier = nil
+	for _, c := range action.GetWeightedClusters().GetClusters() {
+		cleared = cleared || c.HostRewriteSpecifier != nil
+		c.HostRewriteSpecifier = nil
+	}
+	return cleared
+}
+
+// mergeHeaderValueOptions appends the header operations of a cluster to those of its route. A header set by
+// the cluster replaces the same header from the route, as Envoy would when applying both in turn, while a
+// header value added by both is only added once.
+func mergeHeaderValueOptions(routeOps, clusterOps []*core.HeaderValueOption) []*core.HeaderValueOption {
+	if len(clusterOps) == 0 {
+		return routeOps
+	}
+	out := make([]*core.HeaderValueOption, 0, len(routeOps)+len(clusterOps))
+	out = append(out, routeOps...)
+	for _, c := range clusterOps {
+		key := c.GetHeader().GetKey()
+		if c.GetAppend().GetValue() {
+			duplicate := false
+			for _, o := range out {
+				if o.GetAppend().GetValue() && strings.EqualFold(o.GetHeader().GetKey(), key) &&
+					o.GetHeader().GetValue() == c.GetHeader().GetValue() {
+					duplicate = true
+					break
+				}
+			}
+			if duplicate {
+				continue
+			}
+		} else {
+			kept := out[:0]
+			for _, o := range out {
+				if !strings.EqualFold(o.GetHeader().GetKey(), key) {
+					kept = append(kept, o)
+				}
+			}
+			out = kept
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// mergeHeadersToRemove appends the headers removed by a cluster to those removed by its route, once each.
+func mergeHeadersToRemove(routeHeaders, clusterHeaders []string) []string {
+	out := routeHeaders
+	for _, c := range clusterHeaders {
+		duplicate := false
+		for _, o := range out {
+			if strings.EqualFold(o, c) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// appendRequestIDHashPolicy appends a hash policy on the request ID, unless there is one already.
+func appendRequestIDHashPolicy(policies []*route.RouteAction_HashPolicy) []*route.RouteAction_HashPolicy {
+	for _, p := range policies {
+		if strings.EqualFold(p.GetHeader().GetHeaderName(), HeaderRequestID) {
+			return policies
+		}
+	}
+	return append(policies, &route.RouteAction_HashPolicy{
+		PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+			Header: &route.RouteAction_HashPolicy_Header{
+				HeaderName: HeaderRequestID,
+			},
+		},
+	})
+}
+
+// ignoredRouteActions returns the actions of the route overridden by an action with a higher precedence.
+func ignoredRouteActions(in *networking.HTTPRoute) []string {
+	var set, ignored []string
+	if in.Redirect != nil {
+		set = append(set, "redirect")
+	}
+	if in.DirectResponse != nil {
+		set = append(set, "directResponse")
+	}
+	if len(in.Route) > 0 {
+		set = append(set, "route")
+	}
+	if len(set) > 1 {
+		ignored = set[1:]
+	}
+	return ignored
+}
+
+// defaultPortForScheme returns the default port of the scheme, or 0 if it is not known.
+func defaultPortForScheme(scheme string) uint32 {
+	switch strings.ToLower(scheme) {
+	case "http":
+		return 80
+	case "https":
+		return 443
+	default:
+		return 0
 	}
 }
 
@@ -589,8 +1193,11 @@ func applyRedirect(out *route.Route, redirect *networking.HTTPRedirect, port int
 				// we always generate routes in the context of a specific request port. As a result, we can just
 				// use that port
 				action.Redirect.PortRedirect = uint32(port)
+			} else {
+				// Envoy would otherwise keep the port of the request, e.g. redirect http://foo:8080 to https://foo:8080.
+				// When the scheme is rewritten, redirect to its default port, which Envoy omits from the location.
+				action.Redirect.PortRedirect = defaultPortForScheme(redirect.Scheme)
 			}
-			// Otherwise, no port needed; HTTPRedirect_FROM_PROTOCOL_DEFAULT is Envoy's default behavior
 		case *networking.HTTPRedirect_Port:
 			action.Redirect.PortRedirect = rp.Port
 		}
@@ -642,6 +1249,38 @@ func applyDirectResponse(out *route.Route, directResponse *networking.HTTPDirect
 	out.Action = action
 }
 
+// BuildMaintenanceRoute builds a direct response route answering 503 with the maintenance body of a virtual service.
+func BuildMaintenanceRoute(virtualService config.Config, m *Maintenance, listenPort int) *route.Route {
+	prefix := m.Prefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	out := &route.Route{
+		Name:     MaintenanceRouteName,
+		Match:    &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: prefix}},
+		Metadata: util.BuildConfigInfoMetadata(virtualService.Meta),
+	}
+	addIstioMetadata(out, maintenanceMetadataKey, structpb.NewBoolValue(true))
+	applyDirectResponse(out, &networking.HTTPDirectResponse{
+		Status: http.StatusServiceUnavailable,
+		Body:   &networking.HTTPBody{Specifier: &networking.HTTPBody_String_{String_: m.Body}},
+	})
+	if m.RetryAfter > 0 {
+		// Retry-After is in whole seconds, rounded up so that clients do not retry too early.
+		out.ResponseHeadersToAdd = []*core.HeaderValueOption{{
+			Header: &core.HeaderValue{
+				Key:   HeaderRetryAfter,
+				Value: strconv.FormatInt(int64((m.RetryAfter+time.Second-1)/time.Second), 10),
+			},
+			Append: proto.BoolFalse,
+		}}
+	}
+	out.Decorator = &route.Decorator{
+		Operation: getRouteOperation(out, virtualService.Name, listenPort),
+	}
+	return out
+}
+
 func buildHTTP3AltSvcHeader(port int, h3Alpns []string) *core.HeaderValueOption {
 	// For example, www.cloudflare.com returns the following
 	// alt-svc: h3-27=":443"; ma=86400, h3-28=":443"; ma=86400, h3-29=":443"; ma=86400, h3=":443"; ma=86400
@@ -665,6 +1304,7 @@ type SortHeaderValueOption []*core.HeaderValueOption
 
 // mirrorPercent computes the mirror percent to be used based on "Mirror" data in route.
 func mirrorPercent(in *networking.HTTPRoute) *core.RuntimeFractionalPercent {
+	// MirrorPercentage takes precedence over the deprecated MirrorPercent, which is ignored when both are set.
 	switch {
 	case in.MirrorPercentage != nil:
 		if in.MirrorPercentage.GetValue() > 0 {
@@ -712,7 +1352,7 @@ func (b SortHeaderValueOption) Swap(i, j int) {
 }
 
 // translateAppendHeaders translates headers
-func translateAppendHeaders(headers map[string]string, appendFlag bool) ([]*core.HeaderValueOption, string) {
+func translateAppendHeaders(headers map[string]string, appendFlag, keepEmptyValue bool) ([]*core.HeaderValueOption, string) {
 	if len(headers) == 0 {
 		return nil, ""
 	}
@@ -726,12 +1366,14 @@ func translateAppendHeaders(headers map[string]string, appendFlag bool) ([]*core
 		if isInternalHeader(key) {
 			continue
 		}
+		// Validation warns about the values that are not valid Envoy formats; they are sent as literals.
 		headerValueOptionList = append(headerValueOptionList, &core.HeaderValueOption{
 			Header: &core.HeaderValue{
 				Key:   key,
-				Value: value,
+				Value: xds.EscapeHeaderValue(value),
 			},
-			Append: &wrappers.BoolValue{Value: appendFlag},
+			Append:         &wrappers.BoolValue{Value: appendFlag},
+			KeepEmptyValue: keepEmptyValue,
 		})
 	}
 	sort.Stable(SortHeaderValueOption(headerValueOptionList))
@@ -767,17 +1409,39 @@ func dropInternal(keys []string) []string {
 	return result
 }
 
+// applyClientCertDetails adds or drops the x-forwarded-client-cert header from the request headers to remove.
+func applyClientCertDetails(remove []string, details ClientCertDetails) []string {
+	switch details {
+	case ClientCertSanitize:
+		for _, k := range remove {
+			if strings.EqualFold(k, HeaderForwardedClientCert) {
+				return remove
+			}
+		}
+		return append(remove, HeaderForwardedClientCert)
+	case ClientCertForward:
+		out := remove[:0]
+		for _, k := range remove {
+			if !strings.EqualFold(k, HeaderForwardedClientCert) {
+				out = append(out, k)
+			}
+		}
+		return out
+	}
+	return remove
+}
+
 // translateHeadersOperations translates headers operations
-func translateHeadersOperations(headers *networking.Headers) headersOperations {
+func translateHeadersOperations(headers *networking.Headers, hx *HeadersExtension) headersOperations {
 	req := headers.GetRequest()
 	resp := headers.GetResponse()
 
-	requestHeadersToAdd, setAuthority := translateAppendHeaders(req.GetSet(), false)
-	reqAdd, addAuthority := translateAppendHeaders(req.GetAdd(), true)
+	requestHeadersToAdd, setAuthority := translateAppendHeaders(req.GetSet(), false, hx.KeepEmptyValue)
+	reqAdd, addAuthority := translateAppendHeaders(req.GetAdd(), true, hx.KeepEmptyValue)
 	requestHeadersToAdd = append(requestHeadersToAdd, reqAdd...)
 
-	responseHeadersToAdd, _ := translateAppendHeaders(resp.GetSet(), false)
-	respAdd, _ := translateAppendHeaders(resp.GetAdd(), true)
+	responseHeadersToAdd, _ := translateAppendHeaders(resp.GetSet(), false, hx.KeepEmptyValue)
+	respAdd, _ := translateAppendHeaders(resp.GetAdd(), true, hx.KeepEmptyValue)
 	responseHeadersToAdd = append(responseHeadersToAdd, respAdd...)
 
 	auth := addAuthority
@@ -788,14 +1452,26 @@ func translateHeadersOperations(headers *networking.Headers) headersOperations {
 	return headersOperations{
 		requestHeadersToAdd:     requestHeadersToAdd,
 		responseHeadersToAdd:    responseHeadersToAdd,
-		requestHeadersToRemove:  dropInternal(req.GetRemove()),
+		requestHeadersToRemove:  applyClientCertDetails(dropInternal(req.GetRemove()), hx.ClientCert),
 		responseHeadersToRemove: dropInternal(resp.GetRemove()),
 		authority:               auth,
 	}
 }
 
+// hasPathMatch returns true if the match restricts the request path, which CONNECT requests do not have.
+func hasPathMatch(in *networking.HTTPMatchRequest, mx *MatchExtension) bool {
+	return in.GetUri().GetMatchType() != nil || len(in.GetQueryParams()) > 0 || mx.PathTemplate != "" ||
+		mx.GrpcService != "" || len(mx.WithoutQueryParams) > 0
+}
+
+// BuildRouteMatch translates a VirtualService match condition into an Envoy route match, the way the routes of
+// a sidecar are built. Matches specific to Ingress and Gateway API semantics are not applied.
+func BuildRouteMatch(match *networking.HTTPMatchRequest, node *model.Proxy) *route.RouteMatch {
+	return translateRouteMatch(node, config.Config{}, match, emptyMatchExtension)
+}
+
 // translateRouteMatch translates match condition
-func translateRouteMatch(node *model.Proxy, vs config.Config, in *networking.HTTPMatchRequest) *route.RouteMatch {
+func translateRouteMatch(node *model.Proxy, vs config.Config, in *networking.HTTPMatchRequest, mx *MatchExtension) *route.RouteMatch {
 	out := &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}}
 	if in == nil {
 		return out
@@ -827,45 +1503,76 @@ func translateRouteMatch(node *model.Proxy, vs config.Config, in *networking.HTT
 		return out.Headers[i].Name < out.Headers[j].Name
 	})
 
-	if in.Uri != nil {
+	if in.Uri.GetMatchType() != nil {
 		switch m := in.Uri.MatchType.(type) {
 		case *networking.StringMatch_Exact:
 			out.PathSpecifier = &route.RouteMatch_Path{Path: m.Exact}
 		case *networking.StringMatch_Prefix:
-			if (model.UseIngressSemantics(vs) || model.UseGatewaySemantics(vs)) && m.Prefix != "/" {
-				path := strings.TrimSuffix(m.Prefix, "/")
-				if util.IsIstioVersionGE114(node.IstioVersion) {
-					out.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: path}
-				} else {
-					// For older versions, we have to use the regex hack.
-					// From the spec: /foo/bar matches /foo/bar/baz, but does not match /foo/barbaz
-					// and if the prefix is /foo/bar/ we must match /foo/bar and /foo/bar/baz. We cannot simply strip the
-					// trailing "/" and do a prefix match since we'll match unwanted continuations and we cannot add
-					// a "/" if not present since we won't match the prefix without trailing "/". Must be smarter and
-					// use regex.
-					out.PathSpecifier = &route.RouteMatch_SafeRegex{
-						SafeRegex: &matcher.RegexMatcher{
-							EngineType: util.RegexEngine,
-							Regex:      regexp.QuoteMeta(path) + prefixMatchRegex,
-						},
-					}
-				}
+			separated := mx.PathSeparatedPrefix || model.UseIngressSemantics(vs) || model.UseGatewaySemantics(vs)
+			if separated && m.Prefix != "/" {
+				setPathSeparatedPrefix(out, node, m.Prefix)
 			} else {
 				out.PathSpecifier = &route.RouteMatch_Prefix{Prefix: m.Prefix}
 			}
 		case *networking.StringMatch_Regex:
 			out.PathSpecifier = &route.RouteMatch_SafeRegex{
 				SafeRegex: &matcher.RegexMatcher{
-					EngineType: util.RegexEngine,
+					EngineType: util.ConfiguredRegexEngine(),
 					Regex:      m.Regex,
 				},
 			}
 		}
+		// Case sensitivity only qualifies the URI match; without one, the default "/" prefix is left as is.
+		out.CaseSensitive = &wrappers.BoolValue{Value: !in.IgnoreUriCase}
+		// Envoy ignores case_sensitive for regex path matches, so the regex must be made case insensitive itself.
+		// Regexes matching every path are left as is, so that they are still sorted as catch all routes.
+		if r, ok := out.PathSpecifier.(*route.RouteMatch_SafeRegex); ok && in.IgnoreUriCase &&
+			!strings.HasPrefix(r.SafeRegex.Regex, caseInsensitiveRegexFlag) && !isCatchAllRegex(r.SafeRegex.Regex) {
+			r.SafeRegex.Regex = caseInsensitiveRegexFlag + r.SafeRegex.Regex
+		}
+	}
+
+	if mx.PathTemplate != "" {
+		if strings.HasPrefix(mx.PathTemplate, "/") {
+			out.PathSpecifier = translatePathTemplate(mx.PathTemplate)
+		} else {
+			log.Warnf("virtual service %s/%s has a path template %q not starting with /, ignoring",
+				vs.Namespace, vs.Name, mx.PathTemplate)
+		}
+	}
+
+	if mx.Grpc || mx.GrpcService != "" {
+		out.Grpc = &route.RouteMatch_GrpcRouteMatchOptions{}
+	}
+	if mx.GrpcService != "" {
+		// gRPC calls are sent to the /<service>/<method> path.
+		if mx.GrpcMethod != "" {
+			out.PathSpecifier = &route.RouteMatch_Path{Path: "/" + mx.GrpcService + "/" + mx.GrpcMethod}
+		} else {
+			out.PathSpecifier = &route.RouteMatch_Prefix{Prefix: "/" + mx.GrpcService + "/"}
+		}
+	} else if mx.GrpcMethod != "" {
+		log.Warnf("virtual service %s/%s matches gRPC method %q without a service, ignoring",
+			vs.Namespace, vs.Name, mx.GrpcMethod)
 	}
 
-	out.CaseSensitive = &wrappers.BoolValue{Value: !in.IgnoreUriCase}
+	if mx.Connect {
+		out.PathSpecifier = &route.RouteMatch_ConnectMatcher_{ConnectMatcher: &route.RouteMatch_ConnectMatcher{}}
+	}
 
-	if in.Method != nil {
+	if mx.Percentage != nil {
+		out.RuntimeFraction = &core.RuntimeFractionalPercent{
+			DefaultValue: translatePercentToFractionalPercent(mx.Percentage),
+		}
+	}
+
+	if len(mx.Methods) > 0 {
+		if in.Method != nil {
+			log.Warnf("virtual service %s/%s matches both a method and a list of methods, ignoring the method",
+				vs.Namespace, vs.Name)
+		}
+		out.Headers = append(out.Headers, translateHeaderMatch(HeaderMethod, methodsMatch(mx.Methods)))
+	} else if in.Method != nil {
 		matcher := translateHeaderMatch(HeaderMethod, in.Method)
 		out.Headers = append(out.Headers, matcher)
 	}
@@ -880,10 +1587,33 @@ func translateRouteMatch(node *model.Proxy, vs config.Config, in *networking.HTT
 		out.Headers = append(out.Headers, matcher)
 	}
 
+	if len(mx.SNIHosts) > 0 {
+		out.Headers = append(out.Headers, translateHeaderMatch(HeaderAuthority, sniHostsMatch(mx.SNIHosts)))
+	}
+
 	for name, stringMatch := range in.QueryParams {
 		matcher := translateQueryParamMatch(name, stringMatch)
 		out.QueryParameters = append(out.QueryParameters, matcher)
 	}
+	// guarantee ordering of query parameters
+	sort.Slice(out.QueryParameters, func(i, j int) bool {
+		return out.QueryParameters[i].Name < out.QueryParameters[j].Name
+	})
+
+	for _, m := range mx.DynamicMetadata {
+		out.DynamicMetadata = append(out.DynamicMetadata, translateDynamicMetadataMatch(m))
+	}
+
+	if len(mx.WithoutQueryParams) > 0 {
+		names := make([]string, 0, len(mx.WithoutQueryParams))
+		for name := range mx.WithoutQueryParams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out.Headers = append(out.Headers, translateWithoutQueryParamMatch(name, mx.WithoutQueryParams[name]))
+		}
+	}
 
 	return out
 }
@@ -904,7 +1634,7 @@ func translateQueryParamMatch(name string, in *networking.StringMatch) *route.Qu
 			StringMatch: &matcher.StringMatcher{
 				MatchPattern: &matcher.StringMatcher_SafeRegex{
 					SafeRegex: &matcher.RegexMatcher{
-						EngineType: util.RegexEngine,
+						EngineType: util.ConfiguredRegexEngine(),
 						Regex:      m.Regex,
 					},
 				},
@@ -915,6 +1645,31 @@ func translateQueryParamMatch(name string, in *networking.StringMatch) *route.Qu
 	return out
 }
 
+// translateWithoutQueryParamMatch matches the requests without the given query parameter. Envoy cannot
+// invert a query parameter matcher, so the parameter is matched on the :path header instead, with an
+// inverted regex. As for query parameter matches, only exact and regex values are supported; any other
+// match excludes the requests carrying the parameter, whatever its value.
+func translateWithoutQueryParamMatch(name string, in *networking.StringMatch) *route.HeaderMatcher {
+	value := "(?:=[^&#]*)?"
+	switch m := in.GetMatchType().(type) {
+	case *networking.StringMatch_Exact:
+		value = "=" + regexp.QuoteMeta(m.Exact)
+	case *networking.StringMatch_Regex:
+		value = "=(?:" + m.Regex + ")"
+	}
+	// The parameter may appear anywhere in the query, which starts at the first "?" of the path.
+	regex := `[^?]*\?(?:.*&)?` + regexp.QuoteMeta(name) + value + `(?:[&#].*)?`
+	return &route.HeaderMatcher{
+		Name: HeaderPath,
+		HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+			StringMatch: util.ConvertToEnvoyMatch(&networking.StringMatch{
+				MatchType: &networking.StringMatch_Regex{Regex: regex},
+			}),
+		},
+		InvertMatch: true,
+	}
+}
+
 // isCatchAllHeaderMatch determines if the given header is matched with all strings or not.
 // Currently, if the regex has "*" value, it returns true
 func isCatchAllHeaderMatch(in *networking.StringMatch) bool {
@@ -948,6 +1703,25 @@ func translateMetadataMatch(name string, in *networking.StringMatch) *matcher.Me
 	return authz.MetadataMatcherForJWTClaims(claims, util.ConvertToEnvoyMatch(in))
 }
 
+// translateDynamicMetadataMatch translates a match on the dynamic metadata set by a filter.
+func translateDynamicMetadataMatch(in *MetadataMatch) *matcher.MetadataMatcher {
+	path := make([]*matcher.MetadataMatcher_PathSegment, 0, len(in.Path))
+	for _, key := range in.Path {
+		path = append(path, &matcher.MetadataMatcher_PathSegment{
+			Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: key},
+		})
+	}
+	value := &matcher.ValueMatcher{MatchPattern: &matcher.ValueMatcher_PresentMatch{PresentMatch: true}}
+	if in.Value.GetMatchType() != nil {
+		value.MatchPattern = &matcher.ValueMatcher_StringMatch{StringMatch: util.ConvertToEnvoyMatch(in.Value)}
+	}
+	return &matcher.MetadataMatcher{
+		Filter: in.Filter,
+		Path:   path,
+		Value:  value,
+	}
+}
+
 // translateHeaderMatch translates to HeaderMatcher
 func translateHeaderMatch(name string, in *networking.StringMatch) *route.HeaderMatcher {
 	out := &route.HeaderMatcher{
@@ -968,6 +1742,327 @@ func translateHeaderMatch(name string, in *networking.StringMatch) *route.Header
 	return out
 }
 
+// translateRouteTracing translates the tracing settings of a route
+func translateRouteTracing(in *RouteTracing) *route.Tracing {
+	if in == nil || (len(in.CustomTags) == 0 && in.ClientSampling == nil && in.RandomSampling == nil && in.OverallSampling == nil) {
+		return nil
+	}
+	out := &route.Tracing{}
+	if in.ClientSampling != nil {
+		out.ClientSampling = translatePercentToFractionalPercent(in.ClientSampling)
+	}
+	if in.RandomSampling != nil {
+		out.RandomSampling = translatePercentToFractionalPercent(in.RandomSampling)
+	}
+	if in.OverallSampling != nil {
+		out.OverallSampling = translatePercentToFractionalPercent(in.OverallSampling)
+	}
+	for tagName, tagInfo := range in.CustomTags {
+		switch tag := tagInfo.GetType().(type) {
+		case *meshconfig.Tracing_CustomTag_Environment:
+			out.CustomTags = append(out.CustomTags, &tracing.CustomTag{
+				Tag: tagName,
+				Type: &tracing.CustomTag_Environment_{
+					Environment: &tracing.CustomTag_Environment{
+						Name:         tag.Environment.Name,
+						DefaultValue: tag.Environment.DefaultValue,
+					},
+				},
+			})
+		case *meshconfig.Tracing_CustomTag_Header:
+			out.CustomTags = append(out.CustomTags, &tracing.CustomTag{
+				Tag: tagName,
+				Type: &tracing.CustomTag_RequestHeader{
+					RequestHeader: &tracing.CustomTag_Header{
+						Name:         tag.Header.Name,
+						DefaultValue: tag.Header.DefaultValue,
+					},
+				},
+			})
+		case *meshconfig.Tracing_CustomTag_Literal:
+			out.CustomTags = append(out.CustomTags, &tracing.CustomTag{
+				Tag: tagName,
+				Type: &tracing.CustomTag_Literal_{
+					Literal: &tracing.CustomTag_Literal{
+						Value: tag.Literal.Value,
+					},
+				},
+			})
+		}
+	}
+	// guarantee ordering of tags
+	sort.Slice(out.CustomTags, func(i, j int) bool {
+		return out.CustomTags[i].Tag < out.CustomTags[j].Tag
+	})
+	return out
+}
+
+// translateInternalRedirect translates an internal redirect policy
+func translateInternalRedirect(in *InternalRedirect) *route.InternalRedirectPolicy {
+	out := &route.InternalRedirectPolicy{
+		RedirectResponseCodes:    in.ResponseCodes,
+		AllowCrossSchemeRedirect: in.AllowCrossSchemeRedirect,
+	}
+	if in.MaxRedirects > 0 {
+		out.MaxInternalRedirects = &wrappers.UInt32Value{Value: in.MaxRedirects}
+	}
+	return out
+}
+
+// translateConnectTunnel translates a CONNECT tunnel into the upgrade config terminating CONNECT requests.
+func translateConnectTunnel(in *ConnectTunnel) *route.RouteAction_UpgradeConfig {
+	out := &route.RouteAction_UpgradeConfig{
+		UpgradeType: "CONNECT",
+		ConnectConfig: &route.RouteAction_UpgradeConfig_ConnectConfig{
+			AllowPost: in.AllowPost,
+		},
+	}
+	if in.ProxyProtocol {
+		out.ConnectConfig.ProxyProtocolConfig = &core.ProxyProtocolConfig{Version: core.ProxyProtocolConfig_V2}
+	}
+	return out
+}
+
+// translateRelativeTimeout computes the timeout of a route from a percentage of its base timeout.
+func translateRelativeTimeout(in *RelativeTimeout) (*durationpb.Duration, error) {
+	// Written so that NaN is out of bounds too.
+	if !(in.Percent > 0 && in.Percent <= MaxRelativeTimeoutPercent) {
+		return nil, fmt.Errorf("percentage %v is not in the (0, %d] range", in.Percent, MaxRelativeTimeoutPercent)
+	}
+	base := in.Base
+	if base == 0 {
+		base = features.DefaultRequestTimeout.AsDuration()
+	}
+	return durationpb.New(time.Duration(float64(base) * in.Percent / 100)), nil
+}
+
+// translateHedge translates a hedge policy
+func translateHedge(in *Hedge) *route.HedgePolicy {
+	out := &route.HedgePolicy{
+		HedgeOnPerTryTimeout: in.HedgeOnPerTryTimeout,
+	}
+	if in.InitialRequests > 0 {
+		out.InitialRequests = &wrappers.UInt32Value{Value: in.InitialRequests}
+	}
+	if in.AdditionalRequestChance.GetValue() > 0 {
+		out.AdditionalRequestChance = translatePercentToFractionalPercent(in.AdditionalRequestChance)
+	}
+	return out
+}
+
+// setPathSeparatedPrefix matches the request paths under the prefix on path segment boundaries:
+// /foo/bar matches /foo/bar and /foo/bar/baz, but not /foo/barbaz. A trailing "/" in the prefix is ignored.
+func setPathSeparatedPrefix(out *route.RouteMatch, node *model.Proxy, prefix string) {
+	path := strings.TrimSuffix(prefix, "/")
+	if util.IsIstioVersionGE114(node.IstioVersion) {
+		out.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: path}
+		return
+	}
+	// For older versions, we have to use the regex hack.
+	// From the spec: /foo/bar matches /foo/bar/baz, but does not match /foo/barbaz
+	// and if the prefix is /foo/bar/ we must match /foo/bar and /foo/bar/baz. We cannot simply strip the
+	// trailing "/" and do a prefix match since we'll match unwanted continuations and we cannot add
+	// a "/" if not present since we won't match the prefix without trailing "/". Must be smarter and
+	// use regex.
+	out.PathSpecifier = &route.RouteMatch_SafeRegex{
+		SafeRegex: &matcher.RegexMatcher{
+			EngineType: util.ConfiguredRegexEngine(),
+			Regex:      regexp.QuoteMeta(path) + prefixMatchRegex,
+		},
+	}
+}
+
+// methodsMatch matches any of the given HTTP methods. Like all method matches, it is case sensitive.
+func methodsMatch(methods []string) *networking.StringMatch {
+	if len(methods) == 1 {
+		return &networking.StringMatch{MatchType: &networking.StringMatch_Exact{Exact: methods[0]}}
+	}
+	quoted := make([]string, 0, len(methods))
+	for _, m := range methods {
+		quoted = append(quoted, regexp.QuoteMeta(m))
+	}
+	return &networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: strings.Join(quoted, "|")}}
+}
+
+// sniHostsMatch matches an authority whose host is any of the server names, ignoring case and the port. A
+// wildcard server name, e.g. "*.example.com", matches a single DNS label in place of the "*".
+func sniHostsMatch(hosts []string) *networking.StringMatch {
+	patterns := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "*.") {
+			patterns = append(patterns, `[^.:]+`+regexp.QuoteMeta(h[1:]))
+		} else {
+			patterns = append(patterns, regexp.QuoteMeta(h))
+		}
+	}
+	regex := caseInsensitiveRegexFlag + "(" + strings.Join(patterns, "|") + ")(:[0-9]+)?"
+	return &networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: regex}}
+}
+
+// translatePathTemplate matches the request path against a URI template.
+func translatePathTemplate(template string) *route.RouteMatch_PathMatchPolicy {
+	return &route.RouteMatch_PathMatchPolicy{
+		PathMatchPolicy: &core.TypedExtensionConfig{
+			Name:        uriTemplateMatcher,
+			TypedConfig: protoconv.MessageToAny(&uritemplate.UriTemplateMatchConfig{PathTemplate: template}),
+		},
+	}
+}
+
+// translateClusterNotFoundResponseCode translates an HTTP status into the code returned by Envoy when
+// the cluster of a route is not found. It returns false for the statuses Envoy does not support.
+func translateClusterNotFoundResponseCode(code uint32) (route.RouteAction_ClusterNotFoundResponseCode, bool) {
+	switch code {
+	case http.StatusServiceUnavailable:
+		return route.RouteAction_SERVICE_UNAVAILABLE, true
+	case http.StatusNotFound:
+		return route.RouteAction_NOT_FOUND, true
+	case http.StatusInternalServerError:
+		return route.RouteAction_INTERNAL_SERVER_ERROR, true
+	default:
+		return route.RouteAction_SERVICE_UNAVAILABLE, false
+	}
+}
+
+// translateRetriableRequestHeaders translates the headers gating retries, sorted by name.
+func translateRetriableRequestHeaders(in map[string]*networking.StringMatch) []*route.HeaderMatcher {
+	names := make([]string, 0, len(in))
+	for name := range in {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*route.HeaderMatcher, 0, len(names))
+	for _, name := range names {
+		if in[name].GetMatchType() == nil {
+			out = append(out, &route.HeaderMatcher{
+				Name:                 name,
+				HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+			})
+			continue
+		}
+		out = append(out, translateHeaderMatch(name, in[name]))
+	}
+	return out
+}
+
+// translatePerFilterConfig translates the fault and local rate limit of a route or destination into the
+// per filter config of the matching filters, or nil if neither is set.
+func translatePerFilterConfig(fault *networking.HTTPFaultInjection, faultLimits *FaultLimits,
+	localRateLimit *LocalRateLimit,
+) map[string]*anypb.Any {
+	var out map[string]*anypb.Any
+	if fault != nil {
+		out = map[string]*anypb.Any{wellknown.Fault: protoconv.MessageToAny(translateFault(fault, faultLimits))}
+	}
+	if rl := translateLocalRateLimit(localRateLimit); rl != nil {
+		if out == nil {
+			out = make(map[string]*anypb.Any)
+		}
+		out[localRateLimitFilter] = protoconv.MessageToAny(rl)
+	}
+	return out
+}
+
+// mergePerFilterConfig merges the per filter configs, the configs of overrides replacing the ones of base
+// for the same filter.
+func mergePerFilterConfig(base, overrides map[string]*anypb.Any) map[string]*anypb.Any {
+	if len(overrides) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]*anypb.Any, len(overrides))
+	}
+	for name, c := range overrides {
+		base[name] = c
+	}
+	return base
+}
+
+// translateLocalRateLimit translates a local rate limit into the per route config of the local rate limit filter.
+func translateLocalRateLimit(in *LocalRateLimit) *localratelimit.LocalRateLimit {
+	if in == nil || in.MaxTokens == 0 {
+		return nil
+	}
+	tokensPerFill := in.TokensPerFill
+	if tokensPerFill == 0 {
+		tokensPerFill = in.MaxTokens
+	}
+	fillInterval := in.FillInterval
+	if fillInterval <= 0 {
+		fillInterval = time.Second
+	}
+	// The filter is neither enabled nor enforced by default, limit every request of the route.
+	all := func() *core.RuntimeFractionalPercent {
+		return &core.RuntimeFractionalPercent{
+			DefaultValue: &xdstype.FractionalPercent{Numerator: 100, Denominator: xdstype.FractionalPercent_HUNDRED},
+		}
+	}
+	out := &localratelimit.LocalRateLimit{
+		StatPrefix: "http_local_rate_limiter",
+		TokenBucket: &xdstype.TokenBucket{
+			MaxTokens:     in.MaxTokens,
+			TokensPerFill: &wrappers.UInt32Value{Value: tokensPerFill},
+			FillInterval:  durationpb.New(fillInterval),
+		},
+		FilterEnabled:  all(),
+		FilterEnforced: all(),
+	}
+	if in.StatusCode != 0 {
+		out.Status = &xdstype.HttpStatus{Code: xdstype.StatusCode(in.StatusCode)}
+	}
+	return out
+}
+
+// translateRateLimits translates rate limit descriptors
+func translateRateLimits(in []*RateLimit) []*route.RateLimit {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make([]*route.RateLimit, 0, len(in))
+	for _, rl := range in {
+		rateLimit := &route.RateLimit{
+			DisableKey: rl.DisableKey,
+		}
+		if rl.Stage > 0 {
+			rateLimit.Stage = &wrappers.UInt32Value{Value: rl.Stage}
+		}
+		for _, a := range rl.Actions {
+			switch {
+			case a.RequestHeader != nil:
+				rateLimit.Actions = append(rateLimit.Actions, &route.RateLimit_Action{
+					ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+						RequestHeaders: &route.RateLimit_Action_RequestHeaders{
+							HeaderName:    a.RequestHeader.HeaderName,
+							DescriptorKey: a.RequestHeader.DescriptorKey,
+						},
+					},
+				})
+			case a.RemoteAddress:
+				rateLimit.Actions = append(rateLimit.Actions, &route.RateLimit_Action{
+					ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+						RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+					},
+				})
+			case a.GenericKey != nil:
+				rateLimit.Actions = append(rateLimit.Actions, &route.RateLimit_Action{
+					ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+						GenericKey: &route.RateLimit_Action_GenericKey{
+							DescriptorKey:   a.GenericKey.DescriptorKey,
+							DescriptorValue: a.GenericKey.DescriptorValue,
+						},
+					},
+				})
+			}
+		}
+		// Envoy requires at least one action per descriptor.
+		if len(rateLimit.Actions) == 0 {
+			continue
+		}
+		out = append(out, rateLimit)
+	}
+	return out
+}
+
 // translateCORSPolicy translates CORS policy
 func translateCORSPolicy(in *networking.CorsPolicy) *route.CorsPolicy {
 	if in == nil {
@@ -995,13 +2090,97 @@ func translateCORSPolicy(in *networking.CorsPolicy) *route.CorsPolicy {
 	out.AllowCredentials = in.AllowCredentials
 	out.AllowHeaders = strings.Join(in.AllowHeaders, ",")
 	out.AllowMethods = strings.Join(in.AllowMethods, ",")
-	out.ExposeHeaders = strings.Join(in.ExposeHeaders, ",")
+	out.ExposeHeaders = formatCORSExposeHeaders(in.ExposeHeaders, in.AllowCredentials.GetValue())
 	if in.MaxAge != nil {
-		out.MaxAge = strconv.FormatInt(in.MaxAge.GetSeconds(), 10)
+		out.MaxAge = formatCORSMaxAge(in.MaxAge.AsDuration())
 	}
 	return &out
 }
 
+// formatCORSExposeHeaders formats the headers a CORS policy exposes to the browser. A lone "*" is kept, as
+// browsers take it as a wildcard exposing all response headers, though only for requests without credentials.
+// Other patterns, e.g. "x-custom-*", are not supported by browsers and are dropped.
+func formatCORSExposeHeaders(headers []string, allowCredentials bool) string {
+	out := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if h == "*" {
+			if allowCredentials {
+				log.Warnf("CORS expose header \"*\" is taken literally by browsers when credentials are allowed")
+			}
+		} else if strings.Contains(h, "*") {
+			log.Warnf("ignoring CORS expose header pattern %q: only a lone \"*\" wildcard is supported", h)
+			continue
+		}
+		out = append(out, h)
+	}
+	return strings.Join(out, ",")
+}
+
+// formatCORSMaxAge formats the max age of a CORS policy as the whole seconds Envoy expects, rounding to the
+// nearest second. A negative max age is invalid and dropped, leaving the max age to the browser.
+func formatCORSMaxAge(maxAge time.Duration) string {
+	if maxAge < 0 {
+		log.Warnf("ignoring negative CORS max age %v", maxAge)
+		return ""
+	}
+	return strconv.FormatInt(int64(maxAge.Round(time.Second)/time.Second), 10)
+}
+
+// translateDecorator builds the decorator of a route, reporting the given operation unless overridden.
+func translateDecorator(in *RouteDecorator, operation string) *route.Decorator {
+	out := &route.Decorator{
+		Operation: operation,
+	}
+	if in != nil && in.Operation != "" {
+		out.Operation = in.Operation
+	}
+	if in != nil && in.Propagate != nil {
+		out.Propagate = &wrappers.BoolValue{Value: *in.Propagate}
+	}
+	return out
+}
+
+// translateRegexMatchRewrite turns the prefix rewrite of a route matching the path with a regex into a regex
+// rewrite of the whole path. As the regex has to match the whole path, Envoy already replaces all of it on a
+// prefix rewrite, rather than the matched prefix one may expect; the regex rewrite makes this explicit and
+// lets the rewritten URI refer to the capture groups of the match, e.g. "/v2/\1".
+func translateRegexMatchRewrite(out *route.Route) {
+	action := out.GetRoute()
+	r := out.GetMatch().GetSafeRegex()
+	if action.GetPrefixRewrite() == "" || r == nil {
+		return
+	}
+	action.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+		Pattern: &matcher.RegexMatcher{
+			EngineType: r.EngineType,
+			Regex:      r.Regex,
+		},
+		Substitution: action.PrefixRewrite,
+	}
+	action.PrefixRewrite = ""
+}
+
+// translatePathTemplateRewrite turns the prefix rewrite of a route matching the path with a URI template into
+// a URI template rewrite, as Envoy does not combine prefix rewrites with path match extensions. The rewritten
+// URI is then a template that may refer to the variables of the match, e.g. "/v2/{id}". A rewrite that is not
+// a path is dropped.
+func translatePathTemplateRewrite(out *route.Route, vs config.Config) {
+	action := out.GetRoute()
+	if action.GetPrefixRewrite() == "" || out.GetMatch().GetPathMatchPolicy() == nil {
+		return
+	}
+	if strings.HasPrefix(action.PrefixRewrite, "/") {
+		action.PathRewritePolicy = &core.TypedExtensionConfig{
+			Name:        uriTemplateRewriter,
+			TypedConfig: protoconv.MessageToAny(&uritemplaterewrite.UriTemplateRewriteConfig{PathTemplateRewrite: action.PrefixRewrite}),
+		}
+	} else {
+		log.Warnf("virtual service %s/%s rewrites the URI of route %q matching a path template to %q, which is not a path, ignoring",
+			vs.Namespace, vs.Name, out.Name, action.PrefixRewrite)
+	}
+	action.PrefixRewrite = ""
+}
+
 // getRouteOperation returns readable route description for trace.
 func getRouteOperation(in *route.Route, vsName string, port int) string {
 	path := "/*"
@@ -1018,13 +2197,16 @@ func getRouteOperation(in *route.Route, vsName string, port int) string {
 		}
 	}
 
-	// If there is only one destination cluster in route, return host:port/uri as description of route.
+	// If there is only one destination cluster in route, return host:port/uri as description of route,
+	// or cluster/uri for a statically configured cluster whose name does not carry the host and port.
 	// Otherwise there are multiple destination clusters and destination host is not clear. For that case
 	// return virtual serivce name:port/uri as substitute.
 	if c := in.GetRoute().GetCluster(); model.IsValidSubsetKey(c) {
 		// Parse host and port from cluster name.
 		_, _, h, p := model.ParseSubsetKey(c)
 		return string(h) + ":" + strconv.Itoa(p) + path
+	} else if c != "" {
+		return c + path
 	}
 	return vsName + ":" + strconv.Itoa(port) + path
 }
@@ -1048,7 +2230,7 @@ func buildDefaultHTTPRoute(clusterName string, operation string) *route.Route {
 		ClusterSpecifier: &route.RouteAction_Cluster{Cluster: clusterName},
 	}
 	val := &route.Route{
-		Match: translateRouteMatch(nil, config.Config{}, nil),
+		Match: translateRouteMatch(nil, config.Config{}, nil, emptyMatchExtension),
 		Decorator: &route.Decorator{
 			Operation: operation,
 		},
@@ -1061,7 +2243,9 @@ func buildDefaultHTTPRoute(clusterName string, operation string) *route.Route {
 	return val
 }
 
-// setTimeout sets timeout for a route.
+// setTimeout sets timeout for a route. The timeout is always set, as Envoy still lets trusted clients
+// override it with the x-envoy-upstream-rq-timeout-ms header. The default timeout applies when the virtual
+// service sets none, while an explicit zero timeout disables it, e.g. for server-sent events or long polling.
 func setTimeout(action *route.RouteAction, vsTimeout *duration.Duration, node *model.Proxy) {
 	// Configure timeouts specified by Virtual Service if they are provided, otherwise set it to defaults.
 	action.Timeout = features.DefaultRequestTimeout
@@ -1090,6 +2274,38 @@ func setTimeout(action *route.RouteAction, vsTimeout *duration.Duration, node *m
 	}
 }
 
+// setGrpcTimeout bounds the timeouts requested by gRPC clients in the grpc-timeout header. The header
+// max falls back to, and never exceeds, the route timeout, unless the route has no timeout.
+func setGrpcTimeout(action *route.RouteAction, in *GrpcTimeout) {
+	timeout := action.Timeout.AsDuration()
+	headerMax := in.HeaderMax
+	if timeout > 0 && (headerMax <= 0 || headerMax > timeout) {
+		headerMax = timeout
+	}
+	if action.MaxStreamDuration == nil {
+		action.MaxStreamDuration = &route.RouteAction_MaxStreamDuration{}
+	}
+	action.MaxStreamDuration.GrpcTimeoutHeaderMax = durationpb.New(headerMax)
+	if in.HeaderOffset > 0 {
+		action.MaxStreamDuration.GrpcTimeoutHeaderOffset = durationpb.New(in.HeaderOffset)
+	}
+	// The deprecated max_grpc_timeout is superseded by the header max.
+	// nolint: staticcheck
+	action.MaxGrpcTimeout = nil
+}
+
+// clampPerTryTimeout lowers the per-try timeout of the retry policy when it exceeds the route timeout, which
+// would otherwise silently cap it. The route timeout is split evenly across the initial try and all retries.
+func clampPerTryTimeout(action *route.RouteAction) {
+	timeout := action.Timeout.AsDuration()
+	perTry := action.RetryPolicy.GetPerTryTimeout()
+	if timeout <= 0 || perTry == nil || perTry.AsDuration() <= timeout {
+		return
+	}
+	attempts := time.Duration(action.RetryPolicy.GetNumRetries().GetValue()) + 1
+	action.RetryPolicy.PerTryTimeout = durationpb.New(timeout / attempts)
+}
+
 // BuildDefaultHTTPOutboundRoute builds a default outbound route, including a retry policy.
 func BuildDefaultHTTPOutboundRoute(clusterName string, operation string, mesh *meshconfig.MeshConfig) *route.Route {
 	out := buildDefaultHTTPRoute(clusterName, operation)
@@ -1099,6 +2315,20 @@ func BuildDefaultHTTPOutboundRoute(clusterName string, operation string, mesh *m
 	return out
 }
 
+// BuildDefaultDenyRoute builds a default route answering 404, used in place of BuildDefaultHTTPOutboundRoute
+// for services without a virtual service when features.DenyServicesWithoutVirtualService is set.
+func BuildDefaultDenyRoute(operation string) *route.Route {
+	out := &route.Route{
+		Name:  DefaultRouteName,
+		Match: translateRouteMatch(nil, config.Config{}, nil, emptyMatchExtension),
+		Decorator: &route.Decorator{
+			Operation: operation,
+		},
+	}
+	applyDirectResponse(out, &networking.HTTPDirectResponse{Status: http.StatusNotFound})
+	return out
+}
+
 // translatePercentToFractionalPercent translates an v1alpha3 Percent instance
 // to an envoy.type.FractionalPercent instance.
 func translatePercentToFractionalPercent(p *networking.Percent) *xdstype.FractionalPercent {
@@ -1117,61 +2347,142 @@ func translateIntegerToFractionalPercent(p int32) *xdstype.FractionalPercent {
 	}
 }
 
-// translateFault translates networking.HTTPFaultInjection into Envoy's HTTPFault
-func translateFault(in *networking.HTTPFaultInjection) *xdshttpfault.HTTPFault {
+// injectsFault returns whether the route, or any of its weighted clusters, injects faults.
+func injectsFault(out *route.Route) bool {
+	if out.TypedPerFilterConfig[wellknown.Fault] != nil {
+		return true
+	}
+	for _, cw := range out.GetRoute().GetWeightedClusters().GetClusters() {
+		if cw.TypedPerFilterConfig[wellknown.Fault] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// translateFault translates networking.HTTPFaultInjection into Envoy's HTTPFault, bounded by the given limits
+func translateFault(in *networking.HTTPFaultInjection, limits *FaultLimits) *xdshttpfault.HTTPFault {
 	if in == nil {
 		return nil
 	}
 
 	out := xdshttpfault.HTTPFault{}
-	if in.Delay != nil {
-		out.Delay = &xdsfault.FaultDelay{}
-		if in.Delay.Percentage != nil {
-			out.Delay.Percentage = translatePercentToFractionalPercent(in.Delay.Percentage)
-		} else {
-			out.Delay.Percentage = translateIntegerToFractionalPercent(in.Delay.Percent) // nolint: staticcheck
-		}
-		switch d := in.Delay.HttpDelayType.(type) {
-		case *networking.HTTPFaultInjection_Delay_FixedDelay:
-			out.Delay.FaultDelaySecifier = &xdsfault.FaultDelay_FixedDelay{
-				FixedDelay: d.FixedDelay,
-			}
-		default:
-			log.Warnf("Exponential faults are not yet supported")
-			out.Delay = nil
-		}
+	var err error
+	// Unsupported faults are dropped, leaving the other fault in place.
+	if out.Delay, err = translateFaultDelay(in.Delay); err != nil {
+		log.Warn(err)
 	}
-
-	if in.Abort != nil {
-		out.Abort = &xdshttpfault.FaultAbort{}
-		if in.Abort.Percentage != nil {
-			out.Abort.Percentage = translatePercentToFractionalPercent(in.Abort.Percentage)
-		}
-		switch a := in.Abort.ErrorType.(type) {
-		case *networking.HTTPFaultInjection_Abort_HttpStatus:
-			out.Abort.ErrorType = &xdshttpfault.FaultAbort_HttpStatus{
-				HttpStatus: uint32(a.HttpStatus),
-			}
-		case *networking.HTTPFaultInjection_Abort_GrpcStatus:
-			// We wouldn't have an unknown gRPC code here. This is because
-			// the validation webhook would have already caught the invalid
-			// code and we wouldn't reach here.
-			out.Abort.ErrorType = &xdshttpfault.FaultAbort_GrpcStatus{
-				GrpcStatus: uint32(grpc.SupportedGRPCStatus[a.GrpcStatus]),
-			}
-		default:
-			log.Warnf("Only HTTP and gRPC type abort faults are supported")
-			out.Abort = nil
-		}
+	if out.Abort, err = translateFaultAbort(in.Abort); err != nil {
+		log.Warn(err)
 	}
 
 	if out.Delay == nil && out.Abort == nil {
 		return nil
 	}
+	if limits != nil && limits.MaxActiveFaults > 0 {
+		out.MaxActiveFaults = &wrappers.UInt32Value{Value: limits.MaxActiveFaults}
+	}
 
 	return &out
 }
 
+// translateHeaderFault builds a fault delaying and aborting the requests as asked by their
+// x-envoy-fault-delay-request and x-envoy-fault-abort-request headers. The percentages of the given fault,
+// if any, bound the requests faulted, all of them otherwise.
+func translateHeaderFault(in *networking.HTTPFaultInjection, limits *FaultLimits) *xdshttpfault.HTTPFault {
+	out := &xdshttpfault.HTTPFault{
+		Delay: &xdsfault.FaultDelay{
+			FaultDelaySecifier: &xdsfault.FaultDelay_HeaderDelay_{HeaderDelay: &xdsfault.FaultDelay_HeaderDelay{}},
+			Percentage:         translateIntegerToFractionalPercent(100),
+		},
+		Abort: &xdshttpfault.FaultAbort{
+			ErrorType:  &xdshttpfault.FaultAbort_HeaderAbort_{HeaderAbort: &xdshttpfault.FaultAbort_HeaderAbort{}},
+			Percentage: translateIntegerToFractionalPercent(100),
+		},
+	}
+	if delay := in.GetDelay(); delay != nil {
+		if delay.Percentage != nil {
+			out.Delay.Percentage = translatePercentToFractionalPercent(delay.Percentage)
+		} else if delay.Percent != 0 { // nolint: staticcheck
+			out.Delay.Percentage = translateIntegerToFractionalPercent(delay.Percent) // nolint: staticcheck
+		}
+	}
+	if abort := in.GetAbort(); abort != nil && abort.Percentage != nil {
+		out.Abort.Percentage = translatePercentToFractionalPercent(abort.Percentage)
+	}
+	if limits != nil && limits.MaxActiveFaults > 0 {
+		out.MaxActiveFaults = &wrappers.UInt32Value{Value: limits.MaxActiveFaults}
+	}
+	return out
+}
+
+// BuildHTTPFault translates a fault injection policy into the configuration of the Envoy fault filter.
+// Unlike the routes, which drop the faults that are not supported, it returns an error for them.
+func BuildHTTPFault(in *networking.HTTPFaultInjection) (*xdshttpfault.HTTPFault, error) {
+	if in == nil {
+		return nil, nil
+	}
+	delay, err := translateFaultDelay(in.Delay)
+	if err != nil {
+		return nil, err
+	}
+	abort, err := translateFaultAbort(in.Abort)
+	if err != nil {
+		return nil, err
+	}
+	if delay == nil && abort == nil {
+		return nil, nil
+	}
+	return &xdshttpfault.HTTPFault{Delay: delay, Abort: abort}, nil
+}
+
+func translateFaultDelay(in *networking.HTTPFaultInjection_Delay) (*xdsfault.FaultDelay, error) {
+	if in == nil {
+		return nil, nil
+	}
+	out := &xdsfault.FaultDelay{}
+	if in.Percentage != nil {
+		out.Percentage = translatePercentToFractionalPercent(in.Percentage)
+	} else {
+		out.Percentage = translateIntegerToFractionalPercent(in.Percent) // nolint: staticcheck
+	}
+	switch d := in.HttpDelayType.(type) {
+	case *networking.HTTPFaultInjection_Delay_FixedDelay:
+		out.FaultDelaySecifier = &xdsfault.FaultDelay_FixedDelay{
+			FixedDelay: d.FixedDelay,
+		}
+	default:
+		return nil, fmt.Errorf("exponential faults are not yet supported")
+	}
+	return out, nil
+}
+
+func translateFaultAbort(in *networking.HTTPFaultInjection_Abort) (*xdshttpfault.FaultAbort, error) {
+	if in == nil {
+		return nil, nil
+	}
+	out := &xdshttpfault.FaultAbort{}
+	if in.Percentage != nil {
+		out.Percentage = translatePercentToFractionalPercent(in.Percentage)
+	}
+	switch a := in.ErrorType.(type) {
+	case *networking.HTTPFaultInjection_Abort_HttpStatus:
+		out.ErrorType = &xdshttpfault.FaultAbort_HttpStatus{
+			HttpStatus: uint32(a.HttpStatus),
+		}
+	case *networking.HTTPFaultInjection_Abort_GrpcStatus:
+		// We wouldn't have an unknown gRPC code here. This is because
+		// the validation webhook would have already caught the invalid
+		// code and we wouldn't reach here.
+		out.ErrorType = &xdshttpfault.FaultAbort_GrpcStatus{
+			GrpcStatus: uint32(grpc.SupportedGRPCStatus[a.GrpcStatus]),
+		}
+	default:
+		return nil, fmt.Errorf("only HTTP and gRPC type abort faults are supported")
+	}
+	return out, nil
+}
+
 func portLevelSettingsConsistentHash(dst *networking.Destination,
 	pls []*networking.TrafficPolicy_PortTrafficPolicy,
 ) *networking.LoadBalancerSettings_ConsistentHashLB {
@@ -1203,6 +2514,10 @@ func consistentHashToHashPolicy(consistentHash *networking.LoadBalancerSettings_
 		var ttl *durationpb.Duration
 		if cookie.GetTtl() != nil {
 			ttl = cookie.GetTtl()
+		} else if features.HashCookieDefaultTTL > 0 {
+			// Envoy only generates the cookie, when the request has none, if the TTL is set.
+			// Cookie attributes, such as Secure or HttpOnly, cannot be configured in Envoy.
+			ttl = durationpb.New(features.HashCookieDefaultTTL)
 		}
 		return &route.RouteAction_HashPolicy{
 			PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
@@ -1237,11 +2552,12 @@ func hashForService(push *model.PushContext,
 	node *model.Proxy,
 	svc *model.Service,
 	port *model.Port,
+	drs *destinationRuleCache,
 ) (*networking.LoadBalancerSettings_ConsistentHashLB, *model.ConsolidatedDestRule) {
 	if push == nil {
 		return nil, nil
 	}
-	mergedDR := node.SidecarScope.DestinationRule(model.TrafficDirectionOutbound, node, svc.Hostname)
+	mergedDR := drs.lookup(node, svc.Hostname)
 	destinationRule := mergedDR.GetRule()
 	if destinationRule == nil {
 		return nil, nil
@@ -1265,12 +2581,13 @@ func hashForService(push *model.PushContext,
 func hashForVirtualService(push *model.PushContext,
 	node *model.Proxy,
 	virtualService config.Config,
+	drs *destinationRuleCache,
 ) (DestinationHashMap, []*model.ConsolidatedDestRule) {
 	hashByDestination := DestinationHashMap{}
 	destinationRules := make([]*model.ConsolidatedDestRule, 0)
 	for _, httpRoute := range virtualService.Spec.(*networking.VirtualService).Http {
 		for _, destination := range httpRoute.Route {
-			hash, dr := hashForHTTPDestination(push, node, destination)
+			hash, dr := hashForHTTPDestination(push, node, destination, drs)
 			if hash != nil {
 				hashByDestination[destination] = hash
 				destinationRules = append(destinationRules, dr)
@@ -1281,20 +2598,60 @@ func hashForVirtualService(push *model.PushContext,
 }
 
 func GetConsistentHashForVirtualService(push *model.PushContext, node *model.Proxy, virtualService config.Config) DestinationHashMap {
-	hashByDestination, _ := hashForVirtualService(push, node, virtualService)
+	hashByDestination, _ := hashForVirtualService(push, node, virtualService, nil)
 	return hashByDestination
 }
 
+// destinationRuleCache memoizes the destination rule lookups made while the routes of a proxy are built,
+// as the same host is typically the destination of many routes. It must not be shared by proxies with
+// different labels, which select different workload specific rules. It is safe for concurrent use.
+// A nil cache looks the rules up every time.
+type destinationRuleCache struct {
+	mu    sync.RWMutex
+	rules map[destinationRuleKey]*model.ConsolidatedDestRule
+}
+
+// destinationRuleKey identifies a destination rule lookup. The rule found for a host depends on the namespace
+// of the sidecar scope, but not on the subset of the destination, which is only selected from the rule.
+type destinationRuleKey struct {
+	hostname  host.Name
+	namespace string
+}
+
+func newDestinationRuleCache() *destinationRuleCache {
+	return &destinationRuleCache{rules: map[destinationRuleKey]*model.ConsolidatedDestRule{}}
+}
+
+// lookup returns the outbound destination rule of the proxy for the host.
+func (c *destinationRuleCache) lookup(node *model.Proxy, hostname host.Name) *model.ConsolidatedDestRule {
+	if c == nil {
+		return node.SidecarScope.DestinationRule(model.TrafficDirectionOutbound, node, hostname)
+	}
+	key := destinationRuleKey{hostname: hostname, namespace: node.SidecarScope.Namespace}
+	c.mu.RLock()
+	dr, f := c.rules[key]
+	c.mu.RUnlock()
+	if f {
+		return dr
+	}
+	dr = node.SidecarScope.DestinationRule(model.TrafficDirectionOutbound, node, hostname)
+	c.mu.Lock()
+	c.rules[key] = dr
+	c.mu.Unlock()
+	return dr
+}
+
 // hashForHTTPDestination return the ConsistentHashLB and the DestinationRule associated with HTTP route destination.
 func hashForHTTPDestination(push *model.PushContext, node *model.Proxy,
 	dst *networking.HTTPRouteDestination,
+	drs *destinationRuleCache,
 ) (*networking.LoadBalancerSettings_ConsistentHashLB, *model.ConsolidatedDestRule) {
 	if push == nil {
 		return nil, nil
 	}
 
 	destination := dst.GetDestination()
-	mergedDR := node.SidecarScope.DestinationRule(model.TrafficDirectionOutbound, node, host.Name(destination.Host))
+	mergedDR := drs.lookup(node, host.Name(destination.Host))
 	destinationRule := mergedDR.GetRule()
 	if destinationRule == nil {
 		return nil, nil
@@ -1330,6 +2687,8 @@ func hashForHTTPDestination(push *model.PushContext, node *model.Proxy,
 // isCatchAll returns true if HTTPMatchRequest is a catchall match otherwise
 // false. Note - this may not be exactly "catch all" as we don't know the full
 // class of possible inputs As such, this is used only for optimization.
+// A match on "/" that only sets a method is not catch all, so SortVHostRoutes keeps it
+// where its virtual service placed it.
 func isCatchAllMatch(m *networking.HTTPMatchRequest) bool {
 	catchall := false
 	if m.Uri != nil {
@@ -1337,11 +2696,11 @@ func isCatchAllMatch(m *networking.HTTPMatchRequest) bool {
 		case *networking.StringMatch_Prefix:
 			catchall = m.Prefix == "/"
 		case *networking.StringMatch_Regex:
-			catchall = m.Regex == "*"
+			catchall = isCatchAllRegex(m.Regex)
 		}
 	}
 	// A Match is catch all if and only if it has no match set
-	// and URI has a prefix / or regex *.
+	// and URI has a prefix / or a match all regex.
 	return catchall &&
 		len(m.Headers) == 0 &&
 		len(m.QueryParams) == 0 &&
@@ -1356,32 +2715,97 @@ func isCatchAllMatch(m *networking.HTTPMatchRequest) bool {
 }
 
 // SortVHostRoutes moves the catch all routes alone to the end, while retaining
-// the relative order of other routes in the slice.
+// the relative order of other routes in the slice. Maintenance routes are moved to the front,
+// as they take precedence over every other route. Routes that match every path but only for
+// some methods are not catch all: they keep the position their virtual service gave them, which
+// is the precedence its author chose, and so still come before the catch all routes of every
+// virtual service. Only the first catch all route can match; they keep the order in which their virtual
+// services were listed unless PILOT_SORT_CATCH_ALL_ROUTES_BY_VIRTUAL_SERVICE is set, in which case they
+// are ordered by the namespace and name of their virtual service, as recorded in the route metadata,
+// keeping the input order of the routes of the same virtual service. Catch all routes of unknown origin
+// then come last, ordered by route name.
 func SortVHostRoutes(routes []*route.Route) []*route.Route {
 	allroutes := make([]*route.Route, 0, len(routes))
+	maintenanceRoutes := make([]*route.Route, 0)
 	catchAllRoutes := make([]*route.Route, 0)
 	for _, r := range routes {
-		if isCatchAllRoute(r) {
+		if isMaintenanceRoute(r) {
+			maintenanceRoutes = append(maintenanceRoutes, r)
+		} else if isCatchAllRoute(r) {
 			catchAllRoutes = append(catchAllRoutes, r)
 		} else {
 			allroutes = append(allroutes, r)
 		}
 	}
-	return append(allroutes, catchAllRoutes...)
+	if features.SortCatchAllRoutesByVirtualService {
+		sortCatchAllRoutes(catchAllRoutes)
+	}
+	return append(append(maintenanceRoutes, allroutes...), catchAllRoutes...)
+}
+
+// sortCatchAllRoutes orders catch all routes by the namespace and name of their virtual service.
+func sortCatchAllRoutes(catchAllRoutes []*route.Route) {
+	sort.SliceStable(catchAllRoutes, func(i, j int) bool {
+		ns1, name1 := routeVirtualService(catchAllRoutes[i])
+		ns2, name2 := routeVirtualService(catchAllRoutes[j])
+		if (name1 == "") != (name2 == "") {
+			return name2 == ""
+		}
+		if name1 == "" {
+			return catchAllRoutes[i].Name < catchAllRoutes[j].Name
+		}
+		if ns1 != ns2 {
+			return ns1 < ns2
+		}
+		return name1 < name2
+	})
+}
+
+// routeVirtualService returns the namespace and name of the config a route was built from, as recorded in
+// its metadata by util.BuildConfigInfoMetadata, or empty strings if the route has no such metadata.
+func routeVirtualService(r *route.Route) (string, string) {
+	// e.g. /apis/networking.istio.io/v1alpha3/namespaces/default/virtual-service/reviews
+	cfg := r.GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()["config"].GetStringValue()
+	parts := strings.Split(cfg, "/")
+	if len(parts) != 8 || parts[4] != "namespaces" {
+		return "", ""
+	}
+	return parts[5], parts[7]
+}
+
+// isMaintenanceRoute returns true if an Envoy route was built by BuildMaintenanceRoute.
+func isMaintenanceRoute(r *route.Route) bool {
+	return r.GetMetadata().GetFilterMetadata()[util.IstioMetadataKey].GetFields()[maintenanceMetadataKey].GetBoolValue()
 }
 
 // isCatchAllRoute returns true if an Envoy route is a catchall route otherwise false.
 func isCatchAllRoute(r *route.Route) bool {
-	catchall := false
-	switch ir := r.Match.PathSpecifier.(type) {
+	// A Match is catch all if and only if it has no header/query param/gRPC/runtime fraction match
+	// and URI has a prefix / or a match all regex.
+	return isCatchAllPath(r.Match) && len(r.Match.Headers) == 0 && len(r.Match.QueryParameters) == 0 &&
+		len(r.Match.DynamicMetadata) == 0 && r.Match.Grpc == nil && r.Match.RuntimeFraction == nil
+}
+
+// isCatchAllPath returns true if the path specifier of the match accepts every path.
+func isCatchAllPath(m *route.RouteMatch) bool {
+	switch ir := m.PathSpecifier.(type) {
 	case *route.RouteMatch_Prefix:
-		catchall = ir.Prefix == "/"
+		return ir.Prefix == "/"
 	case *route.RouteMatch_PathSeparatedPrefix:
-		catchall = ir.PathSeparatedPrefix == "/"
+		return ir.PathSeparatedPrefix == "/"
 	case *route.RouteMatch_SafeRegex:
-		catchall = ir.SafeRegex.GetRegex() == "*"
+		return isCatchAllRegex(ir.SafeRegex.GetRegex())
 	}
-	// A Match is catch all if and only if it has no header/query param match
-	// and URI has a prefix / or regex *.
-	return catchall && len(r.Match.Headers) == 0 && len(r.Match.QueryParameters) == 0 && len(r.Match.DynamicMetadata) == 0
+	return false
+}
+
+// isCatchAllRegex returns true if the regex matches every path. Besides the RE2 match all ".*",
+// "*" is accepted as it has historically been treated as catch all. A case insensitive flag does not
+// change the paths matched.
+func isCatchAllRegex(regex string) bool {
+	switch strings.TrimPrefix(regex, caseInsensitiveRegexFlag) {
+	case "*", ".*", "^.*$":
+		return true
+	}
+	return false
 }
@@ -16,7 +16,9 @@ package route
 
 import (
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
@@ -25,13 +27,18 @@ import (
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	xdstype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/protobuf/types/known/durationpb"
 	wrappers "google.golang.org/protobuf/types/known/wrapperspb"
 
 	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	authzmatcher "istio.io/istio/pilot/pkg/security/authz/matcher"
 	authz "istio.io/istio/pilot/pkg/security/authz/model"
+	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/test"
 )
 
 func TestIsCatchAllMatch(t *testing.T) {
@@ -76,6 +83,42 @@ func TestIsCatchAllMatch(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "uri regex match all",
+			match: &networking.HTTPMatchRequest{
+				Name: "regex-match-all",
+				Uri: &networking.StringMatch{
+					MatchType: &networking.StringMatch_Regex{
+						Regex: ".*",
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "uri anchored regex match all",
+			match: &networking.HTTPMatchRequest{
+				Name: "regex-match-all",
+				Uri: &networking.StringMatch{
+					MatchType: &networking.StringMatch_Regex{
+						Regex: "^.*$",
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "uri regex with suffix",
+			match: &networking.HTTPMatchRequest{
+				Name: "regex-suffix",
+				Uri: &networking.StringMatch{
+					MatchType: &networking.StringMatch_Regex{
+						Regex: ".*foo",
+					},
+				},
+			},
+			want: false,
+		},
 		{
 			name: "uri regex with headers",
 			match: &networking.HTTPMatchRequest{
@@ -171,6 +214,51 @@ func TestIsCatchAllRoute(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "match all regex",
+			route: &route.Route{
+				Name: "catch-all",
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_SafeRegex{
+						SafeRegex: &matcher.RegexMatcher{
+							EngineType: util.RegexEngine,
+							Regex:      ".*",
+						},
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "anchored match all regex",
+			route: &route.Route{
+				Name: "catch-all",
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_SafeRegex{
+						SafeRegex: &matcher.RegexMatcher{
+							EngineType: util.RegexEngine,
+							Regex:      "^.*$",
+						},
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "case insensitive match all regex",
+			route: &route.Route{
+				Name: "catch-all",
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_SafeRegex{
+						SafeRegex: &matcher.RegexMatcher{
+							EngineType: util.RegexEngine,
+							Regex:      "(?i).*",
+						},
+					},
+				},
+			},
+			want: true,
+		},
 		{
 			name: "catch all prefix with headers",
 			route: &route.Route{
@@ -246,6 +334,34 @@ func TestIsCatchAllRoute(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "catch all prefix with gRPC match",
+			route: &route.Route{
+				Name: "grpc",
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_Prefix{
+						Prefix: "/",
+					},
+					Grpc: &route.RouteMatch_GrpcRouteMatchOptions{},
+				},
+			},
+			want: false,
+		},
+		{
+			name: "catch all prefix with runtime fraction",
+			route: &route.Route{
+				Name: "canary",
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_Prefix{
+						Prefix: "/",
+					},
+					RuntimeFraction: &core.RuntimeFractionalPercent{
+						DefaultValue: &xdstype.FractionalPercent{Numerator: 5},
+					},
+				},
+			},
+			want: false,
+		},
 	}
 
 	for _, tt := range cases {
@@ -667,10 +783,300 @@ func TestTranslateFault(t *testing.T) {
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			tf := translateFault(tt.fault)
+			tf := translateFault(tt.fault, nil)
 			if !reflect.DeepEqual(tf, tt.want) {
 				t.Errorf("Unexpected translate fault want %v, got %v", tt.want, tf)
 			}
 		})
 	}
 }
+
+func TestTranslateRouteMatchCaseSensitive(t *testing.T) {
+	cases := []struct {
+		name  string
+		match *networking.HTTPMatchRequest
+		want  *wrappers.BoolValue
+	}{
+		{
+			name: "header match with ignore uri case",
+			match: &networking.HTTPMatchRequest{
+				Headers: map[string]*networking.StringMatch{
+					"foo": {MatchType: &networking.StringMatch_Exact{Exact: "bar"}},
+				},
+				IgnoreUriCase: true,
+			},
+			want: nil,
+		},
+		{
+			name: "uri match without ignore uri case",
+			match: &networking.HTTPMatchRequest{
+				Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/foo"}},
+			},
+			want: &wrappers.BoolValue{Value: true},
+		},
+		{
+			name: "uri match with ignore uri case",
+			match: &networking.HTTPMatchRequest{
+				Uri:           &networking.StringMatch{MatchType: &networking.StringMatch_Exact{Exact: "/foo"}},
+				IgnoreUriCase: true,
+			},
+			want: &wrappers.BoolValue{Value: false},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			out := translateRouteMatch(&model.Proxy{}, config.Config{}, tt.match, emptyMatchExtension)
+			if !reflect.DeepEqual(out.CaseSensitive, tt.want) {
+				t.Errorf("Unexpected case sensitivity want %v, got %v", tt.want, out.CaseSensitive)
+			}
+		})
+	}
+}
+
+func TestTranslateRouteMatchIgnoreUriCaseRegex(t *testing.T) {
+	cases := []struct {
+		name          string
+		regex         string
+		ignoreUriCase bool
+		wantRegex     string
+		path          string
+		wantMatch     bool
+	}{
+		{
+			name:      "case sensitive",
+			regex:     "/foo/.*",
+			wantRegex: "/foo/.*",
+			path:      "/FOO/bar",
+			wantMatch: false,
+		},
+		{
+			name:          "ignore uri case",
+			regex:         "/foo/.*",
+			ignoreUriCase: true,
+			wantRegex:     "(?i)/foo/.*",
+			path:          "/FOO/bar",
+			wantMatch:     true,
+		},
+		{
+			name:          "match all regex",
+			regex:         ".*",
+			ignoreUriCase: true,
+			wantRegex:     ".*",
+			path:          "/FOO/bar",
+			wantMatch:     true,
+		},
+		{
+			name:          "already case insensitive",
+			regex:         "(?i)/foo/.*",
+			ignoreUriCase: true,
+			wantRegex:     "(?i)/foo/.*",
+			path:          "/Foo/bar",
+			wantMatch:     true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			out := translateRouteMatch(&model.Proxy{}, config.Config{}, &networking.HTTPMatchRequest{
+				Uri:           &networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: tt.regex}},
+				IgnoreUriCase: tt.ignoreUriCase,
+			}, emptyMatchExtension)
+			got := out.GetSafeRegex().GetRegex()
+			if got != tt.wantRegex {
+				t.Fatalf("Unexpected regex want %q, got %q", tt.wantRegex, got)
+			}
+			// Envoy matches the regex against the full path.
+			if match := regexp.MustCompile("^(?:" + got + ")$").MatchString(tt.path); match != tt.wantMatch {
+				t.Errorf("Unexpected match of %s want %v, got %v", tt.path, tt.wantMatch, match)
+			}
+		})
+	}
+}
+
+func TestApplyRedirectPort(t *testing.T) {
+	cases := []struct {
+		name     string
+		redirect *networking.HTTPRedirect
+		want     uint32
+	}{
+		{
+			name:     "no port",
+			redirect: &networking.HTTPRedirect{Uri: "/foo"},
+			want:     0,
+		},
+		{
+			name:     "explicit port",
+			redirect: &networking.HTTPRedirect{Uri: "/foo", RedirectPort: &networking.HTTPRedirect_Port{Port: 8443}},
+			want:     8443,
+		},
+		{
+			name: "from request port",
+			redirect: &networking.HTTPRedirect{
+				Uri:          "/foo",
+				RedirectPort: &networking.HTTPRedirect_DerivePort{DerivePort: networking.HTTPRedirect_FROM_REQUEST_PORT},
+			},
+			want: 8080,
+		},
+		{
+			name: "from protocol default to https",
+			redirect: &networking.HTTPRedirect{
+				Uri:          "/foo",
+				Scheme:       "https",
+				RedirectPort: &networking.HTTPRedirect_DerivePort{DerivePort: networking.HTTPRedirect_FROM_PROTOCOL_DEFAULT},
+			},
+			want: 443,
+		},
+		{
+			name: "from protocol default to http",
+			redirect: &networking.HTTPRedirect{
+				Uri:          "/foo",
+				Scheme:       "HTTP",
+				RedirectPort: &networking.HTTPRedirect_DerivePort{DerivePort: networking.HTTPRedirect_FROM_PROTOCOL_DEFAULT},
+			},
+			want: 80,
+		},
+		{
+			name: "from protocol default without scheme",
+			redirect: &networking.HTTPRedirect{
+				Uri:          "/foo",
+				RedirectPort: &networking.HTTPRedirect_DerivePort{DerivePort: networking.HTTPRedirect_FROM_PROTOCOL_DEFAULT},
+			},
+			want: 0,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &route.Route{}
+			applyRedirect(out, tt.redirect, 8080)
+			if got := out.GetRedirect().GetPortRedirect(); got != tt.want {
+				t.Errorf("Unexpected redirect port want %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIgnoredRouteActions(t *testing.T) {
+	destination := []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "foo"}}}
+	cases := []struct {
+		name  string
+		route *networking.HTTPRoute
+		want  []string
+	}{
+		{
+			name:  "route",
+			route: &networking.HTTPRoute{Route: destination},
+			want:  nil,
+		},
+		{
+			name:  "redirect",
+			route: &networking.HTTPRoute{Redirect: &networking.HTTPRedirect{Uri: "/foo"}},
+			want:  nil,
+		},
+		{
+			name:  "redirect and route",
+			route: &networking.HTTPRoute{Redirect: &networking.HTTPRedirect{Uri: "/foo"}, Route: destination},
+			want:  []string{"route"},
+		},
+		{
+			name: "all actions",
+			route: &networking.HTTPRoute{
+				Redirect:       &networking.HTTPRedirect{Uri: "/foo"},
+				DirectResponse: &networking.HTTPDirectResponse{Status: 503},
+				Route:          destination,
+			},
+			want: []string{"directResponse", "route"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ignoredRouteActions(tt.route); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unexpected ignored actions want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRedirectTakesPrecedenceOverRoute(t *testing.T) {
+	in := &networking.HTTPRoute{
+		Redirect: &networking.HTTPRedirect{Uri: "/foo"},
+		Route:    []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "foo"}}},
+	}
+	node := &model.Proxy{Metadata: &model.NodeMetadata{}}
+	out := translateRoute(node, in, nil, 8080, config.Config{}, nil, nil, nil, false, nil, nil)
+	if out.GetRedirect() == nil || out.GetRoute() != nil {
+		t.Errorf("expected the redirect to take precedence, got %v", out.Action)
+	}
+}
+
+func TestCookieHashPolicyTTL(t *testing.T) {
+	cookie := func(ttl *durationpb.Duration) *networking.LoadBalancerSettings_ConsistentHashLB {
+		return &networking.LoadBalancerSettings_ConsistentHashLB{
+			HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpCookie{
+				HttpCookie: &networking.LoadBalancerSettings_ConsistentHashLB_HTTPCookie{Name: "session", Ttl: ttl},
+			},
+		}
+	}
+	cases := []struct {
+		name       string
+		ttl        *durationpb.Duration
+		defaultTTL time.Duration
+		want       *durationpb.Duration
+	}{
+		{name: "explicit ttl", ttl: durationpb.New(10 * time.Second), defaultTTL: time.Hour, want: durationpb.New(10 * time.Second)},
+		{name: "default ttl", defaultTTL: time.Hour, want: durationpb.New(time.Hour)},
+		{name: "no ttl"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			test.SetForTest(t, &features.HashCookieDefaultTTL, tt.defaultTTL)
+			got := consistentHashToHashPolicy(cookie(tt.ttl)).GetCookie().GetTtl()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got ttl %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRouteOperation(t *testing.T) {
+	prefix := &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/api"}}
+	cases := []struct {
+		name string
+		in   *route.Route
+		want string
+	}{
+		{
+			name: "service cluster",
+			in: &route.Route{
+				Match:  prefix,
+				Action: &route.Route_Route{Route: &route.RouteAction{ClusterSpecifier: &route.RouteAction_Cluster{Cluster: "outbound|8080||foo.default.svc.cluster.local"}}},
+			},
+			want: "foo.default.svc.cluster.local:8080/api*",
+		},
+		{
+			name: "static cluster",
+			in: &route.Route{
+				Match:  prefix,
+				Action: &route.Route_Route{Route: &route.RouteAction{ClusterSpecifier: &route.RouteAction_Cluster{Cluster: "zipkin"}}},
+			},
+			want: "zipkin/api*",
+		},
+		{
+			name: "weighted clusters",
+			in: &route.Route{
+				Match:  prefix,
+				Action: &route.Route_Route{Route: &route.RouteAction{ClusterSpecifier: &route.RouteAction_WeightedClusters{}}},
+			},
+			want: "vs:80/api*",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getRouteOperation(tt.in, "vs", 80); got != tt.want {
+				t.Errorf("got operation %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -15,7 +15,14 @@
 package route_test
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +33,7 @@ import (
 	"google.golang.org/protobuf/types/known/durationpb"
 	wrappers "google.golang.org/protobuf/types/known/wrapperspb"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
@@ -38,6 +46,10 @@ import (
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/config/validation"
+	"istio.io/istio/pkg/test"
+	"istio.io/istio/pkg/test/util/assert"
+	"istio.io/pkg/log"
 )
 
 func TestBuildHTTPRoutes(t *testing.T) {
@@ -149,6 +161,30 @@ func TestBuildHTTPRoutes(t *testing.T) {
 		g.Expect(routes[0].GetRoute().MaxStreamDuration.GrpcTimeoutHeaderMax.Seconds).To(gomega.Equal(int64(0)))
 	})
 
+	t.Run("for virtual service with per-try timeout exceeding timeout", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+
+		routes, err := route.BuildHTTPRoutesForVirtualService(node(cg), virtualServiceWithConflictingPerTryTimeout, serviceRegistry, nil, 8080,
+			gatewayNames, false, nil)
+		xdstest.ValidateRoutes(t, routes)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		// Without clamping, the per-try timeout is left to be capped by Envoy.
+		g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout().AsDuration()).To(gomega.Equal(5 * time.Second))
+
+		clamp := features.ClampPerTryTimeout
+		features.ClampPerTryTimeout = true
+		defer func() { features.ClampPerTryTimeout = clamp }()
+
+		routes, err = route.BuildHTTPRoutesForVirtualService(node(cg), virtualServiceWithConflictingPerTryTimeout, serviceRegistry, nil, 8080,
+			gatewayNames, false, nil)
+		xdstest.ValidateRoutes(t, routes)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(routes[0].GetRoute().Timeout.AsDuration()).To(gomega.Equal(time.Second))
+		// The route timeout is split across the initial try and the 3 retries.
+		g.Expect(routes[0].GetRoute().GetRetryPolicy().GetPerTryTimeout().AsDuration()).To(gomega.Equal(250 * time.Millisecond))
+	})
+
 	t.Run("for virtual service with catch all route", func(t *testing.T) {
 		g := gomega.NewWithT(t)
 		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
@@ -920,6 +956,38 @@ func TestBuildHTTPRoutes(t *testing.T) {
 		}
 	})
 
+	t.Run("for weighted clusters summing to 1000", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+
+		routes, err := route.BuildHTTPRoutesForVirtualService(node(cg), virtualServiceWithFineGrainedWeights, serviceRegistry, nil, 8080,
+			gatewayNames, false, nil)
+		xdstest.ValidateRoutes(t, routes)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+
+		weightedCluster := routes[0].GetRoute().GetWeightedClusters()
+		g.Expect(weightedCluster.GetTotalWeight().GetValue()).To(gomega.Equal(uint32(1000)))
+		// The zero weighted destination is ignored as there are other clusters in the route.
+		g.Expect(len(weightedCluster.GetClusters())).To(gomega.Equal(2))
+		g.Expect(weightedCluster.GetClusters()[0].GetName()).To(gomega.Equal("outbound|8484|blue|*.example.org"))
+		g.Expect(weightedCluster.GetClusters()[0].GetWeight().GetValue()).To(gomega.Equal(uint32(995)))
+		g.Expect(weightedCluster.GetClusters()[1].GetName()).To(gomega.Equal("outbound|8484|green|*.example.org"))
+		g.Expect(weightedCluster.GetClusters()[1].GetWeight().GetValue()).To(gomega.Equal(uint32(5)))
+	})
+
+	t.Run("for single zero weighted cluster", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+
+		routes, err := route.BuildHTTPRoutesForVirtualService(node(cg), virtualServiceWithZeroWeight, serviceRegistry, nil, 8080,
+			gatewayNames, false, nil)
+		xdstest.ValidateRoutes(t, routes)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(routes)).To(gomega.Equal(1))
+		g.Expect(routes[0].GetRoute().GetCluster()).To(gomega.Equal("outbound|8484||*.example.org"))
+	})
+
 	t.Run("for redirect code", func(t *testing.T) {
 		g := gomega.NewWithT(t)
 		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
@@ -1031,6 +1099,26 @@ func TestBuildHTTPRoutes(t *testing.T) {
 		}
 		g.Expect(vhosts[0].Routes[0].Action.(*envoyroute.Route_Route).Route.HashPolicy).To(gomega.ConsistOf(hashPolicy))
 	})
+	t.Run("for no virtualservice forwards to the service by default", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{Services: exampleService})
+		vhosts := route.BuildSidecarVirtualHostWrapper(nil, node(cg), cg.PushContext(), serviceRegistry, []config.Config{}, 8080)
+		g.Expect(vhosts[0].Routes).To(gomega.HaveLen(1))
+		g.Expect(vhosts[0].Routes[0].Name).To(gomega.Equal(route.DefaultRouteName))
+		g.Expect(vhosts[0].Routes[0].GetRoute().GetCluster()).To(gomega.Equal("outbound|8080||*.example.org"))
+	})
+	t.Run("for no virtualservice denies with default route deny", func(t *testing.T) {
+		test.SetForTest(t, &features.DenyServicesWithoutVirtualService, true)
+		g := gomega.NewWithT(t)
+		cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{Services: exampleService})
+		vhosts := route.BuildSidecarVirtualHostWrapper(nil, node(cg), cg.PushContext(), serviceRegistry, []config.Config{}, 8080)
+		xdstest.ValidateRoutes(t, vhosts[0].Routes)
+		g.Expect(vhosts[0].Routes).To(gomega.HaveLen(1))
+		g.Expect(vhosts[0].Routes[0].Name).To(gomega.Equal(route.DefaultRouteName))
+		g.Expect(vhosts[0].Routes[0].GetMatch().GetPrefix()).To(gomega.Equal("/"))
+		g.Expect(vhosts[0].Routes[0].GetRoute()).To(gomega.BeNil())
+		g.Expect(vhosts[0].Routes[0].GetDirectResponse().GetStatus()).To(gomega.Equal(uint32(http.StatusNotFound)))
+	})
 }
 
 func loadBalancerPolicy(name string) *networking.LoadBalancerSettings_ConsistentHash {
@@ -1171,6 +1259,37 @@ var virtualServiceWithTimeoutDisabled = config.Config{
 	},
 }
 
+var virtualServiceWithConflictingPerTryTimeout = config.Config{
+	Meta: config.Meta{
+		GroupVersionKind: gvk.VirtualService,
+		Name:             "acme",
+	},
+	Spec: &networking.VirtualService{
+		Hosts:    []string{},
+		Gateways: []string{"some-gateway"},
+		Http: []*networking.HTTPRoute{
+			{
+				Route: []*networking.HTTPRouteDestination{
+					{
+						Destination: &networking.Destination{
+							Host: "*.example.org",
+							Port: &networking.PortSelector{
+								Number: 8484,
+							},
+						},
+						Weight: 100,
+					},
+				},
+				Timeout: durationpb.New(time.Second),
+				Retries: &networking.HTTPRetry{
+					Attempts:      3,
+					PerTryTimeout: durationpb.New(5 * time.Second),
+				},
+			},
+		},
+	},
+}
+
 var virtualServiceWithCatchAllRoute = config.Config{
 	Meta: config.Meta{
 		GroupVersionKind: gvk.VirtualService,
@@ -1496,6 +1615,78 @@ var virtualServiceWithHeaderOperationsForWeightedCluster = config.Config{
 	},
 }
 
+var virtualServiceWithFineGrainedWeights = config.Config{
+	Meta: config.Meta{
+		GroupVersionKind: gvk.VirtualService,
+		Name:             "acme",
+	},
+	Spec: &networking.VirtualService{
+		Hosts:    []string{},
+		Gateways: []string{"some-gateway"},
+		Http: []*networking.HTTPRoute{
+			{
+				Route: []*networking.HTTPRouteDestination{
+					{
+						Destination: &networking.Destination{
+							Host:   "*.example.org",
+							Subset: "blue",
+							Port: &networking.PortSelector{
+								Number: 8484,
+							},
+						},
+						Weight: 995,
+					},
+					{
+						Destination: &networking.Destination{
+							Host:   "*.example.org",
+							Subset: "green",
+							Port: &networking.PortSelector{
+								Number: 8484,
+							},
+						},
+						Weight: 5,
+					},
+					{
+						Destination: &networking.Destination{
+							Host:   "*.example.org",
+							Subset: "red",
+							Port: &networking.PortSelector{
+								Number: 8484,
+							},
+						},
+						Weight: 0,
+					},
+				},
+			},
+		},
+	},
+}
+
+var virtualServiceWithZeroWeight = config.Config{
+	Meta: config.Meta{
+		GroupVersionKind: gvk.VirtualService,
+		Name:             "acme",
+	},
+	Spec: &networking.VirtualService{
+		Hosts:    []string{},
+		Gateways: []string{"some-gateway"},
+		Http: []*networking.HTTPRoute{
+			{
+				Route: []*networking.HTTPRouteDestination{
+					{
+						Destination: &networking.Destination{
+							Host: "*.example.org",
+							Port: &networking.PortSelector{
+								Number: 8484,
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
 var virtualServiceWithRedirect = config.Config{
 	Meta: config.Meta{
 		GroupVersionKind: gvk.VirtualService,
@@ -2038,6 +2229,176 @@ var networkingSubsetWithPortLevelSettings = &networking.Subset{
 	},
 }
 
+func TestSortVHostRoutesCatchAllInputOrder(t *testing.T) {
+	catchAll := func(name string) *envoyroute.Route {
+		return &envoyroute.Route{Name: name, Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}}
+	}
+	// By default catch all routes keep the order in which their virtual services were listed.
+	in := []*envoyroute.Route{catchAll("b-default"), catchAll(""), catchAll("a-default")}
+	got := route.SortVHostRoutes(in)
+	assert.Equal(t, []string{got[0].Name, got[1].Name, got[2].Name}, []string{"b-default", "", "a-default"})
+}
+
+func TestSortVHostRoutesCatchAllOrder(t *testing.T) {
+	test.SetForTest(t, &features.SortCatchAllRoutesByVirtualService, true)
+	catchAll := func(name string) *envoyroute.Route {
+		return &envoyroute.Route{Name: name, Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}}
+	}
+	path := func(name, p string) *envoyroute.Route {
+		return &envoyroute.Route{Name: name, Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: p}}}
+	}
+	names := func(routes []*envoyroute.Route) []string {
+		out := make([]string, 0, len(routes))
+		for _, r := range routes {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+
+	// Catch all routes without virtual service metadata, listed in any order, are sorted by name.
+	vsA := []*envoyroute.Route{path("a-path", "/a"), catchAll("a-default")}
+	vsB := []*envoyroute.Route{path("b-path", "/b"), catchAll("b-default")}
+	vsC := []*envoyroute.Route{catchAll("c-default")}
+	permutations := [][][]*envoyroute.Route{
+		{vsA, vsB, vsC},
+		{vsC, vsB, vsA},
+		{vsB, vsC, vsA},
+	}
+	for _, p := range permutations {
+		var routes []*envoyroute.Route
+		for _, vs := range p {
+			routes = append(routes, vs...)
+		}
+		got := names(route.SortVHostRoutes(routes))
+		// The catch all routes come after the two path routes.
+		assert.Equal(t, got[2:], []string{"a-default", "b-default", "c-default"})
+	}
+
+	// Catch all routes of unknown origin with the same name keep their input order.
+	first, second := catchAll("default"), catchAll("default")
+	got := route.SortVHostRoutes([]*envoyroute.Route{first, path("path", "/path"), second})
+	if got[1] != first || got[2] != second {
+		t.Errorf("catch all routes with the same name were reordered")
+	}
+
+	// Catch all routes of virtual services are ordered by the namespace and name of their virtual service,
+	// whatever their route names, and keep their input order within a virtual service.
+	fromVirtualService := func(r *envoyroute.Route, namespace, name string) *envoyroute.Route {
+		r.Metadata = util.BuildConfigInfoMetadata(config.Meta{GroupVersionKind: gvk.VirtualService, Namespace: namespace, Name: name})
+		return r
+	}
+	for _, p := range [][]*envoyroute.Route{
+		{
+			catchAll("unknown"),
+			fromVirtualService(catchAll("z"), "team-b", "api"),
+			fromVirtualService(catchAll(""), "team-b", "web"),
+			fromVirtualService(catchAll("y"), "team-a", "web"),
+			fromVirtualService(catchAll("x"), "team-a", "web"),
+		},
+		{
+			fromVirtualService(catchAll(""), "team-b", "web"),
+			fromVirtualService(catchAll("y"), "team-a", "web"),
+			fromVirtualService(catchAll("z"), "team-b", "api"),
+			catchAll("unknown"),
+			fromVirtualService(catchAll("x"), "team-a", "web"),
+		},
+	} {
+		assert.Equal(t, names(route.SortVHostRoutes(p)), []string{"y", "x", "z", "", "unknown"})
+	}
+}
+
+func TestSortVHostRoutesMethodCatchAll(t *testing.T) {
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+	destination := func(subset string) []*networking.HTTPRouteDestination {
+		return []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "*.example.org", Subset: subset}}}
+	}
+	vs := config.Config{
+		Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme", Namespace: "default"},
+		Spec: &networking.VirtualService{
+			Hosts: []string{"*.example.org"},
+			Http: []*networking.HTTPRoute{
+				{
+					Name: "get",
+					Match: []*networking.HTTPMatchRequest{{
+						Uri:    &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/"}},
+						Method: &networking.StringMatch{MatchType: &networking.StringMatch_Exact{Exact: "GET"}},
+					}},
+					Route: destination("a"),
+				},
+				{
+					Name: "foo",
+					Match: []*networking.HTTPMatchRequest{{
+						Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/foo"}},
+					}},
+					Route: destination("b"),
+				},
+			},
+		},
+	}
+	routes, err := route.BuildHTTPRoutes(vs, route.RouteOptions{
+		Node: cg.SetupProxy(nil),
+		Push: cg.PushContext(),
+		ServiceRegistry: map[host.Name]*model.Service{
+			"*.example.org": {
+				Hostname:       "*.example.org",
+				DefaultAddress: "1.1.1.1",
+				Ports:          model.PortList{{Name: "default", Port: 8080, Protocol: protocol.HTTP}},
+			},
+		},
+		ListenPort:   8080,
+		GatewayNames: map[string]bool{constants.IstioMeshGateway: true},
+	})
+	assert.NoError(t, err)
+
+	// The GET catch all of the virtual service precedes its /foo route, so GET /foo still goes to subset a.
+	var got []string
+	for _, r := range route.SortVHostRoutes(routes) {
+		got = append(got, r.Name)
+	}
+	assert.Equal(t, got, []string{"get", "foo"})
+}
+
+func TestSortVHostRoutesCaseInsensitiveCatchAll(t *testing.T) {
+	for _, regex := range []string{".*", "^.*$", "(?i).*"} {
+		t.Run(regex, func(t *testing.T) {
+			in := &networking.HTTPRoute{
+				Name: "catch-all",
+				Match: []*networking.HTTPMatchRequest{{
+					Uri:           &networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: regex}},
+					IgnoreUriCase: true,
+				}},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			catchAll := buildRoutesWithExtensions(t, in, nil)[0]
+			// A specific route of a virtual service listed after the one of the catch all is not shadowed.
+			specific := &envoyroute.Route{Name: "specific", Match: &envoyroute.RouteMatch{
+				PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/specific"},
+			}}
+			got := route.SortVHostRoutes([]*envoyroute.Route{catchAll, specific})
+			assert.Equal(t, []string{got[0].Name, got[1].Name}, []string{"specific", "catch-all"})
+		})
+	}
+}
+
+func TestSortVHostRoutesMaintenance(t *testing.T) {
+	specific := &envoyroute.Route{Name: "specific", Match: &envoyroute.RouteMatch{
+		PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/specific"},
+	}}
+	// A route of a virtual service that happens to be named like the maintenance route keeps its position.
+	user := buildRoutesWithExtensions(t, &networking.HTTPRoute{
+		Name:           route.MaintenanceRouteName,
+		Match:          []*networking.HTTPMatchRequest{{Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/api"}}}},
+		DirectResponse: &networking.HTTPDirectResponse{Status: 503},
+	}, nil)[0]
+	got := route.SortVHostRoutes([]*envoyroute.Route{specific, user})
+	assert.Equal(t, []*envoyroute.Route{got[0], got[1]}, []*envoyroute.Route{specific, user})
+
+	// The route built for a virtual service under maintenance goes first.
+	maintenance := route.BuildMaintenanceRoute(config.Config{}, &route.Maintenance{Prefix: "/api"}, 8080)
+	got = route.SortVHostRoutes([]*envoyroute.Route{specific, maintenance})
+	assert.Equal(t, []*envoyroute.Route{got[0], got[1]}, []*envoyroute.Route{maintenance, specific})
+}
+
 func TestSortVHostRoutes(t *testing.T) {
 	regexEngine := &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}}
 	first := []*envoyroute.Route{
@@ -2118,16 +2479,91 @@ func TestSortVHostRoutes(t *testing.T) {
 		}},
 	}
 
+	maintenance := route.BuildMaintenanceRoute(virtualServicePlain, &route.Maintenance{Body: "down"}, 8080)
+	third := []*envoyroute.Route{
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path1"}}},
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}},
+		maintenance,
+	}
+	wantThird := []*envoyroute.Route{
+		maintenance,
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path1"}}},
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}},
+	}
+
+	matchAllRegex := func(regex string) *envoyroute.Route {
+		return &envoyroute.Route{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{
+				EngineType: regexEngine,
+				Regex:      regex,
+			},
+		}}}
+	}
+	fourth := []*envoyroute.Route{
+		matchAllRegex(".*"),
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path1"}}},
+		matchAllRegex("^.*$"),
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/prefix1"}}},
+	}
+	wantFourth := []*envoyroute.Route{
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path1"}}},
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/prefix1"}}},
+		matchAllRegex(".*"),
+		matchAllRegex("^.*$"),
+	}
+
+	methodRoute := func(path, method string) *envoyroute.Route {
+		return &envoyroute.Route{Match: &envoyroute.RouteMatch{
+			PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: path},
+			Headers: []*envoyroute.HeaderMatcher{{
+				Name: route.HeaderMethod,
+				HeaderMatchSpecifier: &envoyroute.HeaderMatcher_StringMatch{
+					StringMatch: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: method}},
+				},
+			}},
+		}}
+	}
+	// A "/" route matching only GET keeps its position among the specific routes, as the order of
+	// the routes of a virtual service is the precedence chosen by its author, but still comes before
+	// the catch all route.
+	fifth := []*envoyroute.Route{
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}},
+		methodRoute("/", "GET"),
+		methodRoute("/path1", "GET"),
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path2"}}},
+	}
+	wantFifth := []*envoyroute.Route{
+		methodRoute("/", "GET"),
+		methodRoute("/path1", "GET"),
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Path{Path: "/path2"}}},
+		{Match: &envoyroute.RouteMatch{PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/"}}},
+	}
+
 	testCases := []struct {
 		name     string
 		in       []*envoyroute.Route
 		expected []*envoyroute.Route
 	}{
+		{
+			name:     "routes with method catchall match",
+			in:       fifth,
+			expected: wantFifth,
+		},
 		{
 			name:     "routes with catchall match",
 			in:       first,
 			expected: wantFirst,
 		},
+		{
+			name:     "routes with match all regex",
+			in:       fourth,
+			expected: wantFourth,
+		},
+		{
+			name:     "routes with maintenance route",
+			in:       third,
+			expected: wantThird,
+		},
 		{
 			name:     "routes without catchall match",
 			in:       second,
@@ -2152,3 +2588,778 @@ func TestSortVHostRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildRouteMatch(t *testing.T) {
+	match := &networking.HTTPMatchRequest{
+		Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/api"}},
+		Headers: map[string]*networking.StringMatch{
+			"x-user": {MatchType: &networking.StringMatch_Exact{Exact: "alice"}},
+		},
+		QueryParams: map[string]*networking.StringMatch{
+			"debug": {MatchType: &networking.StringMatch_Exact{Exact: "true"}},
+		},
+		IgnoreUriCase: true,
+	}
+	want := &envoyroute.RouteMatch{
+		PathSpecifier: &envoyroute.RouteMatch_Prefix{Prefix: "/api"},
+		CaseSensitive: &wrappers.BoolValue{Value: false},
+		Headers: []*envoyroute.HeaderMatcher{{
+			Name: "x-user",
+			HeaderMatchSpecifier: &envoyroute.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: "alice"}},
+			},
+		}},
+		QueryParameters: []*envoyroute.QueryParameterMatcher{{
+			Name: "debug",
+			QueryParameterMatchSpecifier: &envoyroute.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: "true"}},
+			},
+		}},
+	}
+	assert.Equal(t, route.BuildRouteMatch(match, &model.Proxy{}), want)
+}
+
+func TestBuildHTTPFault(t *testing.T) {
+	cases := []struct {
+		name    string
+		fault   *networking.HTTPFaultInjection
+		wantErr bool
+	}{
+		{
+			name: "http abort",
+			fault: &networking.HTTPFaultInjection{
+				Abort: &networking.HTTPFaultInjection_Abort{
+					ErrorType: &networking.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: 503},
+				},
+			},
+		},
+		{
+			name: "unsupported abort",
+			fault: &networking.HTTPFaultInjection{
+				Abort: &networking.HTTPFaultInjection_Abort{
+					ErrorType: &networking.HTTPFaultInjection_Abort_Http2Error{Http2Error: "CANCEL"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported abort with a delay",
+			fault: &networking.HTTPFaultInjection{
+				Delay: &networking.HTTPFaultInjection_Delay{
+					HttpDelayType: &networking.HTTPFaultInjection_Delay_FixedDelay{FixedDelay: durationpb.New(time.Second)},
+				},
+				Abort: &networking.HTTPFaultInjection_Abort{},
+			},
+			wantErr: true,
+		},
+		{
+			name: "exponential delay",
+			fault: &networking.HTTPFaultInjection{
+				Delay: &networking.HTTPFaultInjection_Delay{
+					HttpDelayType: &networking.HTTPFaultInjection_Delay_ExponentialDelay{ExponentialDelay: durationpb.New(time.Second)},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fault, err := route.BuildHTTPFault(tt.fault)
+			if tt.wantErr {
+				assert.Error(t, err)
+				if fault != nil {
+					t.Errorf("expected no fault, got %v", fault)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if fault == nil {
+				t.Errorf("expected a fault")
+			}
+		})
+	}
+}
+
+func TestBuildHTTPRoutesWithOptions(t *testing.T) {
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+	node := cg.SetupProxy(&model.Proxy{
+		Type:        model.SidecarProxy,
+		IPAddresses: []string{"1.1.1.1"},
+		ID:          "someID",
+		DNSDomain:   "foo.com",
+	})
+	serviceRegistry := map[host.Name]*model.Service{
+		"*.example.org": {
+			Hostname:       "*.example.org",
+			DefaultAddress: "1.1.1.1",
+			Ports:          model.PortList{{Name: "default", Port: 8080, Protocol: protocol.HTTP}},
+		},
+	}
+	gatewayNames := map[string]bool{"some-gateway": true}
+
+	// BuildHTTPRoutesForVirtualService keeps the signature of previous releases for existing callers.
+	var buildForVirtualService func(*model.Proxy, config.Config, map[host.Name]*model.Service, route.DestinationHashMap,
+		int, map[string]bool, bool, *meshconfig.MeshConfig) ([]*envoyroute.Route, error) = route.BuildHTTPRoutesForVirtualService
+	want, err := buildForVirtualService(node, virtualServicePlain, serviceRegistry, nil, 8080,
+		gatewayNames, true, cg.PushContext().Mesh)
+	assert.NoError(t, err)
+
+	t.Run("mesh", func(t *testing.T) {
+		got, err := route.BuildHTTPRoutes(virtualServicePlain, route.RouteOptions{
+			Node:                      node,
+			ServiceRegistry:           serviceRegistry,
+			ListenPort:                8080,
+			GatewayNames:              gatewayNames,
+			IsHTTP3AltSvcHeaderNeeded: true,
+			Mesh:                      cg.PushContext().Mesh,
+		})
+		assert.NoError(t, err)
+		xdstest.ValidateRoutes(t, got)
+		assert.Equal(t, got, want)
+	})
+	t.Run("mesh from push", func(t *testing.T) {
+		got, err := route.BuildHTTPRoutes(virtualServicePlain, route.RouteOptions{
+			Node:                      node,
+			Push:                      cg.PushContext(),
+			ServiceRegistry:           serviceRegistry,
+			ListenPort:                8080,
+			GatewayNames:              gatewayNames,
+			IsHTTP3AltSvcHeaderNeeded: true,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, got, want)
+	})
+}
+
+func TestBuildHTTPRoutesErrors(t *testing.T) {
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+	opts := route.RouteOptions{
+		Node:         cg.SetupProxy(nil),
+		ListenPort:   8080,
+		GatewayNames: map[string]bool{"some-gateway": true},
+	}
+
+	t.Run("not a virtual service", func(t *testing.T) {
+		_, err := route.BuildHTTPRoutes(config.Config{Spec: &networking.Gateway{}}, opts)
+		if !errors.Is(err, route.ErrNotVirtualService) {
+			t.Fatalf("expected ErrNotVirtualService, got %v", err)
+		}
+	})
+	t.Run("no routes matched", func(t *testing.T) {
+		vs := config.Config{
+			Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme"},
+			Spec: &networking.VirtualService{
+				Hosts: []string{"*.example.org"},
+				Http: []*networking.HTTPRoute{{
+					Match: []*networking.HTTPMatchRequest{{Gateways: []string{"other-gateway"}}},
+					Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "*.example.org"}}},
+				}},
+			},
+		}
+		_, err := route.BuildHTTPRoutes(vs, opts)
+		if !errors.Is(err, route.ErrNoRoutesMatched) {
+			t.Fatalf("expected ErrNoRoutesMatched, got %v", err)
+		}
+		if err.Error() != "no routes matched" {
+			t.Fatalf("unexpected message %q", err)
+		}
+	})
+}
+
+func TestBuildHTTPRoutesDelegate(t *testing.T) {
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{})
+	prefix := func(p string) []*networking.HTTPMatchRequest {
+		return []*networking.HTTPMatchRequest{{Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: p}}}}
+	}
+	virtualService := func(name string, hosts []string, routes ...*networking.HTTPRoute) config.Config {
+		return config.Config{
+			Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: name, Namespace: "default"},
+			Spec: &networking.VirtualService{Hosts: hosts, Http: routes},
+		}
+	}
+	resolver := func(configs ...config.Config) route.DelegateResolver {
+		return func(name, namespace string) (config.Config, bool) {
+			for _, c := range configs {
+				if c.Name == name && c.Namespace == namespace {
+					return c, true
+				}
+			}
+			return config.Config{}, false
+		}
+	}
+	root := virtualService("root", []string{"*.example.org"}, &networking.HTTPRoute{
+		Name:     "api",
+		Match:    prefix("/api"),
+		Delegate: &networking.Delegate{Name: "api"},
+	})
+
+	t.Run("one level", func(t *testing.T) {
+		delegate := virtualService("api", nil,
+			&networking.HTTPRoute{
+				Name:  "v1",
+				Match: prefix("/api/v1"),
+				Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "v1.example.org"}}},
+			},
+			&networking.HTTPRoute{
+				Name:  "default",
+				Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "default.example.org"}}},
+			},
+		)
+		routes, err := route.BuildHTTPRoutes(root, route.RouteOptions{
+			Node:            cg.SetupProxy(nil),
+			ListenPort:      80,
+			GatewayNames:    map[string]bool{constants.IstioMeshGateway: true},
+			ResolveDelegate: resolver(delegate),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The delegate routes are inlined under the root match.
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.Name+" "+r.GetMatch().GetPrefix())
+		}
+		assert.Equal(t, got, []string{"api-v1 /api/v1", "api-default /api"})
+		// The delegate itself is left untouched.
+		assert.Equal(t, delegate.Spec.(*networking.VirtualService).Http[1].Match == nil, true)
+	})
+	t.Run("self-referential cycle", func(t *testing.T) {
+		delegate := virtualService("api", nil, &networking.HTTPRoute{
+			Match:    prefix("/api/v1"),
+			Delegate: &networking.Delegate{Name: "api"},
+		})
+		_, err := route.BuildHTTPRoutes(root, route.RouteOptions{
+			Node:            cg.SetupProxy(nil),
+			ListenPort:      80,
+			GatewayNames:    map[string]bool{constants.IstioMeshGateway: true},
+			ResolveDelegate: resolver(delegate),
+		})
+		if !errors.Is(err, route.ErrDelegateCycle) {
+			t.Fatalf("expected ErrDelegateCycle, got %v", err)
+		}
+	})
+}
+
+func TestRegexMaxProgramSize(t *testing.T) {
+	match := &networking.HTTPMatchRequest{
+		Uri: &networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: "/foo/.*"}},
+		Headers: map[string]*networking.StringMatch{
+			"x-user": {MatchType: &networking.StringMatch_Regex{Regex: "alice|bob"}},
+		},
+	}
+	engines := func(m *envoyroute.RouteMatch) []*matcher.RegexMatcher_GoogleRE2 {
+		return []*matcher.RegexMatcher_GoogleRE2{
+			m.GetSafeRegex().GetGoogleRe2(),
+			m.GetHeaders()[0].GetStringMatch().GetSafeRegex().GetGoogleRe2(),
+		}
+	}
+
+	for _, engine := range engines(route.BuildRouteMatch(match, &model.Proxy{})) {
+		// nolint: staticcheck
+		if engine.GetMaxProgramSize() != nil {
+			t.Errorf("expected no max program size by default, got %v", engine.GetMaxProgramSize())
+		}
+	}
+
+	test.SetForTest(t, &features.RegexMaxProgramSize, 1024)
+	for _, engine := range engines(route.BuildRouteMatch(match, &model.Proxy{})) {
+		// nolint: staticcheck
+		if got := engine.GetMaxProgramSize().GetValue(); got != 1024 {
+			t.Errorf("expected max program size 1024, got %d", got)
+		}
+	}
+}
+
+func TestSingleClusterHeaderMerge(t *testing.T) {
+	headers := func(set, add map[string]string, remove ...string) *networking.Headers {
+		return &networking.Headers{
+			Request:  &networking.Headers_HeaderOperations{Set: set, Add: add, Remove: remove},
+			Response: &networking.Headers_HeaderOperations{Set: set, Add: add, Remove: remove},
+		}
+	}
+	dst := exampleDestination(100)
+	dst.Headers = headers(map[string]string{"x-set": "cluster"}, map[string]string{"x-add": "1", "x-other": "cluster"}, "x-remove")
+	in := &networking.HTTPRoute{
+		Headers: headers(map[string]string{"x-set": "route"}, map[string]string{"x-add": "1", "x-other": "route"}, "x-remove"),
+		Route:   []*networking.HTTPRouteDestination{dst},
+	}
+	r := buildRoutesWithExtensions(t, in, nil)[0]
+
+	for _, ops := range [][]*core.HeaderValueOption{r.RequestHeadersToAdd, r.ResponseHeadersToAdd} {
+		got := map[string][]string{}
+		for _, o := range ops {
+			got[o.Header.Key] = append(got[o.Header.Key], o.Header.Value)
+		}
+		assert.Equal(t, got, map[string][]string{
+			// The cluster set wins over the route set.
+			"x-set": {"cluster"},
+			// The same value added by both is only added once.
+			"x-add": {"1"},
+			// Different values added by both are all added.
+			"x-other": {"route", "cluster"},
+		})
+	}
+	assert.Equal(t, r.RequestHeadersToRemove, []string{"x-remove"})
+	assert.Equal(t, r.ResponseHeadersToRemove, []string{"x-remove"})
+}
+
+func TestWeightedClustersOrder(t *testing.T) {
+	subset := func(name string, weight int32) *networking.HTTPRouteDestination {
+		dst := exampleDestination(weight)
+		dst.Destination.Subset = name
+		return dst
+	}
+	build := func(destinations ...*networking.HTTPRouteDestination) []string {
+		r := buildRoutesWithExtensions(t, &networking.HTTPRoute{Route: destinations}, nil)[0]
+		var out []string
+		for _, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+			out = append(out, fmt.Sprintf("%s=%d", c.Name, c.Weight.GetValue()))
+		}
+		return out
+	}
+	// The same destinations listed in a different order produce the same clusters.
+	want := build(subset("v1", 50), subset("v2", 30), subset("v3", 20))
+	assert.Equal(t, build(subset("v3", 20), subset("v1", 50), subset("v2", 30)), want)
+	assert.Equal(t, want, []string{
+		"outbound|8484|v1|*.example.org=50",
+		"outbound|8484|v2|*.example.org=30",
+		"outbound|8484|v3|*.example.org=20",
+	})
+}
+
+func TestUnknownDestinationHostWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{path}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = log.Configure(log.DefaultOptions())
+	})
+	build := func(hostname string) (*envoyroute.Route, string) {
+		t.Helper()
+		dst := exampleDestination(100)
+		dst.Destination.Host = hostname
+		r := buildRoutesWithExtensions(t, &networking.HTTPRoute{Route: []*networking.HTTPRouteDestination{dst}}, nil)[0]
+		_ = log.Sync()
+		logs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, string(logs)
+	}
+
+	_, logs := build("*.example.org")
+	if strings.Contains(logs, "destination host not found") {
+		t.Fatalf("unexpected warning for a known host: %s", logs)
+	}
+
+	// The route is still built for an unknown host, typically a typo, but a warning names the host.
+	r, logs := build("typo.example.com")
+	assert.Equal(t, r.GetRoute().GetCluster(), "outbound|8484||typo.example.com")
+	if !strings.Contains(logs, "destination host not found") || !strings.Contains(logs, "host=typo.example.com") ||
+		!strings.Contains(logs, "virtualservice=/acme") {
+		t.Fatalf("expected a warning for the unknown host, got: %s", logs)
+	}
+}
+
+func TestMirrorPercentWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{path}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = log.Configure(log.DefaultOptions())
+	})
+	in := &networking.HTTPRoute{
+		Name:             "mirrored",
+		Route:            []*networking.HTTPRouteDestination{exampleDestination(100)},
+		Mirror:           &networking.Destination{Host: "*.example.org"},
+		MirrorPercent:    &wrappers.UInt32Value{Value: 10}, // nolint: staticcheck
+		MirrorPercentage: &networking.Percent{Value: 50},
+	}
+	r := buildRoutesWithExtensions(t, in, nil)[0]
+	_ = log.Sync()
+	logs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The warning names the virtual service, as the route name alone is not unique.
+	if !strings.Contains(string(logs), `virtual service /acme route "mirrored" sets both mirrorPercent and mirrorPercentage`) {
+		t.Fatalf("expected a warning naming the virtual service, got: %s", logs)
+	}
+	assert.Equal(t, r.GetRoute().GetRequestMirrorPolicies()[0].GetRuntimeFraction().GetDefaultValue().GetNumerator(), uint32(500000))
+}
+
+func TestHeaderValueCommandOperators(t *testing.T) {
+	g := gomega.NewWithT(t)
+	in := &networking.HTTPRoute{
+		Headers: &networking.Headers{
+			Request: &networking.Headers_HeaderOperations{
+				Set: map[string]string{"x-pod": "%ENVIRONMENT(POD_NAME)%"},
+				Add: map[string]string{"x-zone": "zone=%UPSTREAM_METADATA([\"istio\", \"zone\"])%"},
+			},
+		},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	// Command operators are passed through unescaped, for the Envoy header formatter to expand them.
+	routes := buildRoutesWithExtensions(t, in, nil)
+	got := map[string]string{}
+	for _, h := range routes[0].GetRequestHeadersToAdd() {
+		got[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	g.Expect(got).To(gomega.Equal(map[string]string{
+		"x-pod":  "%ENVIRONMENT(POD_NAME)%",
+		"x-zone": "zone=%UPSTREAM_METADATA([\"istio\", \"zone\"])%",
+	}))
+}
+
+func TestHeaderValueEscaping(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{value: "50% off", want: "50%% off"},
+		{value: "100%%", want: "100%%"},
+		{value: "%REQ(x-user)%", want: "%REQ(x-user)%"},
+		{value: "%DOWNSTREAM_REMOTE_ADDRESS% is 100% trusted", want: "%DOWNSTREAM_REMOTE_ADDRESS% is 100%% trusted"},
+		{value: "%lowercase%", want: "%%lowercase%%"},
+		{value: "trailing %", want: "trailing %%"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Headers: &networking.Headers{
+					Response: &networking.Headers_HeaderOperations{Set: map[string]string{"x-promo": tt.value}},
+				},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			routes := buildRoutesWithExtensions(t, in, nil)
+			g.Expect(routes[0].GetResponseHeadersToAdd()).To(gomega.HaveLen(1))
+			g.Expect(routes[0].GetResponseHeadersToAdd()[0].GetHeader().GetValue()).To(gomega.Equal(tt.want))
+		})
+	}
+}
+
+func TestHeaderValueValidationAndEscaping(t *testing.T) {
+	// Validation and translation agree: values the validation accepts without warning are sent verbatim,
+	// values it warns about are escaped into literals, and values it rejects never reach translation.
+	cases := []struct {
+		value   string
+		invalid bool
+		warning bool
+		want    string
+	}{
+		{value: "%ENVIRONMENT(POD_NAME)%", want: "%ENVIRONMENT(POD_NAME)%"},
+		{value: "100%%", want: "100%%"},
+		{value: "a%b%c", warning: true, want: "a%%b%%c"},
+		{value: "%hostname%", warning: true, want: "%%hostname%%"},
+		{value: "50% off", invalid: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			g := gomega.NewWithT(t)
+			in := &networking.HTTPRoute{
+				Headers: &networking.Headers{
+					Response: &networking.Headers_HeaderOperations{Set: map[string]string{"x-promo": tt.value}},
+				},
+				Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			warn, err := validation.ValidateVirtualService(config.Config{
+				Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme", Namespace: "default"},
+				Spec: &networking.VirtualService{Hosts: []string{"*.example.org"}, Http: []*networking.HTTPRoute{in}},
+			})
+			g.Expect(err != nil).To(gomega.Equal(tt.invalid))
+			g.Expect(warn != nil).To(gomega.Equal(tt.warning))
+			if tt.invalid {
+				return
+			}
+			routes := buildRoutesWithExtensions(t, in, nil)
+			g.Expect(routes[0].GetResponseHeadersToAdd()[0].GetHeader().GetValue()).To(gomega.Equal(tt.want))
+		})
+	}
+}
+
+func TestResolveDestinationClusters(t *testing.T) {
+	registry := map[host.Name]*model.Service{
+		"single.example.org": {
+			Hostname: "single.example.org",
+			Ports:    model.PortList{{Name: "http", Port: 8080, Protocol: protocol.HTTP}},
+		},
+		"multi.example.org": {
+			Hostname: "multi.example.org",
+			Ports: model.PortList{
+				{Name: "http", Port: 80, Protocol: protocol.HTTP},
+				{Name: "grpc", Port: 9090, Protocol: protocol.GRPC},
+			},
+		},
+	}
+	destination := func(hostname string, port uint32) *networking.Destination {
+		dst := &networking.Destination{Host: hostname}
+		if port != 0 {
+			dst.Port = &networking.PortSelector{Number: port}
+		}
+		return dst
+	}
+	vs := config.Config{
+		Meta: config.Meta{GroupVersionKind: gvk.VirtualService, Name: "acme", Namespace: "default"},
+		Spec: &networking.VirtualService{
+			Hosts: []string{"example.org"},
+			Http: []*networking.HTTPRoute{{
+				Route: []*networking.HTTPRouteDestination{
+					{Destination: destination("multi.example.org", 9090)},
+					{Destination: destination("single.example.org", 0)},
+					{Destination: destination("single.example.org", 1234)},
+				},
+				Mirror: destination("unknown.example.org", 0),
+			}},
+			Tcp: []*networking.TCPRoute{{
+				Route: []*networking.RouteDestination{{Destination: destination("multi.example.org", 0)}},
+			}},
+		},
+	}
+
+	type resolved struct {
+		cluster string
+		err     error
+	}
+	resolve := func(listenPort int) []resolved {
+		t.Helper()
+		clusters, err := route.ResolveDestinationClusters(vs, registry, listenPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]resolved, 0, len(clusters))
+		for _, c := range clusters {
+			out = append(out, resolved{cluster: c.Cluster, err: c.Err})
+		}
+		return out
+	}
+	check := func(got []resolved, want []resolved) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %d clusters, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].cluster != want[i].cluster || !errors.Is(got[i].err, want[i].err) {
+				t.Errorf("destination %d: got %q (%v), want %q (%v)", i, got[i].cluster, got[i].err, want[i].cluster, want[i].err)
+			}
+		}
+	}
+
+	check(resolve(80), []resolved{
+		{cluster: "outbound|9090||multi.example.org"},
+		// The port of a single port service is inferred.
+		{cluster: "outbound|8080||single.example.org"},
+		{cluster: "outbound|1234||single.example.org", err: route.ErrUnknownDestinationPort},
+		{cluster: "outbound|80||unknown.example.org", err: route.ErrUnknownDestinationHost},
+		{cluster: "outbound|80||multi.example.org"},
+	})
+	// The listener port is not a port of the multi port service.
+	check(resolve(8443)[4:], []resolved{
+		{cluster: "outbound|8443||multi.example.org", err: route.ErrAmbiguousDestinationPort},
+	})
+
+	if _, err := route.ResolveDestinationClusters(config.Config{Spec: &networking.Gateway{}}, registry, 80); !errors.Is(err, route.ErrNotVirtualService) {
+		t.Errorf("got error %v, want %v", err, route.ErrNotVirtualService)
+	}
+}
+
+func TestCORSMaxAge(t *testing.T) {
+	cases := []struct {
+		name   string
+		maxAge *durationpb.Duration
+		want   string
+	}{
+		{name: "unset"},
+		{name: "zero", maxAge: durationpb.New(0), want: "0"},
+		{name: "whole minute", maxAge: durationpb.New(time.Minute), want: "60"},
+		{name: "rounded up", maxAge: durationpb.New(1500 * time.Millisecond), want: "2"},
+		{name: "rounded down", maxAge: durationpb.New(90*time.Second + 200*time.Millisecond), want: "90"},
+		{name: "negative", maxAge: durationpb.New(-time.Second)},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &networking.HTTPRoute{
+				CorsPolicy: &networking.CorsPolicy{AllowMethods: []string{"GET"}, MaxAge: tt.maxAge},
+				Route:      []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			routes := buildRoutesWithExtensions(t, in, nil)
+			if got := routes[0].GetRoute().GetCors().GetMaxAge(); got != tt.want {
+				t.Errorf("got max age %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSExposeHeaders(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []string
+		want    string
+	}{
+		{name: "unset"},
+		{name: "literal", headers: []string{"x-request-id", "x-trace"}, want: "x-request-id,x-trace"},
+		{name: "wildcard", headers: []string{"*"}, want: "*"},
+		{name: "unsupported pattern", headers: []string{"x-request-id", "x-custom-*"}, want: "x-request-id"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &networking.HTTPRoute{
+				CorsPolicy: &networking.CorsPolicy{AllowMethods: []string{"GET"}, ExposeHeaders: tt.headers},
+				Route:      []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			routes := buildRoutesWithExtensions(t, in, nil)
+			if got := routes[0].GetRoute().GetCors().GetExposeHeaders(); got != tt.want {
+				t.Errorf("got expose headers %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout *durationpb.Duration
+		want    time.Duration
+	}{
+		{name: "default", want: 5 * time.Second},
+		{name: "disabled", timeout: durationpb.New(0), want: 0},
+		{name: "concrete", timeout: durationpb.New(30 * time.Second), want: 30 * time.Second},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			test.SetForTest(t, &features.DefaultRequestTimeout, durationpb.New(5*time.Second))
+			in := &networking.HTTPRoute{
+				Timeout: tt.timeout,
+				Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+			}
+			action := buildRoutesWithExtensions(t, in, nil)[0].GetRoute()
+			if got := action.GetTimeout().AsDuration(); got != tt.want {
+				t.Errorf("got timeout %v, want %v", got, tt.want)
+			}
+			// Envoy only honors a disabled timeout when the max stream duration is disabled as well.
+			disabled := action.GetMaxStreamDuration().GetMaxStreamDuration() != nil
+			if disabled != (tt.want == 0) {
+				t.Errorf("got max stream duration %v, want it set only when the timeout is disabled", action.GetMaxStreamDuration())
+			}
+		})
+	}
+}
+
+func TestQueryParamsOrder(t *testing.T) {
+	params := map[string]*networking.StringMatch{}
+	for i := 0; i < 10; i++ {
+		params[fmt.Sprintf("param-%d", i)] = &networking.StringMatch{MatchType: &networking.StringMatch_Exact{Exact: "value"}}
+	}
+	in := &networking.HTTPRoute{
+		Match: []*networking.HTTPMatchRequest{{QueryParams: params}},
+		Route: []*networking.HTTPRouteDestination{exampleDestination(100)},
+	}
+	var want []string
+	for i := 0; i < 10; i++ {
+		// Map iteration order varies between builds, the query parameters must not.
+		var got []string
+		for _, q := range buildRoutesWithExtensions(t, in, nil)[0].GetMatch().GetQueryParameters() {
+			got = append(got, q.GetName())
+		}
+		if !sort.StringsAreSorted(got) {
+			t.Fatalf("query parameters are not sorted by name: %v", got)
+		}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got query parameters %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRegexMatchRewrite(t *testing.T) {
+	build := func(uri *networking.StringMatch, ignoreCase bool) *envoyroute.RouteAction {
+		in := &networking.HTTPRoute{
+			Match:   []*networking.HTTPMatchRequest{{Uri: uri, IgnoreUriCase: ignoreCase}},
+			Rewrite: &networking.HTTPRewrite{Uri: "/v2/\\1"},
+			Route:   []*networking.HTTPRouteDestination{exampleDestination(100)},
+		}
+		routes := buildRoutesWithExtensions(t, in, nil)
+		xdstest.ValidateRoutes(t, routes)
+		return routes[0].GetRoute()
+	}
+
+	t.Run("regex match", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		action := build(&networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: "/v1/(.*)"}}, false)
+		g.Expect(action.GetPrefixRewrite()).To(gomega.BeEmpty())
+		g.Expect(action.GetRegexRewrite().GetPattern().GetRegex()).To(gomega.Equal("/v1/(.*)"))
+		g.Expect(action.GetRegexRewrite().GetSubstitution()).To(gomega.Equal("/v2/\\1"))
+	})
+	t.Run("case insensitive regex match", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		action := build(&networking.StringMatch{MatchType: &networking.StringMatch_Regex{Regex: "/v1/(.*)"}}, true)
+		g.Expect(action.GetPrefixRewrite()).To(gomega.BeEmpty())
+		g.Expect(action.GetRegexRewrite().GetPattern().GetRegex()).To(gomega.Equal("(?i)/v1/(.*)"))
+	})
+	t.Run("prefix match", func(t *testing.T) {
+		g := gomega.NewWithT(t)
+		action := build(&networking.StringMatch{MatchType: &networking.StringMatch_Prefix{Prefix: "/v1/"}}, false)
+		g.Expect(action.GetPrefixRewrite()).To(gomega.Equal("/v2/\\1"))
+		g.Expect(action.GetRegexRewrite()).To(gomega.BeNil())
+	})
+}
+
+func TestOutboundTrafficPolicyCluster(t *testing.T) {
+	proxy := func(policy *networking.OutboundTrafficPolicy) *model.Proxy {
+		return &model.Proxy{SidecarScope: &model.SidecarScope{OutboundTrafficPolicy: policy}}
+	}
+	cases := []struct {
+		name string
+		node *model.Proxy
+		want string
+	}{
+		{
+			name: "allow any",
+			node: proxy(&networking.OutboundTrafficPolicy{Mode: networking.OutboundTrafficPolicy_ALLOW_ANY}),
+			want: util.PassthroughCluster,
+		},
+		{
+			name: "registry only",
+			node: proxy(&networking.OutboundTrafficPolicy{Mode: networking.OutboundTrafficPolicy_REGISTRY_ONLY}),
+			want: util.BlackHoleCluster,
+		},
+		{
+			name: "no policy",
+			node: &model.Proxy{},
+			want: util.BlackHoleCluster,
+		},
+		{
+			name: "allow any with egress proxy",
+			node: proxy(&networking.OutboundTrafficPolicy{
+				Mode: networking.OutboundTrafficPolicy_ALLOW_ANY,
+				EgressProxy: &networking.Destination{
+					Host:   "egress.istio-system.svc.cluster.local",
+					Subset: "proxy",
+					Port:   &networking.PortSelector{Number: 443},
+				},
+			}),
+			want: "outbound|443|proxy|egress.istio-system.svc.cluster.local",
+		},
+		{
+			name: "registry only with egress proxy",
+			node: proxy(&networking.OutboundTrafficPolicy{
+				Mode:        networking.OutboundTrafficPolicy_REGISTRY_ONLY,
+				EgressProxy: &networking.Destination{Host: "egress.istio-system.svc.cluster.local"},
+			}),
+			want: util.BlackHoleCluster,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, route.OutboundTrafficPolicyCluster(tt.node), tt.want)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/schema/kind"
+)
+
+// sidecarVirtualHostCache holds the virtual hosts built for virtual services when
+// features.EnableSidecarVirtualHostCache is set.
+var sidecarVirtualHostCache = newVirtualHostCache()
+
+// virtualHostCache memoizes the virtual hosts built for a virtual service on a port, so that
+// sidecars sharing the same routing inputs only build them once per push. Entries are only valid
+// for the push context they were built with; the cache drops them all when a new one is seen,
+// which invalidates them on any config or service change.
+type virtualHostCache struct {
+	mu      sync.Mutex
+	push    *model.PushContext
+	entries map[virtualHostCacheKey]*virtualHostCacheEntry
+}
+
+// virtualHostCacheKey includes the variables, beyond the push context, that can influence the
+// virtual hosts built for a virtual service.
+type virtualHostCacheKey struct {
+	virtualService model.ConfigKey
+	listenPort     int
+	// sidecarScope determines the destination rules visible to the proxy.
+	sidecarScope  *model.SidecarScope
+	namespace     string
+	labels        string
+	istioVersion  model.IstioVersion
+	proxylessGrpc bool
+	// registry is a digest of the services the proxy can reach on the port.
+	registry uint64
+}
+
+type virtualHostCacheEntry struct {
+	wrappers         []VirtualHostWrapper
+	destinationRules []*model.ConsolidatedDestRule
+}
+
+func newVirtualHostCache() *virtualHostCache {
+	return &virtualHostCache{entries: map[virtualHostCacheKey]*virtualHostCacheEntry{}}
+}
+
+func (c *virtualHostCache) get(push *model.PushContext, key virtualHostCacheKey) (*virtualHostCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.push != push {
+		return nil, false
+	}
+	entry, f := c.entries[key]
+	return entry, f
+}
+
+func (c *virtualHostCache) add(push *model.PushContext, key virtualHostCacheKey, entry *virtualHostCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.push != push {
+		c.push = push
+		c.entries = map[virtualHostCacheKey]*virtualHostCacheEntry{}
+	}
+	c.entries[key] = entry
+}
+
+// newVirtualHostCacheKey returns the cache key of the virtual hosts built for the virtual service. The
+// registry digest is computed once by the caller, as it is shared by all virtual services on the port.
+func newVirtualHostCacheKey(node *model.Proxy, virtualService config.Config, listenPort int, registry uint64) virtualHostCacheKey {
+	key := virtualHostCacheKey{
+		virtualService: model.ConfigKey{Kind: kind.VirtualService, Name: virtualService.Name, Namespace: virtualService.Namespace},
+		listenPort:     listenPort,
+		sidecarScope:   node.SidecarScope,
+		labels:         labels.Instance(node.Labels).String(),
+		proxylessGrpc:  node.IsProxylessGrpc(),
+		registry:       registry,
+	}
+	if node.Metadata != nil {
+		key.namespace = node.Metadata.Namespace
+	}
+	if node.IstioVersion != nil {
+		key.istioVersion = *node.IstioVersion
+	}
+	return key
+}
+
+// registryDigest returns a digest of the hostnames and ports of the services in the registry.
+// It does not depend on the iteration order of the registry.
+func registryDigest(serviceRegistry map[host.Name]*model.Service) uint64 {
+	var digest uint64
+	for hostname, svc := range serviceRegistry {
+		h := fnv.New64a()
+		h.Write([]byte(hostname))
+		for _, port := range svc.Ports {
+			h.Write([]byte{'~'})
+			h.Write([]byte(strconv.Itoa(port.Port)))
+			h.Write([]byte(port.Protocol))
+		}
+		digest += h.Sum64()
+	}
+	return digest
+}
+
+// resolveServices returns copies of the wrappers with their services taken from the registry of the
+// proxy, as the services carry proxy specific addresses.
+func resolveServices(wrappers []VirtualHostWrapper, serviceRegistry map[host.Name]*model.Service) []VirtualHostWrapper {
+	out := make([]VirtualHostWrapper, 0, len(wrappers))
+	for _, w := range wrappers {
+		services := make([]*model.Service, 0, len(w.Services))
+		for _, svc := range w.Services {
+			services = append(services, serviceRegistry[svc.Hostname])
+		}
+		w.Services = services
+		// Callers may append to the routes; do not let them share the backing array.
+		w.Routes = append(w.Routes[:0:0], w.Routes...)
+		out = append(out, w)
+	}
+	return out
+}
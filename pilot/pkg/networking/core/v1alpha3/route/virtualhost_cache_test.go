@@ -0,0 +1,166 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package route_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/route"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/test"
+)
+
+// virtualHostCacheTest holds a mesh of services, each with a virtual service splitting its traffic.
+type virtualHostCacheTest struct {
+	cg              *v1alpha3.ConfigGenTest
+	services        []*model.Service
+	virtualServices []config.Config
+}
+
+func newVirtualHostCacheTest(t test.Failer, n int) virtualHostCacheTest {
+	vt := virtualHostCacheTest{}
+	for i := 0; i < n; i++ {
+		hostname := fmt.Sprintf("svc-%d.default.svc.cluster.local", i)
+		vt.services = append(vt.services, &model.Service{
+			Hostname:       host.Name(hostname),
+			DefaultAddress: fmt.Sprintf("10.0.0.%d", i),
+			Ports:          model.PortList{{Name: "http", Port: 80, Protocol: protocol.HTTP}},
+			Attributes:     model.ServiceAttributes{Namespace: "default"},
+		})
+		vt.virtualServices = append(vt.virtualServices, config.Config{
+			Meta: config.Meta{
+				GroupVersionKind: gvk.VirtualService,
+				Name:             fmt.Sprintf("svc-%d", i),
+				Namespace:        "default",
+			},
+			Spec: &networking.VirtualService{
+				Hosts: []string{hostname},
+				Http: []*networking.HTTPRoute{{
+					Route: []*networking.HTTPRouteDestination{
+						{Destination: &networking.Destination{Host: hostname, Subset: "v1"}, Weight: 90},
+						{Destination: &networking.Destination{Host: hostname, Subset: "v2"}, Weight: 10},
+					},
+				}},
+			},
+		})
+	}
+	vt.cg = v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{Services: vt.services})
+	return vt
+}
+
+// build builds the virtual hosts on port 80 for a new sidecar.
+func (vt virtualHostCacheTest) build() []route.VirtualHostWrapper {
+	registry := make(map[host.Name]*model.Service, len(vt.services))
+	for _, svc := range vt.services {
+		registry[svc.Hostname] = svc
+	}
+	node := vt.cg.SetupProxy(nil)
+	return route.BuildSidecarVirtualHostWrapper(nil, node, vt.cg.PushContext(), registry, vt.virtualServices, 80)
+}
+
+func sortWrappers(wrappers []route.VirtualHostWrapper) {
+	sort.Slice(wrappers, func(i, j int) bool {
+		return wrappers[i].Services[0].Hostname < wrappers[j].Services[0].Hostname
+	})
+}
+
+// assertSameVirtualHosts checks that the virtual hosts have the same services and routes, in the same order.
+func assertSameVirtualHosts(t *testing.T, want, got []route.VirtualHostWrapper) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d virtual hosts, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Port != want[i].Port || got[i].Services[0] != want[i].Services[0] {
+			t.Fatalf("got virtual host for %s:%d, want %s:%d",
+				got[i].Services[0].Hostname, got[i].Port, want[i].Services[0].Hostname, want[i].Port)
+		}
+		if diff := cmp.Diff(want[i].Routes, got[i].Routes, protocmp.Transform()); diff != "" {
+			t.Fatalf("unexpected routes (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestSidecarVirtualHostCache(t *testing.T) {
+	vt := newVirtualHostCacheTest(t, 10)
+	want := vt.build()
+	sortWrappers(want)
+
+	test.SetForTest(t, &features.EnableSidecarVirtualHostCache, true)
+	// The first sidecar fills the cache, the second one is served from it.
+	for i := 0; i < 2; i++ {
+		got := vt.build()
+		sortWrappers(got)
+		assertSameVirtualHosts(t, want, got)
+	}
+}
+
+func TestSidecarVirtualHostConcurrency(t *testing.T) {
+	vt := newVirtualHostCacheTest(t, 50)
+	want := vt.build()
+
+	test.SetForTest(t, &features.SidecarVirtualHostConcurrency, 8)
+	assertSameVirtualHosts(t, want, vt.build())
+}
+
+func TestSidecarDefaultVirtualHostOrder(t *testing.T) {
+	vt := newVirtualHostCacheTest(t, 20)
+	// Without virtual services, every service gets a default virtual host.
+	vt.virtualServices = nil
+	want := vt.build()
+	if !sort.SliceIsSorted(want, func(i, j int) bool {
+		return want[i].Services[0].Hostname < want[j].Services[0].Hostname
+	}) {
+		t.Fatalf("default virtual hosts are not sorted by hostname")
+	}
+	for i := 0; i < 5; i++ {
+		assertSameVirtualHosts(t, want, vt.build())
+	}
+}
+
+func BenchmarkBuildSidecarVirtualHostWrapper(b *testing.B) {
+	vt := newVirtualHostCacheTest(b, 100)
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", cache), func(b *testing.B) {
+			test.SetForTest(b, &features.EnableSidecarVirtualHostCache, cache)
+			b.ReportAllocs()
+			// Each iteration builds the virtual hosts of an identical sidecar.
+			for n := 0; n < b.N; n++ {
+				vt.build()
+			}
+		})
+	}
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			test.SetForTest(b, &features.SidecarVirtualHostConcurrency, concurrency)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				vt.build()
+			}
+		})
+	}
+}
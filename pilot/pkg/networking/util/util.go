@@ -120,6 +120,18 @@ var ALPNDownstreamWithMxc = []string{"istio-peer-exchange", "h2", "http/1.1"}
 // RegexEngine is the default google RE2 regex engine.
 var RegexEngine = &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}}
 
+// ConfiguredRegexEngine returns the google RE2 regex engine, limited to the program size set by
+// features.RegexMaxProgramSize if any.
+func ConfiguredRegexEngine() *matcher.RegexMatcher_GoogleRe2 {
+	if features.RegexMaxProgramSize <= 0 {
+		return RegexEngine
+	}
+	return &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{
+		// nolint: staticcheck
+		MaxProgramSize: &wrapperspb.UInt32Value{Value: uint32(features.RegexMaxProgramSize)},
+	}}
+}
+
 func ListContains(haystack []string, needle string) bool {
 	for _, n := range haystack {
 		if needle == n {
@@ -617,7 +629,7 @@ func ConvertToEnvoyMatch(in *networking.StringMatch) *matcher.StringMatcher {
 		return &matcher.StringMatcher{
 			MatchPattern: &matcher.StringMatcher_SafeRegex{
 				SafeRegex: &matcher.RegexMatcher{
-					EngineType: RegexEngine,
+					EngineType: ConfiguredRegexEngine(),
 					Regex:      m.Regex,
 				},
 			},
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
 	"net/netip"
@@ -374,14 +375,20 @@ func ValidateHTTPHeaderOperationName(name string) error {
 }
 
 // ValidateHTTPHeaderValue validates a header value for Envoy
-// Valid: "foo", "%HOSTNAME%", "100%%", "prefix %HOSTNAME% suffix"
+// Valid: "foo", "%HOSTNAME%", "100%%", "prefix %HOSTNAME% suffix", "%ENVIRONMENT(POD_NAME)%"
 // Invalid: "abc%123"
+// Warning, as the value is escaped into a literal: "%hostname%", "a%b%c"
 // We don't try to check that what is inside the %% is one of Envoy recognized values, we just prevent invalid config.
 // See: https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_conn_man/headers.html#custom-request-response-headers
 func ValidateHTTPHeaderValue(value string) error {
 	if strings.Count(value, "%")%2 != 0 {
 		return errors.New("single % not allowed.  Escape by doubling to %% or encase Envoy variable name in pair of %")
 	}
+	// Values with an even number of % were always accepted, so the stricter syntax check only warns; such values
+	// are escaped when translated, e.g. "a%b%c" is sent as the literal "a%%b%%c".
+	if err := xds.ValidateHeaderValueFormat(value); err != nil {
+		return Warningf("header value %q is sent as a literal: %v", value, err)
+	}
 	return nil
 }
 
@@ -1471,6 +1478,16 @@ func validateLoadBalancer(settings *networking.LoadBalancerSettings, outlier *ne
 		if consistentHash.MinimumRingSize != 0 && consistentHash.GetHashAlgorithm() != nil {
 			errs = appendValidation(errs, fmt.Errorf("only one of MinimumRingSize or Maglev/Ringhash can be specified"))
 		}
+		if maglev := consistentHash.GetMaglev(); maglev != nil {
+			// Maglev hashes the source IP of the connection, so every client behind the same NAT, gateway
+			// or sidecar is sent to the same host and the load is not spread.
+			if consistentHash.GetUseSourceIp() {
+				errs = appendValidation(errs, Warningf("maglev consistent hash on the source IP sends all clients sharing an address to the same host"))
+			}
+			if maglev.TableSize != 0 && !new(big.Int).SetUint64(maglev.TableSize).ProbablyPrime(0) {
+				errs = appendValidation(errs, Warningf("maglev table size %d is not a prime number and is rejected by Envoy", maglev.TableSize))
+			}
+		}
 	}
 
 	errs = appendValidation(errs, validateLocalityLbSetting(settings.LocalityLbSetting, outlier))
@@ -2764,49 +2781,49 @@ func validateGatewayNames(gatewayNames []string) (errs Validation) {
 	return
 }
 
-func validateHTTPRouteDestinations(weights []*networking.HTTPRouteDestination, gatewaySemantics bool) (errs error) {
+func validateHTTPRouteDestinations(weights []*networking.HTTPRouteDestination, gatewaySemantics bool) (errs Validation) {
 	var totalWeight int32
 	for _, weight := range weights {
 		if weight == nil {
-			errs = multierror.Append(errs, errors.New("weight may not be nil"))
+			errs = appendValidation(errs, errors.New("weight may not be nil"))
 			continue
 		}
 		if weight.Destination == nil {
-			errs = multierror.Append(errs, errors.New("destination is required"))
+			errs = appendValidation(errs, errors.New("destination is required"))
 		}
 
 		// header manipulations
 		for name, val := range weight.Headers.GetRequest().GetAdd() {
-			errs = appendErrors(errs, ValidateHTTPHeaderWithHostOperationName(name))
-			errs = appendErrors(errs, ValidateHTTPHeaderValue(val))
+			errs = appendValidation(errs, ValidateHTTPHeaderWithHostOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderValue(val))
 		}
 		for name, val := range weight.Headers.GetRequest().GetSet() {
-			errs = appendErrors(errs, ValidateHTTPHeaderWithHostOperationName(name))
-			errs = appendErrors(errs, ValidateHTTPHeaderValue(val))
+			errs = appendValidation(errs, ValidateHTTPHeaderWithHostOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderValue(val))
 		}
 		for _, name := range weight.Headers.GetRequest().GetRemove() {
-			errs = appendErrors(errs, ValidateHTTPHeaderOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderOperationName(name))
 		}
 		for name, val := range weight.Headers.GetResponse().GetAdd() {
-			errs = appendErrors(errs, ValidateHTTPHeaderOperationName(name))
-			errs = appendErrors(errs, ValidateHTTPHeaderValue(val))
+			errs = appendValidation(errs, ValidateHTTPHeaderOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderValue(val))
 		}
 		for name, val := range weight.Headers.GetResponse().GetSet() {
-			errs = appendErrors(errs, ValidateHTTPHeaderOperationName(name))
-			errs = appendErrors(errs, ValidateHTTPHeaderValue(val))
+			errs = appendValidation(errs, ValidateHTTPHeaderOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderValue(val))
 		}
 		for _, name := range weight.Headers.GetResponse().GetRemove() {
-			errs = appendErrors(errs, ValidateHTTPHeaderOperationName(name))
+			errs = appendValidation(errs, ValidateHTTPHeaderOperationName(name))
 		}
 
 		if !gatewaySemantics {
-			errs = appendErrors(errs, validateDestination(weight.Destination))
+			errs = appendValidation(errs, validateDestination(weight.Destination))
 		}
-		errs = appendErrors(errs, validateWeight(weight.Weight))
+		errs = appendValidation(errs, validateWeight(weight.Weight))
 		totalWeight += weight.Weight
 	}
 	if len(weights) > 1 && totalWeight == 0 {
-		errs = appendErrors(errs, fmt.Errorf("total destination weight = 0"))
+		errs = appendValidation(errs, fmt.Errorf("total destination weight = 0"))
 	}
 	return
 }
@@ -1675,6 +1675,36 @@ func TestValidateHTTPHeaderName(t *testing.T) {
 	}
 }
 
+func TestValidateHTTPHeaderValue(t *testing.T) {
+	testCases := []struct {
+		value   string
+		valid   bool
+		warning bool
+	}{
+		{value: "foo", valid: true},
+		{value: "100%%", valid: true},
+		{value: "%HOSTNAME%", valid: true},
+		{value: "prefix %HOSTNAME% suffix", valid: true},
+		{value: "%ENVIRONMENT(POD_NAME)%", valid: true},
+		{value: "%REQ(x-foo?x-bar):10%", valid: true},
+		{value: "%START_TIME(%s.%3f)%", valid: true},
+		{value: "%UPSTREAM_METADATA([\"istio\", \"zone\"])%-%%", valid: true},
+		{value: "abc%123", valid: false},
+		{value: "50% off", valid: false},
+		{value: "%hostname%", valid: true, warning: true},
+		{value: "a%b%c", valid: true, warning: true},
+		{value: "%ENVIRONMENT(POD_NAME%", valid: true, warning: true},
+		{value: "%REQ(x-foo):%", valid: true, warning: true},
+	}
+
+	for _, tc := range testCases {
+		warn, err := appendValidation(Validation{}, ValidateHTTPHeaderValue(tc.value)).Unwrap()
+		if (err == nil) != tc.valid || (warn != nil) != tc.warning {
+			t.Errorf("ValidateHTTPHeaderValue(%q) => got valid=%v warning=%v, want valid=%v warning=%v: %v %v",
+				tc.value, err == nil, warn != nil, tc.valid, tc.warning, err, warn)
+		}
+	}
+}
 func TestValidateCORSPolicy(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -2554,6 +2584,26 @@ func TestValidateDestination(t *testing.T) {
 	}
 }
 
+func TestValidateHTTPRouteHeaderValueWarning(t *testing.T) {
+	headers := &networking.Headers{Request: &networking.Headers_HeaderOperations{Set: map[string]string{"x-discount": "a%b%c"}}}
+	for name, http := range map[string]*networking.HTTPRoute{
+		"route": {
+			Headers: headers,
+			Route:   []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "foo.bar"}}},
+		},
+		"destination": {
+			Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: "foo.bar"}, Headers: headers}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			warn, err := validateHTTPRoute(http, false, false).Unwrap()
+			if err != nil || warn == nil {
+				t.Errorf("got err=%v warning=%v, want a warning only", err, warn)
+			}
+		})
+	}
+}
+
 func TestValidateHTTPRoute(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -3091,6 +3141,17 @@ func TestValidateVirtualService(t *testing.T) {
 				}},
 			}},
 		}, valid: true, warning: true},
+		{name: "mirror percent and percentage", in: &networking.VirtualService{
+			Hosts:    []string{"foo.bar"},
+			Gateways: []string{"ns1/gateway"},
+			Http: []*networking.HTTPRoute{{
+				MirrorPercent:    &wrapperspb.UInt32Value{Value: 5},
+				MirrorPercentage: &networking.Percent{Value: 10},
+				Route: []*networking.HTTPRouteDestination{{
+					Destination: &networking.Destination{Host: "foo.baz"},
+				}},
+			}},
+		}, valid: true, warning: true},
 		{name: "set authority", in: &networking.VirtualService{
 			Hosts: []string{"foo.bar"},
 			Http: []*networking.HTTPRoute{{
@@ -3848,6 +3909,7 @@ func TestValidateLoadBalancer(t *testing.T) {
 		name  string
 		in    *networking.LoadBalancerSettings
 		valid bool
+		warn  bool
 	}{
 		{
 			name: "valid load balancer with simple load balancing", in: &networking.LoadBalancerSettings{
@@ -3873,6 +3935,7 @@ func TestValidateLoadBalancer(t *testing.T) {
 				},
 			},
 			valid: true,
+			warn:  true,
 		},
 
 		{
@@ -3889,6 +3952,7 @@ func TestValidateLoadBalancer(t *testing.T) {
 				},
 			},
 			valid: false,
+			warn:  true,
 		},
 
 		{
@@ -3905,14 +3969,78 @@ func TestValidateLoadBalancer(t *testing.T) {
 				},
 			},
 			valid: false,
+			warn:  true,
+		},
+
+		{
+			name: "load balancer with maglev and source ip", in: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true},
+						HashAlgorithm: &networking.LoadBalancerSettings_ConsistentHashLB_Maglev{
+							Maglev: &networking.LoadBalancerSettings_ConsistentHashLB_MagLev{TableSize: 65537},
+						},
+					},
+				},
+			},
+			valid: true,
+			warn:  true,
+		},
+
+		{
+			name: "valid load balancer with maglev and header", in: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{HttpHeaderName: "x-user"},
+						HashAlgorithm: &networking.LoadBalancerSettings_ConsistentHashLB_Maglev{
+							Maglev: &networking.LoadBalancerSettings_ConsistentHashLB_MagLev{TableSize: 65537},
+						},
+					},
+				},
+			},
+			valid: true,
+		},
+
+		{
+			name: "load balancer with maglev, table size not prime", in: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{HttpHeaderName: "x-user"},
+						HashAlgorithm: &networking.LoadBalancerSettings_ConsistentHashLB_Maglev{
+							Maglev: &networking.LoadBalancerSettings_ConsistentHashLB_MagLev{TableSize: 65536},
+						},
+					},
+				},
+			},
+			valid: true,
+			warn:  true,
+		},
+
+		{
+			name: "load balancer with maglev, source ip hashing turned off", in: &networking.LoadBalancerSettings{
+				LbPolicy: &networking.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networking.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networking.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: false},
+						HashAlgorithm: &networking.LoadBalancerSettings_ConsistentHashLB_Maglev{
+							Maglev: &networking.LoadBalancerSettings_ConsistentHashLB_MagLev{},
+						},
+					},
+				},
+			},
+			valid: true,
 		},
 	}
 
 	for _, c := range cases {
-		if got := validateLoadBalancer(c.in, nil); (got.Err == nil) != c.valid {
+		got := validateLoadBalancer(c.in, nil)
+		if (got.Err == nil) != c.valid {
 			t.Errorf("validateLoadBalancer failed on %v: got valid=%v but wanted valid=%v: %v",
 				c.name, got.Err == nil, c.valid, got)
 		}
+		if (got.Warning != nil) != c.warn {
+			t.Errorf("validateLoadBalancer failed on %v: got warn=%v but wanted warn=%v: %v",
+				c.name, got.Warning != nil, c.warn, got.Warning)
+		}
 	}
 }
 
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"strings"
 
+	"google.golang.org/protobuf/types/known/durationpb"
+
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pkg/config/labels"
 )
@@ -83,6 +85,9 @@ func validateHTTPRoute(http *networking.HTTPRoute, delegate, gatewaySemantics bo
 			errs = appendValidation(errs, fmt.Errorf("mirror_percent must have a max value of 100 (it has %d)", value))
 		}
 		errs = appendValidation(errs, WrapWarning(errors.New(`using deprecated setting "mirrorPercent", use "mirrorPercentage" instead`)))
+		if http.MirrorPercentage != nil {
+			errs = appendValidation(errs, WrapWarning(errors.New(`both "mirrorPercent" and "mirrorPercentage" are set, "mirrorPercent" is ignored`)))
+		}
 	}
 
 	if http.MirrorPercentage != nil {
@@ -105,10 +110,25 @@ func validateHTTPRoute(http *networking.HTTPRoute, delegate, gatewaySemantics bo
 	if http.Timeout != nil {
 		errs = appendValidation(errs, ValidateDuration(http.Timeout))
 	}
+	errs = appendValidation(errs, validatePerTryTimeout(http.Retries, http.Timeout))
 
 	return
 }
 
+// validatePerTryTimeout warns when the retry per-try timeout exceeds the route timeout, as Envoy silently caps
+// each try by the overall route timeout.
+func validatePerTryTimeout(retries *networking.HTTPRetry, timeout *durationpb.Duration) Validation {
+	if retries.GetPerTryTimeout() == nil || timeout == nil {
+		return Validation{}
+	}
+	// A zero timeout disables the route timeout, so there is nothing to cap the per-try timeout.
+	if timeout.AsDuration() == 0 || retries.GetPerTryTimeout().AsDuration() <= timeout.AsDuration() {
+		return Validation{}
+	}
+	return WrapWarning(fmt.Errorf("retries.perTryTimeout %v exceeds the route timeout %v and will be capped by it",
+		retries.GetPerTryTimeout().AsDuration(), timeout.AsDuration()))
+}
+
 // validateAuthorityRewrite ensures we only attempt rewrite authority in a single place.
 func validateAuthorityRewrite(rewrite *networking.HTTPRewrite, headers *networking.Headers) error {
 	current := rewrite.GetAuthority()
@@ -16,8 +16,10 @@ package validation
 
 import (
 	"testing"
+	"time"
 
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	networking "istio.io/api/networking/v1alpha3"
@@ -619,3 +621,51 @@ func TestValidateDelegateHTTPRoute(t *testing.T) {
 		})
 	}
 }
+
+func TestValidatePerTryTimeout(t *testing.T) {
+	testCases := []struct {
+		name    string
+		route   *networking.HTTPRoute
+		warning bool
+	}{
+		{name: "per-try timeout within route timeout", route: &networking.HTTPRoute{
+			Timeout: durationpb.New(10 * time.Second),
+			Retries: &networking.HTTPRetry{Attempts: 3, PerTryTimeout: durationpb.New(2 * time.Second)},
+			Route: []*networking.HTTPRouteDestination{{
+				Destination: &networking.Destination{Host: "foo.bar"},
+			}},
+		}, warning: false},
+		{name: "per-try timeout exceeds route timeout", route: &networking.HTTPRoute{
+			Timeout: durationpb.New(1 * time.Second),
+			Retries: &networking.HTTPRetry{Attempts: 3, PerTryTimeout: durationpb.New(5 * time.Second)},
+			Route: []*networking.HTTPRouteDestination{{
+				Destination: &networking.Destination{Host: "foo.bar"},
+			}},
+		}, warning: true},
+		{name: "route timeout disabled", route: &networking.HTTPRoute{
+			Timeout: durationpb.New(0),
+			Retries: &networking.HTTPRetry{Attempts: 3, PerTryTimeout: durationpb.New(5 * time.Second)},
+			Route: []*networking.HTTPRouteDestination{{
+				Destination: &networking.Destination{Host: "foo.bar"},
+			}},
+		}, warning: false},
+		{name: "no route timeout", route: &networking.HTTPRoute{
+			Retries: &networking.HTTPRetry{Attempts: 3, PerTryTimeout: durationpb.New(5 * time.Second)},
+			Route: []*networking.HTTPRouteDestination{{
+				Destination: &networking.Destination{Host: "foo.bar"},
+			}},
+		}, warning: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePerTryTimeout(tc.route.Retries, tc.route.Timeout)
+			if err.Err != nil {
+				t.Fatalf("unexpected error: %v", err.Err)
+			}
+			if (err.Warning != nil) != tc.warning {
+				t.Fatalf("got warning=%v but wanted warning=%v: %v", err.Warning != nil, tc.warning, err.Warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateHeaderValueFormat validates a header value for the Envoy header formatter: every "%" is either
+// escaped as "%%" or encloses a command operator, e.g. "%HOSTNAME%", "%REQ(x-foo):10%" or
+// "%ENVIRONMENT(POD_NAME)%". Whether Envoy knows the command operator is not checked.
+// See: https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_conn_man/headers.html#custom-request-response-headers
+func ValidateHeaderValueFormat(value string) error {
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			continue
+		}
+		if i+1 < len(value) && value[i+1] == '%' {
+			i++
+			continue
+		}
+		end := commandOperatorEnd(value, i)
+		if end < 0 {
+			return fmt.Errorf("%q at position %d is neither escaped as %%%% nor the start of a command operator like %%HOSTNAME%%", "%", i)
+		}
+		i = end - 1
+	}
+	return nil
+}
+
+// EscapeHeaderValue escapes as "%%" the "%" of a header value that are neither escaped already nor part of a
+// command operator, so that literal percent signs, e.g. in "50% off", do not make the Envoy header formatter
+// reject the value. Command operators are kept verbatim for Envoy to expand.
+func EscapeHeaderValue(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+1 < len(value) && value[i+1] == '%' {
+			b.WriteString("%%")
+			i++
+			continue
+		}
+		if end := commandOperatorEnd(value, i); end >= 0 {
+			b.WriteString(value[i:end])
+			i = end - 1
+			continue
+		}
+		b.WriteString("%%")
+	}
+	return b.String()
+}
+
+// commandOperatorEnd returns the index just past the command operator starting with the "%" at value[start],
+// or -1 if no command operator starts there. A command operator is an upper case name, with optional arguments
+// in parentheses and an optional ":N" length, enclosed in "%".
+func commandOperatorEnd(value string, start int) int {
+	i := start + 1
+	if i >= len(value) || !isUpper(value[i]) {
+		return -1
+	}
+	for i < len(value) && (isUpper(value[i]) || isDigit(value[i]) || value[i] == '_') {
+		i++
+	}
+	if i < len(value) && value[i] == '(' {
+		// Arguments may contain "%", e.g. "%START_TIME(%s)%".
+		end := strings.IndexByte(value[i:], ')')
+		if end < 0 {
+			return -1
+		}
+		i += end + 1
+	}
+	if i < len(value) && value[i] == ':' {
+		j := i + 1
+		for j < len(value) && isDigit(value[j]) {
+			j++
+		}
+		if j == i+1 {
+			return -1
+		}
+		i = j
+	}
+	if i < len(value) && value[i] == '%' {
+		return i + 1
+	}
+	return -1
+}
+
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}